@@ -4,7 +4,9 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"time"
 
+	"github.com/metal-stack/api-server/pkg/db/validate"
 	"github.com/urfave/cli/v2"
 )
 
@@ -170,6 +172,64 @@ var (
 		Value: "http://ipam:9090",
 		Usage: "the ipam grpc server endpoint",
 	}
+	ipAllocationTimeoutFlag = &cli.DurationFlag{
+		Name:  "ip-allocation-timeout",
+		Value: 10 * time.Second,
+		Usage: "the maximum duration the allocation of an ip in ipam may take, regardless of the request deadline, 0 disables the timeout",
+	}
+	machineIPRetryWindowFlag = &cli.DurationFlag{
+		Name:  "machine-ip-retry-window",
+		Value: 0,
+		Usage: "the window in which a retried random allocation of an ip for a machine returns the ip already allocated for it in the same network and addressfamily, 0 always allocates a new ip",
+	}
+	maxPrefixAttemptsFlag = &cli.IntFlag{
+		Name:  "max-prefix-attempts",
+		Value: 0,
+		Usage: "the maximum number of prefixes of a network which are tried on the allocation of a random ip, 0 tries all prefixes",
+	}
+	projectLookupTimeoutFlag = &cli.DurationFlag{
+		Name:  "project-lookup-timeout",
+		Value: 5 * time.Second,
+		Usage: "the maximum duration the lookup of the project of an ip allocation may take, regardless of the request deadline, 0 disables the timeout",
+	}
+	chargeableIPTypesFlag = &cli.StringSliceFlag{
+		Name:  "chargeable-ip-types",
+		Usage: "the types of ips which are chargeable, e.g. static, no ip is chargeable if not given",
+	}
+	chargeableIPNetworksFlag = &cli.StringSliceFlag{
+		Name:  "chargeable-ip-networks",
+		Usage: "the networks whose ips are chargeable if they are of a chargeable type, ips of all networks if not given",
+	}
+	networkCacheTTLFlag = &cli.DurationFlag{
+		Name:  "network-cache-ttl",
+		Value: 3 * time.Second,
+		Usage: "the duration networks are cached for the allocation of ips, changes of other instances are seen after this duration at the latest, 0 disables the cache",
+	}
+	ipamNamespaceFlag = &cli.StringFlag{
+		Name:  "ipam-namespace",
+		Value: "",
+		Usage: "the ipam namespace the prefixes of a network live in, either network or project, all prefixes are in the default namespace if not given. must not be changed once networks exist",
+	}
+	prefixWarningThresholdFlag = &cli.IntFlag{
+		Name:  "prefix-warning-threshold",
+		Value: 0,
+		Usage: "the utilization of a prefix in percent from which on the allocation of an ip in it logs a warning, the allocation succeeds anyway. 0 disables the warning",
+	}
+	releaseEphemeralIPsOnProjectDeletionFlag = &cli.BoolFlag{
+		Name:  "release-ephemeral-ips-on-project-deletion",
+		Value: false,
+		Usage: "release the ephemeral ips of a project on its deletion, static ips must still be released explicitly. if not set, all ips must be released before",
+	}
+	maxNameLengthFlag = &cli.IntFlag{
+		Name:  "max-name-length",
+		Value: validate.DefaultLengthLimits.Name,
+		Usage: "the maximum number of characters of the name of an entity, 0 disables the check",
+	}
+	maxDescriptionLengthFlag = &cli.IntFlag{
+		Name:  "max-description-length",
+		Value: validate.DefaultLengthLimits.Description,
+		Usage: "the maximum number of characters of the description of an entity, 0 disables the check",
+	}
 )
 
 func main() {
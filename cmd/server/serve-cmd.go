@@ -14,6 +14,9 @@ import (
 	"github.com/avast/retry-go/v4"
 	compress "github.com/klauspost/connect-compress/v2"
 
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/db/repository"
+	"github.com/metal-stack/api-server/pkg/db/validate"
 	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
 	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
 	mdm "github.com/metal-stack/masterdata-api/pkg/client"
@@ -58,6 +61,18 @@ var serveCmd = &cli.Command{
 		maxRequestsPerMinuteFlag,
 		maxRequestsPerMinuteUnauthenticatedFlag,
 		ipamGrpcEndpointFlag,
+		ipAllocationTimeoutFlag,
+		machineIPRetryWindowFlag,
+		maxPrefixAttemptsFlag,
+		projectLookupTimeoutFlag,
+		chargeableIPTypesFlag,
+		chargeableIPNetworksFlag,
+		networkCacheTTLFlag,
+		ipamNamespaceFlag,
+		prefixWarningThresholdFlag,
+		releaseEphemeralIPsOnProjectDeletionFlag,
+		maxNameLengthFlag,
+		maxDescriptionLengthFlag,
 	},
 	Action: func(ctx *cli.Context) error {
 		log, level, err := createLoggers(ctx)
@@ -85,6 +100,18 @@ var serveCmd = &cli.Command{
 			os.Exit(1)
 		}
 
+		chargeableRule, err := metal.NewChargeableRule(ctx.StringSlice(chargeableIPTypesFlag.Name), ctx.StringSlice(chargeableIPNetworksFlag.Name))
+		if err != nil {
+			log.Error("unable to create chargeable ip rule", "error", err)
+			os.Exit(1)
+		}
+
+		ipamNamespace, err := repository.NewIPAMNamespaceFunc(ctx.String(ipamNamespaceFlag.Name))
+		if err != nil {
+			log.Error("unable to create ipam namespace", "error", err)
+			os.Exit(1)
+		}
+
 		c := config{
 			HttpServerEndpoint:                  ctx.String(httpServerEndpointFlag.Name),
 			MetricsServerEndpoint:               ctx.String(metricServerEndpointFlag.Name),
@@ -102,6 +129,19 @@ var serveCmd = &cli.Command{
 			RethinkDB:                           ctx.String(rethinkdbDBFlag.Name),
 			RethinkDBSession:                    rethinkDBSession,
 			Ipam:                                ipam,
+			IPAllocationTimeout:                 ctx.Duration(ipAllocationTimeoutFlag.Name),
+			MachineIPRetryWindow:                ctx.Duration(machineIPRetryWindowFlag.Name),
+			MaxPrefixAttempts:                   ctx.Int(maxPrefixAttemptsFlag.Name),
+			ProjectLookupTimeout:                ctx.Duration(projectLookupTimeoutFlag.Name),
+			ChargeableIPRule:                    chargeableRule,
+			NetworkCacheTTL:                     ctx.Duration(networkCacheTTLFlag.Name),
+			IPAMNamespace:                       ipamNamespace,
+			PrefixWarningThreshold:              ctx.Int(prefixWarningThresholdFlag.Name),
+			ReleaseEphemeralIPs:                 ctx.Bool(releaseEphemeralIPsOnProjectDeletionFlag.Name),
+			LengthLimits: validate.LengthLimits{
+				Name:        ctx.Int(maxNameLengthFlag.Name),
+				Description: ctx.Int(maxDescriptionLengthFlag.Name),
+			},
 		}
 
 		log.Info("running api-server", "version", v.V, "level", level, "http endpoint", c.HttpServerEndpoint)
@@ -32,7 +32,9 @@ import (
 	"github.com/metal-stack/api-server/pkg/auth"
 	"github.com/metal-stack/api-server/pkg/certs"
 	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
 	"github.com/metal-stack/api-server/pkg/db/repository"
+	dbvalidate "github.com/metal-stack/api-server/pkg/db/validate"
 	"github.com/metal-stack/api-server/pkg/invite"
 	ratelimiter "github.com/metal-stack/api-server/pkg/rate-limiter"
 	"github.com/metal-stack/api-server/pkg/service/filesystem"
@@ -69,6 +71,16 @@ type config struct {
 	RethinkDBSession                    *r.Session
 	RethinkDB                           string
 	Ipam                                ipamv1connect.IpamServiceClient
+	IPAllocationTimeout                 time.Duration
+	MachineIPRetryWindow                time.Duration
+	MaxPrefixAttempts                   int
+	ProjectLookupTimeout                time.Duration
+	ChargeableIPRule                    metal.ChargeableRule
+	NetworkCacheTTL                     time.Duration
+	IPAMNamespace                       repository.IPAMNamespaceFunc
+	PrefixWarningThreshold              int
+	LengthLimits                        dbvalidate.LengthLimits
+	ReleaseEphemeralIPs                 bool
 }
 type server struct {
 	c   config
@@ -165,22 +177,34 @@ func (s *server) Run() error {
 		Log:          s.log,
 		MasterClient: s.c.MasterClient,
 	})
-	projectService := project.New(project.Config{
-		Log:          s.log,
-		MasterClient: s.c.MasterClient,
-		InviteStore:  inviteStore,
-	})
-
 	ds, err := generic.New(s.log, s.c.RethinkDB, s.c.RethinkDBSession)
 	if err != nil {
 		return err
 	}
 
-	repo, err := repository.New(s.log, s.c.MasterClient, ds, s.c.Ipam, txRedisClient)
+	repo, err := repository.New(s.log, s.c.MasterClient, ds, s.c.Ipam, txRedisClient, repository.Config{
+		AllocationTimeout:      s.c.IPAllocationTimeout,
+		MachineRetryWindow:     s.c.MachineIPRetryWindow,
+		MaxPrefixAttempts:      s.c.MaxPrefixAttempts,
+		ProjectLookupTimeout:   s.c.ProjectLookupTimeout,
+		ChargeableRule:         s.c.ChargeableIPRule,
+		LengthLimits:           s.c.LengthLimits,
+		IPAMNamespace:          s.c.IPAMNamespace,
+		PrefixWarningThreshold: s.c.PrefixWarningThreshold,
+		NetworkCacheTTL:        s.c.NetworkCacheTTL,
+	})
 	if err != nil {
 		return err
 	}
 
+	projectService := project.New(project.Config{
+		Log:                 s.log,
+		MasterClient:        s.c.MasterClient,
+		Repo:                repo,
+		InviteStore:         inviteStore,
+		ReleaseEphemeralIPs: s.c.ReleaseEphemeralIPs,
+	})
+
 	ipService := ip.New(ip.Config{Log: s.log, Repo: repo})
 	filesystemService := filesystem.New(filesystem.Config{Log: s.log, Repo: repo})
 	tokenService := token.New(token.Config{
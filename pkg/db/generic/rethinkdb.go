@@ -43,6 +43,15 @@ type (
 		Get(ctx context.Context, id string) (E, error)
 		Find(ctx context.Context, queries ...EntityQuery) (E, error)
 		List(ctx context.Context, queries ...EntityQuery) ([]E, error)
+		Iterate(ctx context.Context, fn func(E) error, queries ...EntityQuery) error
+		CountBy(ctx context.Context, field string, queries ...EntityQuery) (map[string]int, error)
+		CountByFields(ctx context.Context, fields []string, queries ...EntityQuery) ([]FieldsCount, error)
+	}
+
+	// FieldsCount is the number of entities with the same values of several fields, the values are in the order of the fields.
+	FieldsCount struct {
+		Values []string
+		Count  int
 	}
 
 	Datastore struct {
@@ -237,6 +246,139 @@ func (rs *rethinkStore[E]) List(ctx context.Context, queries ...EntityQuery) ([]
 	return *result, nil
 }
 
+// Iterate calls fn for every entity present in the database, optionally filtered by the given set of queries.
+// In contrast to List the entities are fetched one after another, so not all of them are held in memory at once.
+// Iterating stops with the first error returned by fn.
+func (rs *rethinkStore[E]) Iterate(ctx context.Context, fn func(E) error, queries ...EntityQuery) error {
+	query := rs.table
+	for _, q := range queries {
+		if q == nil {
+			continue
+		}
+		query = q(query)
+	}
+
+	rs.log.Debug("iterate", "table", rs.table, "query", query.String())
+
+	res, err := query.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return fmt.Errorf("cannot search %v in database: %w", rs.tableName, err)
+	}
+	defer res.Close()
+
+	for {
+		e := new(E)
+		if !res.Next(e) {
+			break
+		}
+
+		err = fn(*e)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = res.Err()
+	if err != nil {
+		return fmt.Errorf("cannot fetch entities: %w", err)
+	}
+
+	return nil
+}
+
+// CountBy returns the number of entities per distinct value of the given field, optionally filtered by the given set of queries.
+// The grouping is done by the database, entities are not fetched.
+func (rs *rethinkStore[E]) CountBy(ctx context.Context, field string, queries ...EntityQuery) (map[string]int, error) {
+	query := rs.table
+	for _, q := range queries {
+		if q == nil {
+			continue
+		}
+		query = q(query)
+	}
+	query = query.Group(field).Count().Ungroup()
+
+	rs.log.Debug("count by", "table", rs.table, "query", query.String())
+
+	res, err := query.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("cannot count %v in database: %w", rs.tableName, err)
+	}
+	defer res.Close()
+
+	var groups []struct {
+		Group     string `rethinkdb:"group"`
+		Reduction int    `rethinkdb:"reduction"`
+	}
+	err = res.All(&groups)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch counts: %w", err)
+	}
+
+	counts := make(map[string]int, len(groups))
+	for _, g := range groups {
+		counts[g.Group] = g.Reduction
+	}
+
+	return counts, nil
+}
+
+// CountByFields returns the number of entities per distinct combination of values of the given fields, optionally filtered by the given set of queries.
+// The grouping is done by the database, entities are not fetched.
+func (rs *rethinkStore[E]) CountByFields(ctx context.Context, fields []string, queries ...EntityQuery) ([]FieldsCount, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("at least one field must be given to count by")
+	}
+
+	query := rs.table
+	for _, q := range queries {
+		if q == nil {
+			continue
+		}
+		query = q(query)
+	}
+
+	var groupBy []any
+	for _, f := range fields {
+		groupBy = append(groupBy, f)
+	}
+	query = query.Group(groupBy...).Count().Ungroup()
+
+	rs.log.Debug("count by fields", "table", rs.table, "query", query.String())
+
+	res, err := query.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("cannot count %v in database: %w", rs.tableName, err)
+	}
+	defer res.Close()
+
+	// a single field is grouped by its value, several fields by the array of their values
+	var groups []struct {
+		Group     any `rethinkdb:"group"`
+		Reduction int `rethinkdb:"reduction"`
+	}
+	err = res.All(&groups)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch counts: %w", err)
+	}
+
+	counts := make([]FieldsCount, 0, len(groups))
+	for _, g := range groups {
+		group, ok := g.Group.([]any)
+		if !ok {
+			group = []any{g.Group}
+		}
+		values := make([]string, 0, len(group))
+		for _, v := range group {
+			value, _ := v.(string)
+			values = append(values, value)
+		}
+		counts = append(counts, FieldsCount{Values: values, Count: g.Reduction})
+	}
+
+	return counts, nil
+}
+
 // Get returns the entity of the given ID  from the database.
 func (rs *rethinkStore[E]) Get(ctx context.Context, id string) (E, error) {
 	var zero E
@@ -2,6 +2,7 @@ package generic_test
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"testing"
 
@@ -117,4 +118,40 @@ func TestFindAndListGeneric(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, listWithNilQuery)
 	require.Len(t, listWithNilQuery, 2)
+
+	var iterated []string
+	err = ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		iterated = append(iterated, ip.IPAddress)
+		return nil
+	}, queries.IpFilter(&apiv2.IPQuery{Project: pointer.Pointer("p1")}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.2.3.2", "1.2.3.4"}, iterated)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		calls++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 1, calls)
+
+	counts, err := ds.IP().CountBy(ctx, "projectid")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"p1": 2}, counts)
+
+	counts, err = ds.IP().CountBy(ctx, "projectid", queries.IpFilter(&apiv2.IPQuery{Project: pointer.Pointer("p2")}))
+	require.NoError(t, err)
+	require.Empty(t, counts)
+
+	fieldCounts, err := ds.IP().CountByFields(ctx, []string{"projectid", "id"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []generic.FieldsCount{{Values: []string{"p1", "1.2.3.2"}, Count: 1}, {Values: []string{"p1", "1.2.3.4"}, Count: 1}}, fieldCounts)
+
+	fieldCounts, err = ds.IP().CountByFields(ctx, []string{"projectid"})
+	require.NoError(t, err)
+	require.Equal(t, []generic.FieldsCount{{Values: []string{"p1"}, Count: 2}}, fieldCounts)
+
+	_, err = ds.IP().CountByFields(ctx, nil)
+	require.Error(t, err)
 }
@@ -1,6 +1,10 @@
 package metal
 
 import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -17,6 +21,101 @@ const (
 	Static IPType = "static"
 )
 
+// IPAllocationMethod tells whether the address of an ip was chosen by the user or by the system.
+type IPAllocationMethod string
+
+const (
+	// AllocationMethodRandom is used for ips whose address was chosen by ipam
+	AllocationMethodRandom IPAllocationMethod = "random"
+	// AllocationMethodSpecific is used for ips whose address was given by the user
+	AllocationMethodSpecific IPAllocationMethod = "specific"
+)
+
+const (
+	// TagFirewallEphemeralIP marks an ip which was acquired as the ephemeral ip of a firewall, the value is the id of the firewall.
+	// Such ips are released together with the firewall.
+	TagFirewallEphemeralIP = "firewall.metal-stack.io/ephemeral-ip"
+	// TagIPOwner names the resource an ip was created for, e.g. machine:<machine id>.
+	TagIPOwner = "ip.metal-stack.io/owner"
+	// TagIPLeaseExpiry is the point in time in RFC3339 after which the ip is considered orphaned if it is still allocated.
+	TagIPLeaseExpiry = "ip.metal-stack.io/lease-expiry"
+	// TagIPStaticReason is reserved for the reason why an ip was made static, which is kept in IP.StaticReason.
+	TagIPStaticReason = "ip.metal-stack.io/static-reason"
+	// TagIPHostname is the hostname the ip is published with in dns, e.g. as hint for its PTR record.
+	// An ip with a hostname is only released when forced, otherwise its dns records would be left dangling.
+	TagIPHostname = "dns.metal-stack.io/hostname"
+	// TagIPAllocationMethod is reserved for the method the ip was allocated with, which is kept in IP.AllocationMethod.
+	TagIPAllocationMethod = "ip.metal-stack.io/allocation-method"
+	// TagIPChargeable is reserved for whether the ip is chargeable according to the configured ChargeableRule.
+	TagIPChargeable = "ip.metal-stack.io/chargeable"
+	// TagIPTransferTarget is reserved for the project a pending transfer offers the ip to, which is kept in IP.Transfer.
+	TagIPTransferTarget = "ip.metal-stack.io/transfer-target"
+)
+
+// ReservedIPTagKeys are the tag keys which are reserved for fields of an ip, tags with these keys are rejected.
+var ReservedIPTagKeys = []string{TagIPStaticReason, TagIPAllocationMethod, TagIPChargeable, TagIPTransferTarget}
+
+// IPTransfer is a pending transfer of an ip to another project.
+// It is initiated by the project the ip belongs to and takes effect when the target project accepts it.
+type IPTransfer struct {
+	SourceProjectID string    `rethinkdb:"sourceprojectid"`
+	TargetProjectID string    `rethinkdb:"targetprojectid"`
+	InitiatedBy     string    `rethinkdb:"initiatedby"`
+	Initiated       time.Time `rethinkdb:"initiated"`
+}
+
+const (
+	// IPReferenceKindMachine is a machine or firewall which uses an ip.
+	IPReferenceKindMachine = "machine"
+	// IPReferenceKindService is a service of a cluster, e.g. a loadbalancer, which uses an ip.
+	IPReferenceKindService = "service"
+)
+
+// IPReference is a resource which uses an ip.
+type IPReference struct {
+	Kind string
+	ID   string
+}
+
+func (r IPReference) String() string {
+	return r.Kind + ":" + r.ID
+}
+
+// ChargeableRule decides which ips are chargeable, e.g. static ips in the internet networks.
+type ChargeableRule struct {
+	// Types are the ip types which are chargeable, no ip is chargeable if empty.
+	Types []IPType
+	// Networks restricts chargeable ips to the given networks, ips of all networks are chargeable if empty.
+	Networks []string
+}
+
+// NewChargeableRule returns the rule for the given ip types and networks, the types must be known ip types.
+func NewChargeableRule(types, networks []string) (ChargeableRule, error) {
+	rule := ChargeableRule{Networks: networks}
+	for _, t := range types {
+		switch IPType(t) {
+		case Ephemeral, Static:
+			rule.Types = append(rule.Types, IPType(t))
+		default:
+			return ChargeableRule{}, fmt.Errorf("unknown ip type:%q, must be one of %s, %s", t, Ephemeral, Static)
+		}
+	}
+	return rule, nil
+}
+
+// Enabled returns true if the rule can declare any ip as chargeable.
+func (c ChargeableRule) Enabled() bool {
+	return len(c.Types) > 0
+}
+
+// IsChargeable returns true if the ip is of a chargeable type and lives in a chargeable network.
+func (c ChargeableRule) IsChargeable(ip *IP) bool {
+	if !slices.Contains(c.Types, ip.Type) {
+		return false
+	}
+	return len(c.Networks) == 0 || slices.Contains(c.Networks, ip.NetworkID)
+}
+
 // IP of a machine/firewall.
 type IP struct {
 	IPAddress string `rethinkdb:"id"`
@@ -24,16 +123,50 @@ type IP struct {
 	// when an IP was created. This is not the primary key!
 	// This field can help to distinguish whether an IP address was re-acquired or
 	// if it is still the same ip address as before.
-	AllocationUUID   string    `rethinkdb:"allocationuuid"`
-	ParentPrefixCidr string    `rethinkdb:"prefix"`
-	Name             string    `rethinkdb:"name"`
-	Description      string    `rethinkdb:"description"`
-	ProjectID        string    `rethinkdb:"projectid"`
-	NetworkID        string    `rethinkdb:"networkid"`
-	Type             IPType    `rethinkdb:"type"`
-	Tags             []string  `rethinkdb:"tags"`
-	Created          time.Time `rethinkdb:"created"`
-	Changed          time.Time `rethinkdb:"changed"`
+	AllocationUUID   string   `rethinkdb:"allocationuuid"`
+	ParentPrefixCidr string   `rethinkdb:"prefix"`
+	Name             string   `rethinkdb:"name"`
+	Description      string   `rethinkdb:"description"`
+	ProjectID        string   `rethinkdb:"projectid"`
+	NetworkID        string   `rethinkdb:"networkid"`
+	Type             IPType   `rethinkdb:"type"`
+	Tags             []string `rethinkdb:"tags"`
+	// StaticReason justifies why a static ip was made permanent, it is kept until the ip becomes ephemeral again.
+	StaticReason string `rethinkdb:"staticreason"`
+	// AllocationMethod is empty for ips which were created before it was recorded.
+	AllocationMethod IPAllocationMethod `rethinkdb:"allocationmethod"`
+	// NeedsReconciliation is set on imported ips which are not acquired in ipam yet.
+	NeedsReconciliation bool `rethinkdb:"needsreconciliation"`
+	// Transfer is set while the ip is offered to another project.
+	Transfer *IPTransfer `rethinkdb:"transfer,omitempty"`
+	Created  time.Time   `rethinkdb:"created"`
+	Changed  time.Time   `rethinkdb:"changed"`
+	// References are the resources which use the ip, they are never stored and only resolved by repositories WithReferences.
+	References []IPReference `rethinkdb:"-"`
+}
+
+// IsHostPrefix returns true if the address of an ip is a whole prefix which was allocated as a single unit, e.g. a /64 for one interface.
+// The address of a host prefix is the prefix in cidr notation.
+func IsHostPrefix(address string) bool {
+	return strings.Contains(address, "/")
+}
+
+// NormalizeIPAddress returns the canonical form of the ip address, e.g. ipv6 addresses in lower case with zeros compressed.
+// The address of a host prefix is normalized as prefix.
+func NormalizeIPAddress(address string) (string, error) {
+	if IsHostPrefix(address) {
+		pfx, err := netip.ParsePrefix(address)
+		if err != nil {
+			return "", fmt.Errorf("invalid host prefix %q: %w", address, err)
+		}
+		return pfx.String(), nil
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid ip address %q: %w", address, err)
+	}
+	return addr.String(), nil
 }
 
 // GetID returns the ID of the entity
@@ -0,0 +1,102 @@
+package metal_test
+
+import (
+	"testing"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChargeableRule(t *testing.T) {
+	rule, err := metal.NewChargeableRule([]string{"static"}, []string{"internet"})
+	require.NoError(t, err)
+	assert.Equal(t, metal.ChargeableRule{Types: []metal.IPType{metal.Static}, Networks: []string{"internet"}}, rule)
+	assert.True(t, rule.Enabled())
+
+	rule, err = metal.NewChargeableRule(nil, []string{"internet"})
+	require.NoError(t, err)
+	assert.False(t, rule.Enabled())
+
+	_, err = metal.NewChargeableRule([]string{"static", "floating"}, nil)
+	require.EqualError(t, err, `unknown ip type:"floating", must be one of ephemeral, static`)
+}
+
+func TestChargeableRule_IsChargeable(t *testing.T) {
+	tests := []struct {
+		name string
+		rule metal.ChargeableRule
+		ip   *metal.IP
+		want bool
+	}{
+		{
+			name: "no rule",
+			rule: metal.ChargeableRule{},
+			ip:   &metal.IP{Type: metal.Static, NetworkID: "internet"},
+			want: false,
+		},
+		{
+			name: "static ip in any network",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Static}},
+			ip:   &metal.IP{Type: metal.Static, NetworkID: "tenant-network"},
+			want: true,
+		},
+		{
+			name: "ephemeral ip not chargeable",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Static}},
+			ip:   &metal.IP{Type: metal.Ephemeral, NetworkID: "internet"},
+			want: false,
+		},
+		{
+			name: "static ip in chargeable network",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Static}, Networks: []string{"internet", "internet-v6"}},
+			ip:   &metal.IP{Type: metal.Static, NetworkID: "internet-v6"},
+			want: true,
+		},
+		{
+			name: "static ip in other network",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Static}, Networks: []string{"internet"}},
+			ip:   &metal.IP{Type: metal.Static, NetworkID: "tenant-network"},
+			want: false,
+		},
+		{
+			name: "ephemeral and static ips chargeable",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Ephemeral, metal.Static}, Networks: []string{"internet"}},
+			ip:   &metal.IP{Type: metal.Ephemeral, NetworkID: "internet"},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.rule.IsChargeable(tt.ip))
+		})
+	}
+}
+
+func TestNormalizeIPAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr string
+	}{
+		{address: "1.2.3.4", want: "1.2.3.4"},
+		{address: "2001:db8::1", want: "2001:db8::1"},
+		{address: "2001:DB8::1", want: "2001:db8::1"},
+		{address: "2001:0db8:0000:0000:0000:0000:0000:0001", want: "2001:db8::1"},
+		{address: "2001:db8:0:0:1:0:0:1", want: "2001:db8::1:0:0:1"},
+		{address: "::FFFF:1.2.3.4", want: "::ffff:1.2.3.4"},
+		{address: "2001:DB8:0:1::/64", want: "2001:db8:0:1::/64"},
+		{address: "1.2.3", wantErr: `invalid ip address "1.2.3": ParseAddr("1.2.3"): IPv4 address too short`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := metal.NormalizeIPAddress(tt.address)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,14 +1,22 @@
 package metal
 
 import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand/v2"
 	"net/netip"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type (
 	Network struct {
 		Base
 		Prefixes                   Prefixes          `rethinkdb:"prefixes"`
+		AddressFamilies            AddressFamilies   `rethinkdb:"addressfamilies" description:"the addressfamilies of the prefixes of this network"`
 		DestinationPrefixes        Prefixes          `rethinkdb:"destinationprefixes"`
 		DefaultChildPrefixLength   ChildPrefixLength `rethinkdb:"defaultchildprefixlength" description:"if privatesuper, this defines the bitlen of child prefixes per addressfamily if not nil"`
 		PartitionID                string            `rethinkdb:"partitionid"`
@@ -21,6 +29,7 @@ type (
 		Shared                     bool              `rethinkdb:"shared"`
 		Labels                     map[string]string `rethinkdb:"labels"`
 		AdditionalAnnouncableCIDRs []string          `rethinkdb:"additionalannouncablecidrs" description:"list of cidrs which are added to the route maps per tenant private network, these are typically pod- and service cidrs, can only be set in a supernetwork"`
+		ReservedIPs                []string          `rethinkdb:"reservedips" description:"ips which must never be allocated from this network, e.g. gateways or vips which are managed elsewhere"`
 	}
 
 	ChildPrefixLength map[AddressFamily]uint8
@@ -47,6 +56,355 @@ const (
 	IPv6AddressFamily = AddressFamily("IPv6")
 )
 
+const (
+	// NetworkLabelEphemeralOnly if set to true on a network, only ephemeral ips can be allocated from this network
+	NetworkLabelEphemeralOnly = "network.metal-stack.io/ephemeral-only"
+	// NetworkLabelNoSpecificIP if set to true on a network, no specific ips can be allocated from this network
+	NetworkLabelNoSpecificIP = "network.metal-stack.io/no-specific-ip"
+	// NetworkLabelReadOnly if set to true on a network, e.g. during maintenance, no ips can be allocated from this network
+	NetworkLabelReadOnly = "network.metal-stack.io/read-only"
+	// NetworkLabelPrefixWeights if set on a network, random ips are allocated from its prefixes proportionally to their weights.
+	// The value is a comma separated list of prefix=weight, e.g. "10.0.0.0/24=3,10.0.1.0/24=1". Prefixes without a weight have a weight of 1.
+	NetworkLabelPrefixWeights = "network.metal-stack.io/prefix-weights"
+	// NetworkLabelDefaultIPType if set on a network, ips allocated without a type get this type, e.g. static for management networks.
+	NetworkLabelDefaultIPType = "network.metal-stack.io/default-ip-type"
+	// NetworkLabelReleasedIPReuse if set on a network, random ips are allocated with respect to the recently released ips of the network.
+	// With "last", recently released ips are only handed out again if no other ip is left, the longest released first.
+	// With "first", recently released ips are handed out again before any other ip, the latest released first.
+	NetworkLabelReleasedIPReuse = "network.metal-stack.io/released-ip-reuse"
+	// NetworkLabelMachineIPLease if set on a network, ips created for a machine get a lease expiry after this duration, e.g. "720h".
+	NetworkLabelMachineIPLease = "network.metal-stack.io/machine-ip-lease"
+	// NetworkLabelPendingDeletion if set to true on a network, the network is going to be deleted and no ips can be allocated from it anymore.
+	// Existing ips are still listable so they can be cleaned up.
+	NetworkLabelPendingDeletion = "network.metal-stack.io/pending-deletion"
+	// NetworkLabelReserveGateway if set to true on a network, the first usable address of every prefix is the gateway by convention.
+	// It is never handed out as random ip and can not be allocated as specific ip. Point-to-point and single address prefixes have no gateway.
+	NetworkLabelReserveGateway = "network.metal-stack.io/reserve-gateway"
+	// NetworkLabelExcludedIPs if set on a network, the given ips are never handed out as random ip and can not be allocated as specific ip.
+	// The value is a comma separated list of ips or ranges in the form "first-last", e.g. "10.0.0.5,10.0.0.100-10.0.0.120".
+	// In contrast to reserved ips, excluded ips are not acquired in ipam upfront.
+	NetworkLabelExcludedIPs = "network.metal-stack.io/excluded-ips"
+)
+
+const (
+	// ReleasedIPReuseFirst prefers recently released ips on random allocation.
+	ReleasedIPReuseFirst = "first"
+	// ReleasedIPReuseLast avoids recently released ips on random allocation.
+	ReleasedIPReuseLast = "last"
+)
+
+// LabelEnabled returns true if the label with the given key is present on the network and its value parses to true.
+func (n *Network) LabelEnabled(key string) bool {
+	value, ok := n.Labels[key]
+	if !ok {
+		return false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// IsReservedIP returns true if the given ip is reserved in the network and must therefore never be allocated,
+// either on its own or as part of a reserved range.
+func (n *Network) IsReservedIP(ip string) bool {
+	if slices.Contains(n.ReservedIPs, ip) {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	_, ok := reservationContaining(n.ReservedIPs, addr)
+	return ok
+}
+
+// OverlappingReservation returns the reservation of the network which overlaps with the given range, if any.
+// be aware that malformed reservations are just skipped.
+func (n *Network) OverlappingReservation(rng ReservedRange) (string, bool) {
+	for _, reserved := range n.ReservedIPs {
+		r, err := ParseReservedRange(reserved)
+		if err != nil {
+			continue
+		}
+		if r.Overlaps(rng) {
+			return reserved, true
+		}
+	}
+	return "", false
+}
+
+// ReservedRange is a range of consecutive ips which are reserved in a network, a single reserved ip is a range of one ip.
+type ReservedRange struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// ParseReservedRange parses a reservation which is either a single ip or a range in the form "first-last".
+func ParseReservedRange(s string) (ReservedRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+
+	firstAddr, err := netip.ParseAddr(strings.TrimSpace(first))
+	if err != nil {
+		return ReservedRange{}, fmt.Errorf("unable to parse first ip of range %q: %w", s, err)
+	}
+	lastAddr, err := netip.ParseAddr(strings.TrimSpace(last))
+	if err != nil {
+		return ReservedRange{}, fmt.Errorf("unable to parse last ip of range %q: %w", s, err)
+	}
+	if firstAddr.Is4() != lastAddr.Is4() {
+		return ReservedRange{}, fmt.Errorf("first and last ip of range %q must be of the same address family", s)
+	}
+	if lastAddr.Less(firstAddr) {
+		return ReservedRange{}, fmt.Errorf("first ip of range %q must not be greater than the last ip", s)
+	}
+
+	return ReservedRange{First: firstAddr, Last: lastAddr}, nil
+}
+
+// String returns the range in the form "first-last", or only the ip if the range consists of a single ip.
+func (r ReservedRange) String() string {
+	if r.First == r.Last {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Contains returns true if the given ip is part of the range.
+func (r ReservedRange) Contains(ip netip.Addr) bool {
+	return r.First.Compare(ip) <= 0 && ip.Compare(r.Last) <= 0
+}
+
+// Overlaps returns true if at least one ip is part of both ranges, adjacent ranges do not overlap.
+func (r ReservedRange) Overlaps(other ReservedRange) bool {
+	if r.First.Is4() != other.First.Is4() {
+		return false
+	}
+	return r.First.Compare(other.Last) <= 0 && other.First.Compare(r.Last) <= 0
+}
+
+// Exceeds returns true if the range consists of more than n ips, without enumerating the whole range.
+func (r ReservedRange) Exceeds(n int) bool {
+	addr := r.First
+	for range n {
+		if addr == r.Last {
+			return false
+		}
+		addr = addr.Next()
+	}
+	return true
+}
+
+// Addrs returns all ips of the range, use Exceeds before on ranges of arbitrary size.
+func (r ReservedRange) Addrs() []netip.Addr {
+	var addrs []netip.Addr
+	for addr := r.First; addr.IsValid() && addr.Compare(r.Last) <= 0; addr = addr.Next() {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// reservationContaining returns the reservation which contains the given ip, if any.
+func reservationContaining(reserved []string, ip netip.Addr) (string, bool) {
+	for _, reservation := range reserved {
+		r, err := ParseReservedRange(reservation)
+		if err != nil {
+			continue
+		}
+		if r.Contains(ip) {
+			return reservation, true
+		}
+	}
+	return "", false
+}
+
+// GatewayIPs returns the gateway address of every prefix if the network reserves gateways, nil otherwise.
+func (n *Network) GatewayIPs() []string {
+	if !n.LabelEnabled(NetworkLabelReserveGateway) {
+		return nil
+	}
+
+	var gateways []string
+	for _, prefix := range n.Prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil || pfx.Addr().BitLen()-pfx.Bits() <= 1 {
+			continue
+		}
+		gateways = append(gateways, NewPrefixRange(pfx).FirstUsable.String())
+	}
+	return gateways
+}
+
+// IsGatewayIP returns true if the network reserves gateways and the given ip is the gateway of one of its prefixes.
+func (n *Network) IsGatewayIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(n.GatewayIPs(), addr.String())
+}
+
+// ExcludedIPs returns the ips and ranges given by the excluded ips label.
+// be aware that malformed entries are just skipped.
+func (n *Network) ExcludedIPs() []string {
+	value, ok := n.Labels[NetworkLabelExcludedIPs]
+	if !ok {
+		return nil
+	}
+
+	var excluded []string
+	for entry := range strings.SplitSeq(value, ",") {
+		rng, err := ParseReservedRange(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		excluded = append(excluded, rng.String())
+	}
+	return excluded
+}
+
+// IsExcludedIP returns true if the given ip is excluded from allocation in the network, either on its own or as part of an excluded range.
+func (n *Network) IsExcludedIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	_, ok := reservationContaining(n.ExcludedIPs(), addr)
+	return ok
+}
+
+// DefaultIPType returns the type of ips which are allocated without a type in this network.
+// Ephemeral is returned if the default ip type label is not set or its value is not a known ip type.
+func (n *Network) DefaultIPType() IPType {
+	switch IPType(n.Labels[NetworkLabelDefaultIPType]) {
+	case Static:
+		return Static
+	default:
+		return Ephemeral
+	}
+}
+
+// AllocationPolicy is the policy of a network for the allocation of ips, it is derived from the labels and the reserved ips of the network.
+type AllocationPolicy struct {
+	NetworkID       string
+	ReadOnly        bool
+	PendingDeletion bool
+	EphemeralOnly   bool
+	NoSpecificIP    bool
+	DefaultIPType   IPType
+	ReservedIPs     []string
+	GatewayIPs      []string
+	ExcludedIPs     []string
+}
+
+// AllocationPolicy returns the policy for the allocation of ips in this network.
+func (n *Network) AllocationPolicy() AllocationPolicy {
+	return AllocationPolicy{
+		NetworkID:       n.ID,
+		ReadOnly:        n.LabelEnabled(NetworkLabelReadOnly),
+		PendingDeletion: n.LabelEnabled(NetworkLabelPendingDeletion),
+		EphemeralOnly:   n.LabelEnabled(NetworkLabelEphemeralOnly),
+		NoSpecificIP:    n.LabelEnabled(NetworkLabelNoSpecificIP),
+		DefaultIPType:   n.DefaultIPType(),
+		ReservedIPs:     n.ReservedIPs,
+		GatewayIPs:      n.GatewayIPs(),
+		ExcludedIPs:     n.ExcludedIPs(),
+	}
+}
+
+// CheckAllocation returns an error if the policy does not allow to allocate an ip of the given type.
+// The specific ip is empty for the allocation of a random ip.
+func (p AllocationPolicy) CheckAllocation(ipType IPType, specificIP string) error {
+	if p.ReadOnly {
+		return fmt.Errorf("network:%s is read-only, no ips can be allocated", p.NetworkID)
+	}
+	if p.PendingDeletion {
+		return fmt.Errorf("network:%s is pending deletion, no ips can be allocated", p.NetworkID)
+	}
+
+	err := p.CheckIPType(ipType)
+	if err != nil {
+		return err
+	}
+
+	if specificIP == "" {
+		return nil
+	}
+	if p.NoSpecificIP {
+		return fmt.Errorf("network:%s does not allow allocation of specific ips", p.NetworkID)
+	}
+	if addr, err := netip.ParseAddr(specificIP); err == nil {
+		if _, ok := reservationContaining(p.ReservedIPs, addr); ok {
+			return fmt.Errorf("ip:%s is reserved in network:%s", addr.String(), p.NetworkID)
+		}
+		if slices.Contains(p.GatewayIPs, addr.String()) {
+			return fmt.Errorf("ip:%s is reserved as gateway in network:%s", addr.String(), p.NetworkID)
+		}
+		if _, ok := reservationContaining(p.ExcludedIPs, addr); ok {
+			return fmt.Errorf("ip:%s is excluded in network:%s", addr.String(), p.NetworkID)
+		}
+	}
+
+	return nil
+}
+
+// CheckIPType returns an error if the policy does not allow ips of the given type, e.g. when an ip changes its type.
+func (p AllocationPolicy) CheckIPType(ipType IPType) error {
+	if p.EphemeralOnly && ipType != Ephemeral {
+		return fmt.Errorf("network:%s only allows ephemeral ips", p.NetworkID)
+	}
+	return nil
+}
+
+// ReleasedIPReuse returns how recently released ips are treated on random allocation,
+// which is either ReleasedIPReuseFirst, ReleasedIPReuseLast or empty if they are not treated differently.
+func (n *Network) ReleasedIPReuse() string {
+	switch value := n.Labels[NetworkLabelReleasedIPReuse]; value {
+	case ReleasedIPReuseFirst, ReleasedIPReuseLast:
+		return value
+	default:
+		return ""
+	}
+}
+
+// MachineIPLease returns the lease duration of ips created for a machine in this network.
+// Zero is returned if the label is not set or malformed, then the ips have no lease expiry.
+func (n *Network) MachineIPLease() time.Duration {
+	lease, err := time.ParseDuration(n.Labels[NetworkLabelMachineIPLease])
+	if err != nil || lease < 0 {
+		return 0
+	}
+	return lease
+}
+
+// PrefixWeights returns the weights of the prefixes given by the prefix weights label.
+// be aware that malformed entries are just skipped.
+func (n *Network) PrefixWeights() map[string]uint {
+	value, ok := n.Labels[NetworkLabelPrefixWeights]
+	if !ok {
+		return nil
+	}
+
+	weights := map[string]uint{}
+	for _, entry := range strings.Split(value, ",") {
+		prefix, weight, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		w, err := strconv.ParseUint(weight, 10, 32)
+		if err != nil {
+			continue
+		}
+		weights[prefix] = uint(w)
+	}
+
+	return weights
+}
+
 func (p *Prefix) String() string {
 	return p.IP + "/" + p.Length
 }
@@ -75,6 +433,46 @@ func (p Prefixes) OfFamily(af AddressFamily) Prefixes {
 	return res
 }
 
+// WeightedOrder returns the prefixes in a random order in which prefixes with a higher weight are more likely to come first.
+// Prefixes without a weight have a weight of 1, prefixes with a weight of 0 always come last.
+func (p Prefixes) WeightedOrder(weights map[string]uint, rnd *rand.Rand) Prefixes {
+	var (
+		res       Prefixes
+		remaining = slices.Clone(p)
+	)
+
+	weightOf := func(prefix Prefix) uint {
+		w, ok := weights[prefix.String()]
+		if !ok {
+			return 1
+		}
+		return w
+	}
+
+	for len(remaining) > 0 {
+		var total uint
+		for _, prefix := range remaining {
+			total += weightOf(prefix)
+		}
+		if total == 0 {
+			return append(res, remaining...)
+		}
+
+		pick := uint(rnd.UintN(total))
+		for i, prefix := range remaining {
+			w := weightOf(prefix)
+			if pick < w {
+				res = append(res, prefix)
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+			pick -= w
+		}
+	}
+
+	return res
+}
+
 // AddressFamilies returns the addressfamilies of given prefixes.
 // be aware that malformed prefixes are just skipped, so do not use this for validation or something.
 func (p Prefixes) AddressFamilies() AddressFamilies {
@@ -100,3 +498,176 @@ func (p Prefixes) AddressFamilies() AddressFamilies {
 
 	return afs
 }
+
+// MaxCapacity is the capacity reported for an addressfamily whose usable addresses exceed what is representable, e.g. several ipv6 /64.
+const MaxCapacity = uint64(math.MaxUint64)
+
+// Capacity returns the number of usable addresses of the given prefixes per addressfamily, regardless of how many are allocated.
+// The capacity of an addressfamily is capped at MaxCapacity. be aware that malformed prefixes are just skipped.
+func (p Prefixes) Capacity() map[AddressFamily]uint64 {
+	sums := map[AddressFamily]*big.Int{}
+	for _, prefix := range p {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			continue
+		}
+
+		af := IPv4AddressFamily
+		if pfx.Addr().Is6() {
+			af = IPv6AddressFamily
+		}
+		if sums[af] == nil {
+			sums[af] = new(big.Int)
+		}
+
+		rng := NewPrefixRange(pfx)
+		usable := new(big.Int).Sub(new(big.Int).SetBytes(rng.LastUsable.AsSlice()), new(big.Int).SetBytes(rng.FirstUsable.AsSlice()))
+		sums[af].Add(sums[af], usable.Add(usable, big.NewInt(1)))
+	}
+
+	capacity := map[AddressFamily]uint64{}
+	for af, sum := range sums {
+		if !sum.IsUint64() {
+			capacity[af] = MaxCapacity
+			continue
+		}
+		capacity[af] = sum.Uint64()
+	}
+	return capacity
+}
+
+// PrefixIndex allows to find the prefix containing an ip without scanning all prefixes.
+// The prefixes of a network do usually not overlap, which is ensured by ipam. If they do, the longest match is found.
+type PrefixIndex struct {
+	entries []prefixIndexEntry
+}
+
+type prefixIndexEntry struct {
+	pfx    netip.Prefix
+	prefix Prefix
+	// enclosing is the index of the longest other entry which contains this entry, -1 if there is none
+	enclosing int
+}
+
+// NewPrefixIndex creates an index of the given prefixes, malformed prefixes are skipped.
+func NewPrefixIndex(prefixes Prefixes) *PrefixIndex {
+	entries := make([]prefixIndexEntry, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, prefixIndexEntry{pfx: pfx.Masked(), prefix: prefix})
+	}
+
+	// prefixes with the same start address are sorted from the shortest to the longest match
+	slices.SortFunc(entries, func(a, b prefixIndexEntry) int {
+		if c := a.pfx.Addr().Compare(b.pfx.Addr()); c != 0 {
+			return c
+		}
+		return a.pfx.Bits() - b.pfx.Bits()
+	})
+
+	// prefixes either contain each other or are disjoint, the stack holds the chain of prefixes enclosing the current one
+	var stack []int
+	for idx := range entries {
+		for len(stack) > 0 && !entries[stack[len(stack)-1]].pfx.Overlaps(entries[idx].pfx) {
+			stack = stack[:len(stack)-1]
+		}
+		entries[idx].enclosing = -1
+		if len(stack) > 0 {
+			entries[idx].enclosing = stack[len(stack)-1]
+		}
+		stack = append(stack, idx)
+	}
+
+	return &PrefixIndex{entries: entries}
+}
+
+// Lookup returns the longest prefix which contains the given ip.
+func (i *PrefixIndex) Lookup(ip netip.Addr) (Prefix, bool) {
+	// the first candidate is the longest prefix with the highest start address not greater than the ip
+	idx, found := slices.BinarySearchFunc(i.entries, ip, func(e prefixIndexEntry, ip netip.Addr) int {
+		return e.pfx.Addr().Compare(ip)
+	})
+	if found {
+		for idx+1 < len(i.entries) && i.entries[idx+1].pfx.Addr() == ip {
+			idx++
+		}
+	} else {
+		idx--
+	}
+
+	// every other prefix containing the ip also contains the candidate, so only the enclosing prefixes are left
+	for idx >= 0 {
+		if i.entries[idx].pfx.Contains(ip) {
+			return i.entries[idx].prefix, true
+		}
+		idx = i.entries[idx].enclosing
+	}
+
+	return Prefix{}, false
+}
+
+// PrefixRange describes the addresses of a prefix which are usable by hosts.
+type PrefixRange struct {
+	Network     netip.Addr
+	FirstUsable netip.Addr
+	LastUsable  netip.Addr
+	// Broadcast is only valid for ipv4 prefixes which have a broadcast address, which is not the case for /31 and /32.
+	Broadcast netip.Addr
+}
+
+// NewPrefixRange computes the usable range of the given prefix.
+// Point-to-point prefixes (/31, /127) and single address prefixes (/32, /128) have no network and broadcast address which are excluded from the usable range.
+func NewPrefixRange(pfx netip.Prefix) PrefixRange {
+	pfx = pfx.Masked()
+
+	var (
+		network = pfx.Addr()
+		last    = lastAddr(pfx)
+		bits    = network.BitLen() - pfx.Bits()
+	)
+
+	if bits <= 1 {
+		return PrefixRange{Network: network, FirstUsable: network, LastUsable: last}
+	}
+
+	r := PrefixRange{Network: network, FirstUsable: network.Next(), LastUsable: last}
+	if network.Is4() {
+		r.LastUsable = last.Prev()
+		r.Broadcast = last
+	}
+
+	return r
+}
+
+// Nth returns the nth usable address of the range, the first usable address is the 1st.
+func (r PrefixRange) Nth(n uint64) (netip.Addr, error) {
+	if n == 0 {
+		return netip.Addr{}, fmt.Errorf("the nth usable address must be at least 1")
+	}
+
+	var (
+		first = new(big.Int).SetBytes(r.FirstUsable.AsSlice())
+		last  = new(big.Int).SetBytes(r.LastUsable.AsSlice())
+		nth   = new(big.Int).Add(first, new(big.Int).SetUint64(n-1))
+	)
+	if nth.Cmp(last) > 0 {
+		usable := new(big.Int).Add(new(big.Int).Sub(last, first), big.NewInt(1))
+		return netip.Addr{}, fmt.Errorf("there are only %s usable addresses in the range from %s to %s, the %d. is out of range", usable, r.FirstUsable, r.LastUsable, n)
+	}
+
+	addr, _ := netip.AddrFromSlice(nth.FillBytes(make([]byte, r.FirstUsable.BitLen()/8)))
+	return addr, nil
+}
+
+// lastAddr returns the last address of the given prefix by setting all host bits.
+func lastAddr(pfx netip.Prefix) netip.Addr {
+	a := pfx.Addr().AsSlice()
+	for i := pfx.Bits(); i < len(a)*8; i++ {
+		a[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(a)
+	return addr
+}
@@ -1,11 +1,17 @@
 package metal_test
 
 import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPrefixes_OfFamily(t *testing.T) {
@@ -105,3 +111,680 @@ func TestPrefixes_AddressFamilies(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixes_Capacity(t *testing.T) {
+	tests := []struct {
+		name string
+		p    metal.Prefixes
+		want map[metal.AddressFamily]uint64
+	}{
+		{
+			name: "ipv4 prefixes",
+			p: metal.Prefixes{
+				{IP: "10.0.0.0", Length: "24"},
+				{IP: "10.0.1.0", Length: "28"},
+				{IP: "10.0.2.0", Length: "31"},
+				{IP: "10.0.3.1", Length: "32"},
+			},
+			want: map[metal.AddressFamily]uint64{metal.IPv4AddressFamily: 254 + 14 + 2 + 1},
+		},
+		{
+			name: "ipv6 /64",
+			p: metal.Prefixes{
+				{IP: "2001:db8::", Length: "64"},
+			},
+			want: map[metal.AddressFamily]uint64{metal.IPv6AddressFamily: metal.MaxCapacity},
+		},
+		{
+			name: "ipv6 beyond the representable maximum is capped",
+			p: metal.Prefixes{
+				{IP: "2001:db8::", Length: "64"},
+				{IP: "2001:db8:1::", Length: "48"},
+			},
+			want: map[metal.AddressFamily]uint64{metal.IPv6AddressFamily: metal.MaxCapacity},
+		},
+		{
+			name: "both afs",
+			p: metal.Prefixes{
+				{IP: "10.0.0.0", Length: "30"},
+				{IP: "2001:db8::", Length: "120"},
+				{IP: "no-prefix", Length: "8"},
+			},
+			want: map[metal.AddressFamily]uint64{metal.IPv4AddressFamily: 2, metal.IPv6AddressFamily: 255},
+		},
+		{
+			name: "nil prefixes",
+			p:    nil,
+			want: map[metal.AddressFamily]uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.p.Capacity())
+		})
+	}
+}
+
+func TestNetwork_LabelEnabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		key    string
+		want   bool
+	}{
+		{
+			name:   "nil labels",
+			labels: nil,
+			key:    metal.NetworkLabelEphemeralOnly,
+			want:   false,
+		},
+		{
+			name:   "label enabled",
+			labels: map[string]string{metal.NetworkLabelEphemeralOnly: "true"},
+			key:    metal.NetworkLabelEphemeralOnly,
+			want:   true,
+		},
+		{
+			name:   "label disabled",
+			labels: map[string]string{metal.NetworkLabelEphemeralOnly: "false"},
+			key:    metal.NetworkLabelEphemeralOnly,
+			want:   false,
+		},
+		{
+			name:   "malformed label value",
+			labels: map[string]string{metal.NetworkLabelNoSpecificIP: "yes please"},
+			key:    metal.NetworkLabelNoSpecificIP,
+			want:   false,
+		},
+		{
+			name:   "other label enabled",
+			labels: map[string]string{metal.NetworkLabelNoSpecificIP: "true"},
+			key:    metal.NetworkLabelEphemeralOnly,
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &metal.Network{Labels: tt.labels}
+			if got := n.LabelEnabled(tt.key); got != tt.want {
+				t.Errorf("Network.LabelEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetwork_DefaultIPType(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   metal.IPType
+	}{
+		{
+			name: "no label",
+			want: metal.Ephemeral,
+		},
+		{
+			name:   "static default",
+			labels: map[string]string{metal.NetworkLabelDefaultIPType: "static"},
+			want:   metal.Static,
+		},
+		{
+			name:   "ephemeral default",
+			labels: map[string]string{metal.NetworkLabelDefaultIPType: "ephemeral"},
+			want:   metal.Ephemeral,
+		},
+		{
+			name:   "unknown type",
+			labels: map[string]string{metal.NetworkLabelDefaultIPType: "permanent"},
+			want:   metal.Ephemeral,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &metal.Network{Labels: tt.labels}
+			assert.Equal(t, tt.want, n.DefaultIPType())
+		})
+	}
+}
+
+func TestNetwork_ReleasedIPReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name: "no label",
+			want: "",
+		},
+		{
+			name:   "reuse first",
+			labels: map[string]string{metal.NetworkLabelReleasedIPReuse: "first"},
+			want:   metal.ReleasedIPReuseFirst,
+		},
+		{
+			name:   "reuse last",
+			labels: map[string]string{metal.NetworkLabelReleasedIPReuse: "last"},
+			want:   metal.ReleasedIPReuseLast,
+		},
+		{
+			name:   "unknown policy",
+			labels: map[string]string{metal.NetworkLabelReleasedIPReuse: "never"},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &metal.Network{Labels: tt.labels}
+			assert.Equal(t, tt.want, n.ReleasedIPReuse())
+		})
+	}
+}
+
+func TestNetwork_MachineIPLease(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   time.Duration
+	}{
+		{
+			name: "no label",
+			want: 0,
+		},
+		{
+			name:   "lease is parsed",
+			labels: map[string]string{metal.NetworkLabelMachineIPLease: "720h"},
+			want:   720 * time.Hour,
+		},
+		{
+			name:   "malformed lease",
+			labels: map[string]string{metal.NetworkLabelMachineIPLease: "a month"},
+			want:   0,
+		},
+		{
+			name:   "negative lease",
+			labels: map[string]string{metal.NetworkLabelMachineIPLease: "-1h"},
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &metal.Network{Labels: tt.labels}
+			assert.Equal(t, tt.want, n.MachineIPLease())
+		})
+	}
+}
+
+func TestNetwork_PrefixWeights(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   map[string]uint
+	}{
+		{
+			name: "no label",
+			want: nil,
+		},
+		{
+			name:   "weights are parsed",
+			labels: map[string]string{metal.NetworkLabelPrefixWeights: "10.0.0.0/24=3, 10.0.1.0/24=0"},
+			want:   map[string]uint{"10.0.0.0/24": 3, "10.0.1.0/24": 0},
+		},
+		{
+			name:   "malformed entries are skipped",
+			labels: map[string]string{metal.NetworkLabelPrefixWeights: "10.0.0.0/24=3,10.0.1.0/24,10.0.2.0/24=-1"},
+			want:   map[string]uint{"10.0.0.0/24": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &metal.Network{Labels: tt.labels}
+			if diff := cmp.Diff(tt.want, n.PrefixWeights()); diff != "" {
+				t.Errorf("Network.PrefixWeights() diff = %s", diff)
+			}
+		})
+	}
+}
+
+func TestPrefixes_WeightedOrder(t *testing.T) {
+	var (
+		heavy  = metal.Prefix{IP: "10.0.0.0", Length: "24"}
+		light  = metal.Prefix{IP: "10.0.1.0", Length: "24"}
+		never  = metal.Prefix{IP: "10.0.2.0", Length: "24"}
+		p      = metal.Prefixes{light, never, heavy}
+		rnd    = rand.New(rand.NewPCG(1, 2))
+		counts = map[string]int{}
+		runs   = 10000
+	)
+
+	weights := map[string]uint{heavy.String(): 3, never.String(): 0}
+
+	for range runs {
+		ordered := p.WeightedOrder(weights, rnd)
+		require.Len(t, ordered, 3)
+		require.Equal(t, never, ordered[2], "prefixes with weight 0 must come last")
+		counts[ordered[0].String()]++
+	}
+
+	ratio := float64(counts[heavy.String()]) / float64(runs)
+	assert.InDelta(t, 0.75, ratio, 0.03, "heavy prefix must be chosen first in about 3 of 4 cases")
+	assert.Equal(t, runs, counts[heavy.String()]+counts[light.String()])
+}
+
+func TestPrefixIndex_Lookup(t *testing.T) {
+	index := metal.NewPrefixIndex(metal.Prefixes{
+		{IP: "10.0.2.0", Length: "24"},
+		{IP: "2001:db8::", Length: "96"},
+		{IP: "10.0.0.0", Length: "24"},
+		{IP: "10.0.1.128", Length: "25"},
+		{IP: "invalid", Length: "24"},
+	})
+
+	tests := []struct {
+		ip     string
+		want   metal.Prefix
+		wantOk bool
+	}{
+		{ip: "10.0.0.0", want: metal.Prefix{IP: "10.0.0.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.0.255", want: metal.Prefix{IP: "10.0.0.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.1.5", wantOk: false},
+		{ip: "10.0.1.200", want: metal.Prefix{IP: "10.0.1.128", Length: "25"}, wantOk: true},
+		{ip: "10.0.2.1", want: metal.Prefix{IP: "10.0.2.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.3.1", wantOk: false},
+		{ip: "9.255.255.255", wantOk: false},
+		{ip: "2001:db8::1", want: metal.Prefix{IP: "2001:db8::", Length: "96"}, wantOk: true},
+		{ip: "2001:db9::1", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got, ok := index.Lookup(netip.MustParseAddr(tt.ip))
+			require.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPrefixIndex_LookupOverlapping(t *testing.T) {
+	index := metal.NewPrefixIndex(metal.Prefixes{
+		{IP: "10.0.1.0", Length: "24"},
+		{IP: "10.0.0.0", Length: "16"},
+		{IP: "10.0.0.0", Length: "24"},
+		{IP: "10.0.1.128", Length: "25"},
+		{IP: "10.0.0.0", Length: "8"},
+		{IP: "10.1.0.0", Length: "24"},
+		{IP: "2001:db8::", Length: "32"},
+		{IP: "2001:db8::", Length: "64"},
+	})
+
+	tests := []struct {
+		ip     string
+		want   metal.Prefix
+		wantOk bool
+	}{
+		{ip: "10.0.0.0", want: metal.Prefix{IP: "10.0.0.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.0.5", want: metal.Prefix{IP: "10.0.0.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.1.5", want: metal.Prefix{IP: "10.0.1.0", Length: "24"}, wantOk: true},
+		{ip: "10.0.1.200", want: metal.Prefix{IP: "10.0.1.128", Length: "25"}, wantOk: true},
+		{ip: "10.0.2.1", want: metal.Prefix{IP: "10.0.0.0", Length: "16"}, wantOk: true},
+		{ip: "10.1.0.1", want: metal.Prefix{IP: "10.1.0.0", Length: "24"}, wantOk: true},
+		{ip: "10.1.1.1", want: metal.Prefix{IP: "10.0.0.0", Length: "8"}, wantOk: true},
+		{ip: "11.0.0.1", wantOk: false},
+		{ip: "2001:db8::1", want: metal.Prefix{IP: "2001:db8::", Length: "64"}, wantOk: true},
+		{ip: "2001:db8:1::1", want: metal.Prefix{IP: "2001:db8::", Length: "32"}, wantOk: true},
+		{ip: "2001:db9::1", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got, ok := index.Lookup(netip.MustParseAddr(tt.ip))
+			require.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPrefixIndex_LookupManyPrefixes(t *testing.T) {
+	prefixes := manyPrefixes()
+	index := metal.NewPrefixIndex(prefixes)
+
+	for _, prefix := range []metal.Prefix{prefixes[0], prefixes[len(prefixes)/2], prefixes[len(prefixes)-1]} {
+		ip := netip.MustParseAddr(prefix.IP).Next()
+		got, ok := index.Lookup(ip)
+		require.True(t, ok, ip.String())
+		assert.Equal(t, prefix, got)
+	}
+}
+
+func BenchmarkPrefixIndex_Lookup(b *testing.B) {
+	index := metal.NewPrefixIndex(manyPrefixes())
+	ip := netip.MustParseAddr("10.255.255.1")
+
+	b.ResetTimer()
+	for range b.N {
+		_, _ = index.Lookup(ip)
+	}
+}
+
+// manyPrefixes returns 65536 /24 prefixes from 10.0.0.0/8 in reversed order.
+func manyPrefixes() metal.Prefixes {
+	var prefixes metal.Prefixes
+	for i := 255; i >= 0; i-- {
+		for j := 255; j >= 0; j-- {
+			prefixes = append(prefixes, metal.Prefix{IP: fmt.Sprintf("10.%d.%d.0", i, j), Length: "24"})
+		}
+	}
+	return prefixes
+}
+
+func TestNewPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   metal.PrefixRange
+	}{
+		{
+			prefix: "10.0.0.0/24",
+			want: metal.PrefixRange{
+				Network:     netip.MustParseAddr("10.0.0.0"),
+				FirstUsable: netip.MustParseAddr("10.0.0.1"),
+				LastUsable:  netip.MustParseAddr("10.0.0.254"),
+				Broadcast:   netip.MustParseAddr("10.0.0.255"),
+			},
+		},
+		{
+			prefix: "10.0.0.17/24",
+			want: metal.PrefixRange{
+				Network:     netip.MustParseAddr("10.0.0.0"),
+				FirstUsable: netip.MustParseAddr("10.0.0.1"),
+				LastUsable:  netip.MustParseAddr("10.0.0.254"),
+				Broadcast:   netip.MustParseAddr("10.0.0.255"),
+			},
+		},
+		{
+			prefix: "10.0.0.4/31",
+			want: metal.PrefixRange{
+				Network:     netip.MustParseAddr("10.0.0.4"),
+				FirstUsable: netip.MustParseAddr("10.0.0.4"),
+				LastUsable:  netip.MustParseAddr("10.0.0.5"),
+			},
+		},
+		{
+			prefix: "10.0.0.4/32",
+			want: metal.PrefixRange{
+				Network:     netip.MustParseAddr("10.0.0.4"),
+				FirstUsable: netip.MustParseAddr("10.0.0.4"),
+				LastUsable:  netip.MustParseAddr("10.0.0.4"),
+			},
+		},
+		{
+			prefix: "2001:db8::/64",
+			want: metal.PrefixRange{
+				Network:     netip.MustParseAddr("2001:db8::"),
+				FirstUsable: netip.MustParseAddr("2001:db8::1"),
+				LastUsable:  netip.MustParseAddr("2001:db8::ffff:ffff:ffff:ffff"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got := metal.NewPrefixRange(netip.MustParsePrefix(tt.prefix))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPrefixRange_Nth(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		n       uint64
+		want    string
+		wantErr string
+	}{
+		{prefix: "10.0.0.0/24", n: 1, want: "10.0.0.1"},
+		{prefix: "10.0.0.0/24", n: 5, want: "10.0.0.5"},
+		{prefix: "10.0.0.0/24", n: 254, want: "10.0.0.254"},
+		{prefix: "10.0.0.0/24", n: 255, wantErr: "there are only 254 usable addresses in the range from 10.0.0.1 to 10.0.0.254, the 255. is out of range"},
+		{prefix: "10.0.0.0/24", n: 0, wantErr: "the nth usable address must be at least 1"},
+		{prefix: "10.0.0.4/31", n: 2, want: "10.0.0.5"},
+		{prefix: "2001:db8::/64", n: 0x10000, want: "2001:db8::1:0"},
+		{prefix: "2001:db8::/64", n: 1 << 63, want: "2001:db8:0:0:8000::"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.prefix, tt.n), func(t *testing.T) {
+			got, err := metal.NewPrefixRange(netip.MustParsePrefix(tt.prefix)).Nth(tt.n)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestNetwork_AllocationPolicy(t *testing.T) {
+	nw := &metal.Network{
+		Base: metal.Base{ID: "internet"},
+		Labels: map[string]string{
+			metal.NetworkLabelEphemeralOnly: "true",
+			metal.NetworkLabelNoSpecificIP:  "false",
+		},
+		ReservedIPs: []string{"1.2.3.1", "2001:db8::1"},
+	}
+
+	policy := nw.AllocationPolicy()
+	assert.Equal(t, metal.AllocationPolicy{
+		NetworkID:     "internet",
+		EphemeralOnly: true,
+		DefaultIPType: metal.Ephemeral,
+		ReservedIPs:   []string{"1.2.3.1", "2001:db8::1"},
+	}, policy)
+
+	tests := []struct {
+		name       string
+		policy     metal.AllocationPolicy
+		ipType     metal.IPType
+		specificIP string
+		wantErr    string
+	}{
+		{
+			name:   "random ephemeral ip",
+			policy: policy,
+			ipType: metal.Ephemeral,
+		},
+		{
+			name:    "static ip in ephemeral only network",
+			policy:  policy,
+			ipType:  metal.Static,
+			wantErr: "network:internet only allows ephemeral ips",
+		},
+		{
+			name:       "specific ip",
+			policy:     policy,
+			ipType:     metal.Ephemeral,
+			specificIP: "1.2.3.2",
+		},
+		{
+			name:       "reserved specific ip",
+			policy:     policy,
+			ipType:     metal.Ephemeral,
+			specificIP: "1.2.3.1",
+			wantErr:    "ip:1.2.3.1 is reserved in network:internet",
+		},
+		{
+			name:       "reserved specific ip in non canonical form",
+			policy:     policy,
+			ipType:     metal.Ephemeral,
+			specificIP: "2001:0db8::0001",
+			wantErr:    "ip:2001:db8::1 is reserved in network:internet",
+		},
+		{
+			name:       "specific ip in reserved range",
+			policy:     metal.AllocationPolicy{NetworkID: "internet", ReservedIPs: []string{"1.2.3.10-1.2.3.20"}},
+			ipType:     metal.Ephemeral,
+			specificIP: "1.2.3.15",
+			wantErr:    "ip:1.2.3.15 is reserved in network:internet",
+		},
+		{
+			name:       "specific ip in network without specific ips",
+			policy:     metal.AllocationPolicy{NetworkID: "internet", NoSpecificIP: true, ReservedIPs: []string{"1.2.3.1"}},
+			ipType:     metal.Static,
+			specificIP: "1.2.3.1",
+			wantErr:    "network:internet does not allow allocation of specific ips",
+		},
+		{
+			name:       "specific gateway ip",
+			policy:     metal.AllocationPolicy{NetworkID: "internet", GatewayIPs: []string{"1.2.3.1"}},
+			ipType:     metal.Ephemeral,
+			specificIP: "1.2.3.1",
+			wantErr:    "ip:1.2.3.1 is reserved as gateway in network:internet",
+		},
+		{
+			name:       "specific excluded ip",
+			policy:     metal.AllocationPolicy{NetworkID: "internet", ExcludedIPs: []string{"1.2.3.10-1.2.3.20"}},
+			ipType:     metal.Ephemeral,
+			specificIP: "1.2.3.15",
+			wantErr:    "ip:1.2.3.15 is excluded in network:internet",
+		},
+		{
+			name:    "read-only wins over every other constraint",
+			policy:  metal.AllocationPolicy{NetworkID: "internet", ReadOnly: true, PendingDeletion: true, EphemeralOnly: true},
+			ipType:  metal.Static,
+			wantErr: "network:internet is read-only, no ips can be allocated",
+		},
+		{
+			name:    "pending deletion",
+			policy:  metal.AllocationPolicy{NetworkID: "internet", PendingDeletion: true},
+			ipType:  metal.Ephemeral,
+			wantErr: "network:internet is pending deletion, no ips can be allocated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.CheckAllocation(tt.ipType, tt.specificIP)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestParseReservedRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "10.0.0.1", want: "10.0.0.1"},
+		{in: "10.0.0.1-10.0.0.10", want: "10.0.0.1-10.0.0.10"},
+		{in: "10.0.0.1 - 10.0.0.1", want: "10.0.0.1"},
+		{in: "2001:0db8::1-2001:db8::ff", want: "2001:db8::1-2001:db8::ff"},
+		{in: "10.0.0.10-10.0.0.1", wantErr: `first ip of range "10.0.0.10-10.0.0.1" must not be greater than the last ip`},
+		{in: "10.0.0.1-2001:db8::1", wantErr: `first and last ip of range "10.0.0.1-2001:db8::1" must be of the same address family`},
+		{in: "10.0.0.1-", wantErr: `unable to parse last ip of range "10.0.0.1-": ParseAddr(""): unable to parse IP`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := metal.ParseReservedRange(tt.in)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestReservedRange_Overlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.5-10.0.0.20", want: true},
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.10-10.0.0.20", want: true},
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.3-10.0.0.4", want: true},
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.5", want: true},
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.11-10.0.0.20", want: false},
+		{a: "10.0.0.11-10.0.0.20", b: "10.0.0.1-10.0.0.10", want: false},
+		{a: "10.0.0.1-10.0.0.10", b: "10.0.0.0", want: false},
+		{a: "10.0.0.1-10.0.0.10", b: "::ffff:10.0.0.5", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := metal.ParseReservedRange(tt.a)
+			require.NoError(t, err)
+			b, err := metal.ParseReservedRange(tt.b)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, a.Overlaps(b))
+			assert.Equal(t, tt.want, b.Overlaps(a))
+		})
+	}
+}
+
+func TestReservedRange_Exceeds(t *testing.T) {
+	rng, err := metal.ParseReservedRange("10.0.0.1-10.0.0.10")
+	require.NoError(t, err)
+	assert.False(t, rng.Exceeds(10))
+	assert.True(t, rng.Exceeds(9))
+	assert.Len(t, rng.Addrs(), 10)
+
+	rng, err = metal.ParseReservedRange("2001:db8::-2001:db8::ffff:ffff:ffff:ffff")
+	require.NoError(t, err)
+	assert.True(t, rng.Exceeds(256))
+}
+
+func TestNetwork_GatewayIPs(t *testing.T) {
+	nw := &metal.Network{
+		Prefixes: metal.Prefixes{
+			{IP: "10.0.0.0", Length: "24"},
+			{IP: "2001:db8::", Length: "64"},
+			{IP: "10.1.0.0", Length: "31"},
+			{IP: "10.2.0.1", Length: "32"},
+		},
+	}
+	assert.Nil(t, nw.GatewayIPs())
+	assert.False(t, nw.IsGatewayIP("10.0.0.1"))
+
+	nw.Labels = map[string]string{metal.NetworkLabelReserveGateway: "true"}
+	assert.Equal(t, []string{"10.0.0.1", "2001:db8::1"}, nw.GatewayIPs(), "point-to-point and single address prefixes have no gateway")
+	assert.True(t, nw.IsGatewayIP("10.0.0.1"))
+	assert.True(t, nw.IsGatewayIP("2001:0db8::0001"))
+	assert.False(t, nw.IsGatewayIP("10.0.0.2"))
+	assert.False(t, nw.IsGatewayIP("10.1.0.0"))
+	assert.False(t, nw.IsGatewayIP("no-ip"))
+}
+
+func TestNetwork_ExcludedIPs(t *testing.T) {
+	nw := &metal.Network{}
+	assert.Nil(t, nw.ExcludedIPs())
+	assert.False(t, nw.IsExcludedIP("10.0.0.5"))
+
+	nw.Labels = map[string]string{metal.NetworkLabelExcludedIPs: "10.0.0.5, 10.0.0.100-10.0.0.120,no-ip,10.0.0.9-10.0.0.8,2001:db8::1"}
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.100-10.0.0.120", "2001:db8::1"}, nw.ExcludedIPs(), "malformed entries are skipped")
+	assert.True(t, nw.IsExcludedIP("10.0.0.5"))
+	assert.True(t, nw.IsExcludedIP("10.0.0.110"))
+	assert.True(t, nw.IsExcludedIP("2001:0db8::0001"))
+	assert.False(t, nw.IsExcludedIP("10.0.0.6"))
+	assert.False(t, nw.IsExcludedIP("10.0.0.8"))
+	assert.False(t, nw.IsExcludedIP("no-ip"))
+}
+
+func TestNetwork_IsReservedIP(t *testing.T) {
+	nw := &metal.Network{ReservedIPs: []string{"10.0.0.1", "10.0.0.10-10.0.0.20"}}
+
+	assert.True(t, nw.IsReservedIP("10.0.0.1"))
+	assert.True(t, nw.IsReservedIP("10.0.0.10"))
+	assert.True(t, nw.IsReservedIP("10.0.0.15"))
+	assert.True(t, nw.IsReservedIP("10.0.0.20"))
+	assert.False(t, nw.IsReservedIP("10.0.0.2"))
+	assert.False(t, nw.IsReservedIP("10.0.0.21"))
+	assert.False(t, nw.IsReservedIP("no-ip"))
+
+	reservation, ok := nw.OverlappingReservation(metal.ReservedRange{First: netip.MustParseAddr("10.0.0.5"), Last: netip.MustParseAddr("10.0.0.10")})
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.10-10.0.0.20", reservation)
+
+	_, ok = nw.OverlappingReservation(metal.ReservedRange{First: netip.MustParseAddr("10.0.0.2"), Last: netip.MustParseAddr("10.0.0.9")})
+	assert.False(t, ok)
+}
@@ -2,13 +2,24 @@ package queries
 
 import (
 	"fmt"
+	"regexp"
+	"time"
 
+	"github.com/metal-stack/api-server/pkg/db/metal"
 	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
 	"github.com/metal-stack/metal-lib/pkg/tag"
 
 	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
+const (
+	ipv4Pattern = `^[0-9]{1,3}(\.[0-9]{1,3}){3}$`
+	ipv6Pattern = `:`
+
+	ipv4PrefixPattern = `^[0-9]{1,3}(\.[0-9]{1,3}){3}/`
+	ipv6PrefixPattern = `:`
+)
+
 func IpProjectScoped(project string) func(q r.Term) r.Term {
 	return func(q r.Term) r.Term {
 		return q.Filter(func(row r.Term) r.Term {
@@ -17,6 +28,138 @@ func IpProjectScoped(project string) func(q r.Term) r.Term {
 	}
 }
 
+// IpParentPrefixFamily filters the ips whose parent prefix is of the given address family.
+func IpParentPrefixFamily(af apiv2.IPAddressFamily) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		var pattern string
+		switch af {
+		case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4:
+			pattern = ipv4PrefixPattern
+		case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6:
+			pattern = ipv6PrefixPattern
+		case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED:
+			return q
+		}
+
+		return q.Filter(func(row r.Term) r.Term {
+			return row.Field("prefix").Match(pattern)
+		})
+	}
+}
+
+// IpAllocationUUIDs filters the ips with one of the given allocation uuids.
+func IpAllocationUUIDs(uuids []string) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return r.Expr(uuids).Contains(row.Field("allocationuuid"))
+		})
+	}
+}
+
+// IpNetworks filters the ips which belong to one of the given networks.
+func IpNetworks(networks []string) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return r.Expr(networks).Contains(row.Field("networkid"))
+		})
+	}
+}
+
+// IpTransferTargetScoped filters the ips with a pending transfer to the given project.
+func IpTransferTargetScoped(project string) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return row.Field("transfer").Field("targetprojectid").Default("").Eq(project)
+		})
+	}
+}
+
+// IpOwner filters the ips which were created for the given owner, e.g. machine:<machine id>.
+// The api query has no field for the owner yet, hence it is not part of IpFilter.
+func IpOwner(owner string) func(q r.Term) r.Term {
+	ownerTag := tag.New(metal.TagIPOwner, owner)
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return row.Field("tags").Default([]string{}).Contains(ownerTag)
+		})
+	}
+}
+
+// IpBlank filters the ips with an empty name if name is set and with an empty description if description is set,
+// an ip matches if one of the requested fields is empty. The api query has no field for this yet, hence it is not part of IpFilter.
+func IpBlank(name, description bool) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			blank := r.Expr(false)
+			if name {
+				blank = blank.Or(row.Field("name").Default("").Eq(""))
+			}
+			if description {
+				blank = blank.Or(row.Field("description").Default("").Eq(""))
+			}
+			return blank
+		})
+	}
+}
+
+// IpNeedsReconciliation filters the ips which are not acquired in ipam yet.
+func IpNeedsReconciliation() func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return row.Field("needsreconciliation").Eq(true)
+		})
+	}
+}
+
+// IpChangedSince returns the ips which were changed after the given point in time,
+// ordered by their change timestamp and id to get a deterministic order.
+func IpChangedSince(since time.Time) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		return q.Filter(func(row r.Term) r.Term {
+			return row.Field("changed").Gt(since)
+		}).OrderBy("changed", "id")
+	}
+}
+
+// IpOldestEphemeral returns the ephemeral ips of the given network, oldest first, ordered by their creation timestamp and id
+// to get a deterministic order. Ips which are tagged with a machine are skipped if withoutMachine is set.
+// At most limit ips are returned, a limit of zero returns all of them.
+func IpOldestEphemeral(networkID string, withoutMachine bool, limit int) func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		q = q.Filter(func(row r.Term) r.Term {
+			return row.Field("networkid").Eq(networkID).And(row.Field("type").Eq(string(metal.Ephemeral)))
+		})
+		if withoutMachine {
+			q = ipWithoutMachine(q)
+		}
+		q = q.OrderBy("created", "id")
+		if limit > 0 {
+			q = q.Limit(limit)
+		}
+		return q
+	}
+}
+
+// IpStaticWithoutMachine returns the static ips which are not tagged with a machine, oldest first, ordered by their creation timestamp and id
+// to get a deterministic order.
+func IpStaticWithoutMachine() func(q r.Term) r.Term {
+	return func(q r.Term) r.Term {
+		q = q.Filter(func(row r.Term) r.Term {
+			return row.Field("type").Eq(string(metal.Static))
+		})
+		return ipWithoutMachine(q).OrderBy("created", "id")
+	}
+}
+
+func ipWithoutMachine(q r.Term) r.Term {
+	machineTag := "^" + regexp.QuoteMeta(tag.MachineID+"=")
+	return q.Filter(func(row r.Term) r.Term {
+		return row.Field("tags").Default([]string{}).Contains(func(t r.Term) r.Term {
+			return t.Match(machineTag)
+		}).Not()
+	})
+}
+
 func IpFilter(rq *apiv2.IPQuery) func(q r.Term) r.Term {
 	if rq == nil {
 		return nil
@@ -76,17 +219,22 @@ func IpFilter(rq *apiv2.IPQuery) func(q r.Term) r.Term {
 		}
 
 		if rq.AddressFamily != nil {
-			var separator string
-			switch rq.AddressFamily.String() {
-			case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4.String():
-				separator = "\\."
-			case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.String():
-				separator = ":"
+			// the id is the ip address in its canonical string representation,
+			// ipv4 mapped ipv6 addresses like ::ffff:1.2.3.4 contain dots as well, so ipv4 must match completely.
+			var pattern string
+			switch *rq.AddressFamily {
+			case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4:
+				pattern = ipv4Pattern
+			case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6:
+				pattern = ipv6Pattern
+			case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED:
 			}
 
-			q = q.Filter(func(row r.Term) r.Term {
-				return row.Field("id").Match(separator)
-			})
+			if pattern != "" {
+				q = q.Filter(func(row r.Term) r.Term {
+					return row.Field("id").Match(pattern)
+				})
+			}
 		}
 
 		return q
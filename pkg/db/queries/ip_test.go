@@ -0,0 +1,157 @@
+package queries
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
+	"github.com/stretchr/testify/assert"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+func TestIpFilterAddressFamily(t *testing.T) {
+	tests := []struct {
+		name      string
+		af        apiv2.IPAddressFamily
+		wantMatch string
+	}{
+		{
+			name:      "ipv4",
+			af:        apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4,
+			wantMatch: `.Field("id").Match("^[0-9]{1,3}(\\.[0-9]{1,3}){3}$")`,
+		},
+		{
+			name:      "ipv6",
+			af:        apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6,
+			wantMatch: `.Field("id").Match(":")`,
+		},
+		{
+			name: "unspecified does not filter",
+			af:   apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IpFilter(&apiv2.IPQuery{AddressFamily: &tt.af})(r.Table("ip")).String()
+			if tt.wantMatch == "" {
+				assert.Equal(t, `r.Table("ip")`, got)
+				return
+			}
+			assert.Contains(t, got, tt.wantMatch)
+		})
+	}
+}
+
+func TestIpAddressFamilyPatterns(t *testing.T) {
+	ipv4 := regexp.MustCompile(ipv4Pattern)
+	ipv6 := regexp.MustCompile(ipv6Pattern)
+
+	for _, ip := range []string{"1.2.3.4", "10.0.0.255"} {
+		assert.True(t, ipv4.MatchString(ip), ip)
+		assert.False(t, ipv6.MatchString(ip), ip)
+	}
+	for _, ip := range []string{"2001:db8::1", "::1", "::ffff:1.2.3.4"} {
+		assert.False(t, ipv4.MatchString(ip), ip)
+		assert.True(t, ipv6.MatchString(ip), ip)
+	}
+}
+
+func TestIpParentPrefixFamily(t *testing.T) {
+	tests := []struct {
+		name      string
+		af        apiv2.IPAddressFamily
+		wantMatch string
+	}{
+		{
+			name:      "ipv4",
+			af:        apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4,
+			wantMatch: `.Field("prefix").Match("^[0-9]{1,3}(\\.[0-9]{1,3}){3}/")`,
+		},
+		{
+			name:      "ipv6",
+			af:        apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6,
+			wantMatch: `.Field("prefix").Match(":")`,
+		},
+		{
+			name: "unspecified does not filter",
+			af:   apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IpParentPrefixFamily(tt.af)(r.Table("ip")).String()
+			if tt.wantMatch == "" {
+				assert.Equal(t, `r.Table("ip")`, got)
+				return
+			}
+			assert.Contains(t, got, tt.wantMatch)
+		})
+	}
+}
+
+func TestIpParentPrefixFamilyPatterns(t *testing.T) {
+	ipv4 := regexp.MustCompile(ipv4PrefixPattern)
+	ipv6 := regexp.MustCompile(ipv6PrefixPattern)
+
+	for _, prefix := range []string{"1.2.3.0/24", "10.0.0.0/8"} {
+		assert.True(t, ipv4.MatchString(prefix), prefix)
+		assert.False(t, ipv6.MatchString(prefix), prefix)
+	}
+	for _, prefix := range []string{"2001:db8::/96", "::ffff:1.2.3.0/120"} {
+		assert.False(t, ipv4.MatchString(prefix), prefix)
+		assert.True(t, ipv6.MatchString(prefix), prefix)
+	}
+}
+
+func TestIpAllocationUUIDs(t *testing.T) {
+	got := IpAllocationUUIDs([]string{"a", "b"})(r.Table("ip")).String()
+	assert.Contains(t, got, `["a", "b"].Contains(`)
+	assert.Contains(t, got, `.Field("allocationuuid"))`)
+}
+
+func TestIpNetworks(t *testing.T) {
+	got := IpNetworks([]string{"internet", "storage"})(r.Table("ip")).String()
+	assert.Contains(t, got, `["internet", "storage"].Contains(`)
+	assert.Contains(t, got, `.Field("networkid"))`)
+}
+
+func TestIpOwner(t *testing.T) {
+	got := IpOwner("machine:m1")(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("tags").Default([]).Contains("ip.metal-stack.io/owner=machine:m1")`)
+}
+
+func TestIpTransferTargetScoped(t *testing.T) {
+	got := IpTransferTargetScoped("p2")(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("transfer").Field("targetprojectid").Default("").Eq("p2")`)
+}
+
+func TestIpBlank(t *testing.T) {
+	got := IpBlank(true, false)(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("name").Default("").Eq("")`)
+	assert.NotContains(t, got, `.Field("description")`)
+
+	got = IpBlank(true, true)(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("name").Default("").Eq("")`)
+	assert.Contains(t, got, `.Field("description").Default("").Eq("")`)
+}
+
+func TestIpOldestEphemeral(t *testing.T) {
+	got := IpOldestEphemeral("internet", false, 0)(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("networkid").Eq("internet").And(`)
+	assert.Contains(t, got, `.Field("type").Eq("ephemeral")`)
+	assert.NotContains(t, got, `Match(`)
+	assert.True(t, strings.HasSuffix(got, `.OrderBy("created", "id")`), got)
+
+	got = IpOldestEphemeral("internet", true, 10)(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("tags").Default([]).Contains(`)
+	assert.Contains(t, got, `.Match("^machine\\.metal-stack\\.io/id=") }).Not()`)
+	assert.True(t, strings.HasSuffix(got, `.OrderBy("created", "id").Limit(10)`), got)
+}
+
+func TestIpStaticWithoutMachine(t *testing.T) {
+	got := IpStaticWithoutMachine()(r.Table("ip")).String()
+	assert.Contains(t, got, `.Field("type").Eq("static")`)
+	assert.Contains(t, got, `.Match("^machine\\.metal-stack\\.io/id=") }).Not()`)
+	assert.True(t, strings.HasSuffix(got, `.OrderBy("created", "id")`), got)
+}
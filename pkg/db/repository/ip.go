@@ -2,10 +2,17 @@ package repository
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/netip"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/google/uuid"
@@ -14,28 +21,57 @@ import (
 	"github.com/metal-stack/api-server/pkg/db/queries"
 	"github.com/metal-stack/api-server/pkg/db/tx"
 	"github.com/metal-stack/api-server/pkg/db/validate"
+	putil "github.com/metal-stack/api-server/pkg/project"
 	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
 	ipamapiv1 "github.com/metal-stack/go-ipam/api/v1"
+	mdcv1 "github.com/metal-stack/masterdata-api/api/v1"
 	"github.com/metal-stack/metal-lib/pkg/pointer"
 	"github.com/metal-stack/metal-lib/pkg/tag"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ipRepository struct {
 	r     *Repostore
 	scope *ProjectScope
+
+	withReferences bool
+}
+
+// WithReferences returns a copy of this repository which resolves the references of the ips returned by Get, Find and List.
+// They are not resolved by default, so lists of many ips do not pay for them.
+func (r *ipRepository) WithReferences() IPRepository {
+	return &ipRepository{
+		r:              r.r,
+		scope:          r.scope,
+		withReferences: true,
+	}
+}
+
+// expand resolves the references of the ip if this repository is WithReferences.
+func (r *ipRepository) expand(ip *metal.IP) {
+	if r.withReferences {
+		ip.References = ipReferences(ip)
+	}
 }
 
 func (r *ipRepository) Get(ctx context.Context, id string) (*metal.IP, error) {
 	ip, err := r.r.ds.IP().Get(ctx, id)
 	if err != nil {
+		if generic.IsNotFound(err) {
+			r.r.log.Debug("ip not found", "ip", id)
+		}
 		return nil, err
 	}
 
 	err = r.MatchScope(ip)
 	if err != nil {
-		return nil, err
+		// respond exactly like for a non existing ip in order to not leak its existence
+		r.r.log.Warn("ip belongs to another project, responding with not found", "ip", id, "project", ip.ProjectID, "scope", r.scope.projectID)
+		return nil, generic.NotFound("no ip with id %q found", id)
 	}
+	r.expand(ip)
 
 	return ip, nil
 }
@@ -50,8 +86,102 @@ func (r *ipRepository) MatchScope(ip *metal.IP) error {
 	return generic.NotFound("ip:%s for project:%s not found", ip.IPAddress, ip.ProjectID)
 }
 
+// ipAllocationMode tells how an ip is allocated if no specific ip is requested.
+type ipAllocationMode int
+
+const (
+	allocateRandom ipAllocationMode = iota
+	allocateTopDown
+	allocateHostPrefix
+)
+
+// hostPrefixLength is the length of the ipv6 prefixes which are allocated as a whole.
+const hostPrefixLength = 64
+
+// Create creates an ip, either with the specific ip of the request or a random one.
+// A retried create of a specific ip which the project already allocated in the same network returns the existing ip,
+// only if the ip is allocated by another project or in another network the create fails with AlreadyExists.
 func (r *ipRepository) Create(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	ip, err := r.create(ctx, req, allocateRandom)
+	if err == nil || req.Ip == nil || !generic.IsConflict(err) {
+		return ip, err
+	}
+
+	existing, ownErr := r.ownedSpecificIP(ctx, req)
+	if ownErr != nil {
+		return nil, ownErr
+	}
+	if existing == nil {
+		return nil, err
+	}
+
+	r.r.log.Info("specific ip is already allocated by the project, returning it", "ip", existing.IPAddress, "project", existing.ProjectID, "network", existing.NetworkID)
+	return existing, nil
+}
+
+// ownedSpecificIP returns the specific ip of the request if it is allocated by the project of the request in the same network, nil otherwise.
+func (r *ipRepository) ownedSpecificIP(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	addr, err := netip.ParseAddr(*req.Ip)
+	if err != nil {
+		return nil, nil
+	}
+
+	existing, err := r.r.ds.IP().Get(ctx, addr.String())
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if existing.ProjectID != req.Project || existing.NetworkID != req.Network {
+		return nil, nil
+	}
+
+	return existing, nil
+}
+
+// CreateTopDown creates an ip like Create, but a random ip is allocated from the top of the prefixes of the network downwards,
+// e.g. for infrastructure addresses which are assigned from the end of a range.
+func (r *ipRepository) CreateTopDown(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	return r.create(ctx, req, allocateTopDown)
+}
+
+// CreateHostPrefix creates an ip which is a whole /64 of a larger ipv6 prefix of the network, e.g. one /64 per interface.
+// The /64 is acquired as child prefix in ipam and recorded with the prefix in cidr notation as its address.
+// A prefix of the network can not hold host prefixes and single ips at the same time.
+func (r *ipRepository) CreateHostPrefix(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	if req.Ip != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("it is not possible to specify specificIP and allocate a host prefix"))
+	}
+	if req.AddressFamily != nil && *req.AddressFamily != apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("host prefixes can only be allocated for addressfamily %s", metal.IPv6AddressFamily))
+	}
+
+	rq := proto.Clone(req).(*apiv2.IPServiceCreateRequest)
+	rq.AddressFamily = apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()
+
+	return r.create(ctx, rq, allocateHostPrefix)
+}
+
+// preparedIP is a create request which passed all validations, nothing is allocated yet.
+type preparedIP struct {
+	nw          *metal.Network
+	projectID   string
+	af          *metal.AddressFamily
+	ipType      metal.IPType
+	name        string
+	description string
+	tags        []string
+}
+
+// prepare validates the create request against the project and the policy of the network, before anything is allocated.
+func (r *ipRepository) prepare(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*preparedIP, error) {
 	r.r.log.Debug("")
+	err := validate.ValidateIPCreateRequest(req)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
 	var (
 		name        string
 		description string
@@ -63,24 +193,45 @@ func (r *ipRepository) Create(ctx context.Context, req *apiv2.IPServiceCreateReq
 	if req.Description != nil {
 		description = *req.Description
 	}
+	err = validate.ValidateNameAndDescription(name, description, r.r.lengthLimits)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
 	tags := req.Tags
 	if req.MachineId != nil {
-		tags = append(tags, tag.New(tag.MachineID, *req.MachineId))
+		tags = append(tags, tag.New(tag.MachineID, *req.MachineId), tag.New(metal.TagIPOwner, "machine:"+*req.MachineId))
 	}
-	// Ensure no duplicates
-	tags = tag.NewTagMap(tags).Slice()
 
-	p, err := r.r.Project(&req.Project).Get(ctx, req.Project)
+	projectCtx := ctx
+	if r.r.projectLookupTimeout > 0 {
+		var cancel context.CancelFunc
+		projectCtx, cancel = context.WithTimeout(ctx, r.r.projectLookupTimeout)
+		defer cancel()
+	}
+
+	p, err := r.r.Project(&req.Project).Get(projectCtx, req.Project)
 	if err != nil {
+		if ctx.Err() == nil && errors.Is(projectCtx.Err(), context.DeadlineExceeded) {
+			return nil, connect.NewError(connect.CodeDeadlineExceeded, fmt.Errorf("lookup of project:%s took longer than %s", req.Project, r.r.projectLookupTimeout))
+		}
 		// FIXME map generic errors to connect errors
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 	projectID := p.Meta.Id
 
-	nw, err := r.r.Network(&req.Project).Get(ctx, req.Network)
+	if putil.IsSuspended(p) {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("project:%s is suspended, no ips can be allocated", projectID))
+	}
+
+	nw, err := (&networkRepository{r: r.r, scope: &ProjectScope{projectID: req.Project}}).getCached(ctx, req.Network)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
+	if lease := nw.MachineIPLease(); req.MachineId != nil && lease > 0 {
+		tags = append(tags, tag.New(metal.TagIPLeaseExpiry, time.Now().Add(lease).UTC().Format(time.RFC3339)))
+	}
+	// Ensure no duplicates
+	tags = tag.NewTagMap(tags).Slice()
 
 	var af *metal.AddressFamily
 	if req.AddressFamily != nil {
@@ -100,9 +251,11 @@ func (r *ipRepository) Create(ctx context.Context, req *apiv2.IPServiceCreateReq
 		if !slices.Contains(nw.Prefixes.AddressFamilies(), *af) {
 			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("there is no prefix for the given addressfamily:%s present in network:%s %s", *af, req.Network, nw.Prefixes.AddressFamilies()))
 		}
-		if req.Ip != nil {
-			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("it is not possible to specify specificIP and addressfamily"))
-		}
+	}
+
+	err = checkAllowedAddressFamily(p, requestedAddressFamily(nw, af, req.Ip))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, err)
 	}
 
 	// for private, unshared networks the project id must be the same
@@ -111,26 +264,9 @@ func (r *ipRepository) Create(ctx context.Context, req *apiv2.IPServiceCreateReq
 		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("can not allocate ip for project %q because network belongs to %q and the network is not shared", p.Meta.Id, nw.ProjectID))
 	}
 
-	// TODO: Following operations should span a database transaction if possible
-
-	var (
-		ipAddress    string
-		ipParentCidr string
-	)
-
-	if req.Ip == nil {
-		ipAddress, ipParentCidr, err = r.AllocateRandomIP(ctx, nw, af)
-		if err != nil {
-			return nil, connect.NewError(connect.CodeInternal, err)
-		}
-	} else {
-		ipAddress, ipParentCidr, err = r.AllocateSpecificIP(ctx, nw, *req.Ip)
-		if err != nil {
-			return nil, connect.NewError(connect.CodeInternal, err)
-		}
-	}
+	policy := nw.AllocationPolicy()
 
-	ipType := metal.Ephemeral
+	ipType := policy.DefaultIPType
 	if req.Type != nil {
 		switch *req.Type {
 		case apiv2.IPType_IP_TYPE_EPHEMERAL:
@@ -138,221 +274,3560 @@ func (r *ipRepository) Create(ctx context.Context, req *apiv2.IPServiceCreateReq
 		case apiv2.IPType_IP_TYPE_STATIC:
 			ipType = metal.Static
 		case apiv2.IPType_IP_TYPE_UNSPECIFIED:
-			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("given ip type is not supported:%s", req.Type.String()))
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip type cannot be unspecified: %s", req.Type.String()))
+		default:
+			// an unknown type must not silently fall back to the default type of the network and bypass its policy
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("given ip type is not supported:%s", req.Type.String()))
 		}
 	}
 
-	r.r.log.Info("allocated ip in ipam", "ip", ipAddress, "network", nw.ID, "type", ipType)
+	// machine ips are released together with their machine, only admins may create them as static
+	if r.scope != nil && req.MachineId != nil && ipType == metal.Static {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ips of machines can not be created as %s, they are released together with the machine", metal.Static))
+	}
 
-	uuid, err := uuid.NewV7()
+	err = policy.CheckAllocation(ipType, pointer.SafeDeref(req.Ip))
 	if err != nil {
-		return nil, err
+		return nil, connect.NewError(connect.CodeFailedPrecondition, err)
 	}
-
-	ip := &metal.IP{
-		AllocationUUID:   uuid.String(),
-		IPAddress:        ipAddress,
-		ParentPrefixCidr: ipParentCidr,
-		Name:             name,
-		Description:      description,
-		NetworkID:        nw.ID,
-		ProjectID:        projectID,
-		Type:             ipType,
-		Tags:             tags,
+	// the tags are written with the same insert as the allocation, so the ip never exists without them
+	tags = dedupTags(tags)
+	err = validate.ValidateReservedTags(tags)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
-
-	resp, err := r.r.ds.IP().Create(ctx, ip)
+	err = validate.ValidateIPTypeAndTags(ipType, tags)
 	if err != nil {
-		return nil, err
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
 
-	return resp, nil
+	return &preparedIP{
+		nw:          nw,
+		projectID:   projectID,
+		af:          af,
+		ipType:      ipType,
+		name:        name,
+		description: description,
+		tags:        tags,
+	}, nil
 }
 
-func (r *ipRepository) Update(ctx context.Context, rq *apiv2.IPServiceUpdateRequest) (*metal.IP, error) {
-	old, err := r.Get(ctx, rq.Ip)
+func (r *ipRepository) create(ctx context.Context, req *apiv2.IPServiceCreateRequest, mode ipAllocationMode) (*metal.IP, error) {
+	prepared, err := r.prepare(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	nw := prepared.nw
 
-	new := *old
+	// TODO: Following operations should span a database transaction if possible
 
-	if rq.Description != nil {
-		new.Description = *rq.Description
+	var (
+		ipAddress    string
+		ipParentCidr string
+	)
+
+	if req.Ip == nil && req.MachineId != nil && r.r.machineRetryWindow > 0 && mode != allocateHostPrefix {
+		recent, err := r.recentMachineIP(ctx, prepared.projectID, nw.ID, *req.MachineId, randomAddressFamily(nw, prepared.af))
+		if err != nil {
+			return nil, err
+		}
+		if recent != nil {
+			r.r.log.Info("allocation for machine is retried, returning recently allocated ip", "ip", recent.IPAddress, "machine", *req.MachineId, "network", nw.ID)
+			return recent, nil
+		}
 	}
-	if rq.Name != nil {
-		new.Name = *rq.Name
+
+	allocateCtx := ctx
+	if r.r.allocationTimeout > 0 {
+		var cancel context.CancelFunc
+		allocateCtx, cancel = context.WithTimeout(ctx, r.r.allocationTimeout)
+		defer cancel()
 	}
-	if rq.Type != nil {
-		var t metal.IPType
-		switch rq.Type.String() {
-		case apiv2.IPType_IP_TYPE_EPHEMERAL.String():
-			t = metal.Ephemeral
-		case apiv2.IPType_IP_TYPE_STATIC.String():
-			t = metal.Static
-		case apiv2.IPType_IP_TYPE_UNSPECIFIED.String():
-			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip type cannot be unspecified: %s", rq.Type))
+
+	// go-ipam does not store metadata for acquired ips, name and description are only kept in the datastore
+	allocationMethod := metal.AllocationMethodRandom
+	allocationStart := time.Now()
+	switch {
+	case req.Ip != nil:
+		allocationMethod = metal.AllocationMethodSpecific
+		ipAddress, ipParentCidr, err = r.AllocateSpecificIP(allocateCtx, nw, *req.Ip)
+	case mode == allocateHostPrefix:
+		ipAddress, ipParentCidr, err = r.AllocateHostPrefix(allocateCtx, nw)
+	case mode == allocateTopDown:
+		ipAddress, ipParentCidr, err = r.AllocateTopDownIP(allocateCtx, nw, prepared.af)
+	default:
+		ipAddress, ipParentCidr, err = r.AllocateRandomIP(allocateCtx, nw, prepared.af)
+	}
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(allocateCtx.Err(), context.DeadlineExceeded) {
+			return nil, connect.NewError(connect.CodeDeadlineExceeded, fmt.Errorf("allocation of ip in network:%s took longer than %s", nw.ID, r.r.allocationTimeout))
 		}
-		new.Type = t
+		var connectErr *connect.Error
+		if errors.As(err, &connectErr) {
+			return nil, err
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	new.Tags = rq.Tags
 
-	err = r.r.ds.IP().Update(ctx, &new, old)
+	r.r.allocationLatencies.record(time.Since(allocationStart))
+	r.r.log.Info("allocated ip in ipam", "ip", ipAddress, "network", nw.ID, "type", prepared.ipType)
+
+	resp, err := r.store(ctx, prepared, ipAddress, ipParentCidr, allocationMethod)
 	if err != nil {
 		return nil, err
 	}
 
-	return &new, nil
+	r.r.publishIPEvent(ctx, IPEventCreated, resp)
+
+	return resp, nil
 }
 
-func (r *ipRepository) Delete(ctx context.Context, ip *metal.IP) (*metal.IP, error) {
-	ip, err := r.Get(ctx, ip.GetID())
+// store records the ip which was acquired in ipam for the prepared create request.
+// If the ip can not be stored, it is released in ipam again.
+func (r *ipRepository) store(ctx context.Context, prepared *preparedIP, ipAddress, ipParentCidr string, allocationMethod metal.IPAllocationMethod) (*metal.IP, error) {
+	allocationUUID, err := uuid.NewV7()
 	if err != nil {
-		return nil, err
+		r.releaseAcquired(ctx, r.r.ipamNamespace(prepared.nw), IPAMAllocation{IP: ipAddress, ParentPrefixCidr: ipParentCidr})
+		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	err = r.r.q.Insert(ctx, &tx.Tx{Jobs: []tx.Job{{ID: ip.AllocationUUID, Action: tx.ActionIpDelete}}})
+
+	ip := &metal.IP{
+		AllocationUUID:   allocationUUID.String(),
+		IPAddress:        ipAddress,
+		ParentPrefixCidr: ipParentCidr,
+		Name:             prepared.name,
+		Description:      prepared.description,
+		NetworkID:        prepared.nw.ID,
+		ProjectID:        prepared.projectID,
+		Type:             prepared.ipType,
+		Tags:             prepared.tags,
+		AllocationMethod: allocationMethod,
+	}
+
+	// the address is the primary key of the ips, so of concurrent creates of the same address only one row is written,
+	// even if ipam handed the address out twice, e.g. from the same prefix of networks in different ipam namespaces.
+	resp, err := r.r.ds.IP().Create(ctx, ip)
 	if err != nil {
+		// the ip is not stored, it must not stay acquired in ipam
+		r.releaseAcquired(ctx, r.r.ipamNamespace(prepared.nw), IPAMAllocation{IP: ipAddress, ParentPrefixCidr: ipParentCidr})
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
 		return nil, err
 	}
-	return ip, nil
+
+	return resp, nil
 }
 
-func (r *ipRepository) Find(ctx context.Context, rq *apiv2.IPQuery) (*metal.IP, error) {
-	ip, err := r.r.ds.IP().Find(ctx, queries.IpFilter(rq))
+// recentMachineIP returns the latest ip of the addressfamily which was allocated for the machine in the network within the machine retry window, nil if there is none.
+func (r *ipRepository) recentMachineIP(ctx context.Context, projectID, networkID, machineID string, af metal.AddressFamily) (*metal.IP, error) {
+	ips, err := r.r.ds.IP().List(ctx, queries.IpFilter(&apiv2.IPQuery{Project: &projectID, Network: &networkID, MachineId: &machineID}))
 	if err != nil {
 		return nil, err
 	}
 
-	return ip, nil
+	var (
+		recent *metal.IP
+		since  = time.Now().Add(-r.r.machineRetryWindow)
+	)
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip.IPAddress)
+		if err != nil {
+			continue
+		}
+		if addr.Is4() != (af == metal.IPv4AddressFamily) || ip.Created.Before(since) {
+			continue
+		}
+		if recent == nil || ip.Created.After(recent.Created) {
+			recent = ip
+		}
+	}
+
+	return recent, nil
 }
 
-func (r *ipRepository) List(ctx context.Context, rq *apiv2.IPQuery) ([]*metal.IP, error) {
-	ip, err := r.r.ds.IP().List(ctx, queries.IpFilter(rq))
+// IPAllocationBlockReason names why an ip can not be allocated.
+type IPAllocationBlockReason string
+
+const (
+	AllocationBlockedProjectNotFound          IPAllocationBlockReason = "project-not-found"
+	AllocationBlockedProjectSuspended         IPAllocationBlockReason = "project-suspended"
+	AllocationBlockedNetworkNotFound          IPAllocationBlockReason = "network-not-found"
+	AllocationBlockedNetworkNotShared         IPAllocationBlockReason = "network-not-shared"
+	AllocationBlockedNetworkReadOnly          IPAllocationBlockReason = "network-read-only"
+	AllocationBlockedNetworkPendingDeletion   IPAllocationBlockReason = "network-pending-deletion"
+	AllocationBlockedNoPrefixes               IPAllocationBlockReason = "no-prefixes"
+	AllocationBlockedAddressFamilyUnavailable IPAllocationBlockReason = "addressfamily-unavailable"
+	AllocationBlockedIPTypeNotAllowed         IPAllocationBlockReason = "ip-type-not-allowed"
+	AllocationBlockedSpecificIPUnavailable    IPAllocationBlockReason = "specific-ip-unavailable"
+	AllocationBlockedExhausted                IPAllocationBlockReason = "exhausted"
+)
+
+// IPAllocationBlock is a reason why an ip can not be allocated, together with a description for humans.
+type IPAllocationBlock struct {
+	Reason      IPAllocationBlockReason
+	Description string
+}
+
+// IPAllocationReadiness tells whether an allocation request would be served, it is ready if nothing blocks it.
+type IPAllocationReadiness struct {
+	Ready  bool
+	Blocks []IPAllocationBlock
+}
+
+// CanAllocate checks whether the create request could be served, without allocating anything.
+// It checks the project, the network and its policy, the addressfamily, the specific ip if given and whether the network has free ips left.
+// If the network can not be used at all, the checks which depend on it are skipped. The result is only valid at the time of the check.
+func (r *ipRepository) CanAllocate(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*IPAllocationReadiness, error) {
+	res := &IPAllocationReadiness{}
+	block := func(reason IPAllocationBlockReason, format string, args ...any) *IPAllocationReadiness {
+		res.Blocks = append(res.Blocks, IPAllocationBlock{Reason: reason, Description: fmt.Sprintf(format, args...)})
+		return res
+	}
+
+	// a project which can not be looked up lets the allocation fail as well
+	p, err := r.r.Project(&req.Project).Get(ctx, req.Project)
 	if err != nil {
+		return block(AllocationBlockedProjectNotFound, "project:%s can not be found: %s", req.Project, err), nil
+	}
+	if putil.IsSuspended(p) {
+		block(AllocationBlockedProjectSuspended, "project:%s is suspended, no ips can be allocated", req.Project)
+	}
+
+	nw, err := r.r.ds.Network().Get(ctx, req.Network)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return block(AllocationBlockedNetworkNotFound, "network:%s does not exist", req.Network), nil
+		}
 		return nil, err
 	}
+	if !nw.Shared && nw.ParentNetworkID != "" && p.Meta.Id != nw.ProjectID {
+		return block(AllocationBlockedNetworkNotShared, "network:%s belongs to project:%s and is not shared", nw.ID, nw.ProjectID), nil
+	}
 
-	return ip, nil
-}
+	policy := nw.AllocationPolicy()
+	if policy.ReadOnly {
+		block(AllocationBlockedNetworkReadOnly, "network:%s is read-only, no ips can be allocated", nw.ID)
+	}
+	if policy.PendingDeletion {
+		block(AllocationBlockedNetworkPendingDeletion, "network:%s is pending deletion, no ips can be allocated", nw.ID)
+	}
+	if len(nw.Prefixes) == 0 {
+		return block(AllocationBlockedNoPrefixes, "network:%s has no prefixes", nw.ID), nil
+	}
 
-func (r *ipRepository) AllocateSpecificIP(ctx context.Context, parent *metal.Network, specificIP string) (ipAddress, parentPrefixCidr string, err error) {
-	parsedIP, err := netip.ParseAddr(specificIP)
+	var af *metal.AddressFamily
+	switch req.GetAddressFamily() {
+	case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4:
+		af = pointer.Pointer(metal.IPv4AddressFamily)
+	case apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6:
+		af = pointer.Pointer(metal.IPv6AddressFamily)
+	}
+	family := requestedAddressFamily(nw, af, req.Ip)
+	familyPresent := slices.Contains(nw.Prefixes.AddressFamilies(), family)
+	if !familyPresent {
+		block(AllocationBlockedAddressFamilyUnavailable, "there is no prefix for the addressfamily:%s present in network:%s", family, nw.ID)
+	}
+	err = checkAllowedAddressFamily(p, family)
 	if err != nil {
-		return "", "", fmt.Errorf("unable to parse specific ip: %w", err)
+		block(AllocationBlockedAddressFamilyUnavailable, "%s", err)
 	}
 
-	af := metal.IPv4AddressFamily
-	if parsedIP.Is6() {
-		af = metal.IPv6AddressFamily
+	ipType := policy.DefaultIPType
+	switch req.GetType() {
+	case apiv2.IPType_IP_TYPE_EPHEMERAL:
+		ipType = metal.Ephemeral
+	case apiv2.IPType_IP_TYPE_STATIC:
+		ipType = metal.Static
+	}
+	err = policy.CheckIPType(ipType)
+	if err != nil {
+		block(AllocationBlockedIPTypeNotAllowed, "%s", err)
 	}
 
-	for _, prefix := range parent.Prefixes.OfFamily(af) {
-		pfx, err := netip.ParsePrefix(prefix.String())
+	if req.Ip != nil {
+		if policy.NoSpecificIP {
+			block(AllocationBlockedSpecificIPUnavailable, "network:%s does not allow allocation of specific ips", nw.ID)
+		} else {
+			availabilities, err := r.CheckSpecificIPs(ctx, nw, []string{*req.Ip})
+			if err != nil {
+				return nil, err
+			}
+			if a := availabilities[0]; !a.Allocatable {
+				block(AllocationBlockedSpecificIPUnavailable, "ip:%s can not be allocated: %s", a.IP, a.Reason)
+			}
+		}
+	} else if familyPresent {
+		free, err := r.freeIPs(ctx, r.r.ipamNamespace(nw), nw.Prefixes.OfFamily(family))
 		if err != nil {
-			return "", "", fmt.Errorf("unable to parse prefix: %w", err)
+			return nil, err
 		}
-
-		if !pfx.Contains(parsedIP) {
-			continue
+		if free == 0 {
+			block(AllocationBlockedExhausted, "no ips of addressfamily:%s left in network:%s", family, nw.ID)
 		}
+	}
 
-		resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: prefix.String(), Ip: &specificIP}))
-		var connectErr *connect.Error
-		if errors.As(err, &connectErr) {
-			if connectErr.Code() == connect.CodeAlreadyExists {
-				return "", "", generic.Conflict("ip already allocated")
-			}
-		}
+	res.Ready = len(res.Blocks) == 0
+
+	return res, nil
+}
+
+// freeIPs returns the number of ips which are not acquired in the given prefixes of the ipam namespace.
+func (r *ipRepository) freeIPs(ctx context.Context, namespace *string, prefixes metal.Prefixes) (uint64, error) {
+	var free uint64
+	for _, prefix := range prefixes {
+		f, err := r.freePrefixIPs(ctx, namespace, prefix.String())
 		if err != nil {
-			return "", "", err
+			return 0, err
 		}
-
-		return resp.Msg.Ip.Ip, prefix.String(), nil
+		free += f
 	}
+	return free, nil
+}
 
-	return "", "", fmt.Errorf("specific ip not contained in any of the defined prefixes")
+// freePrefixIPs returns the number of ips which are not yet acquired in the prefix of the ipam namespace.
+func (r *ipRepository) freePrefixIPs(ctx context.Context, namespace *string, cidr string) (uint64, error) {
+	usage, err := r.r.ipam.PrefixUsage(ctx, connect.NewRequest(&ipamapiv1.PrefixUsageRequest{Cidr: cidr, Namespace: namespace}))
+	if err != nil {
+		return 0, err
+	}
+	if usage.Msg.AvailableIps <= usage.Msg.AcquiredIps {
+		return 0, nil
+	}
+	return usage.Msg.AvailableIps - usage.Msg.AcquiredIps, nil
 }
 
-func (r *ipRepository) AllocateRandomIP(ctx context.Context, parent *metal.Network, af *metal.AddressFamily) (ipAddress, parentPrefixCidr string, err error) {
-	addressfamily := metal.IPv4AddressFamily
-	if af != nil {
-		addressfamily = *af
-	} else if len(parent.Prefixes.AddressFamilies()) == 1 {
-		addressfamily = parent.Prefixes.AddressFamilies()[0]
+// CreatePreferred creates an ip with the first of the preferred ips which is still available.
+// If all preferred ips are already allocated, a random ip is allocated if fallbackToRandom is set.
+func (r *ipRepository) CreatePreferred(ctx context.Context, req *apiv2.IPServiceCreateRequest, preferredIPs []string, fallbackToRandom bool) (*metal.IP, error) {
+	if req.Ip != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("it is not possible to specify specificIP and preferred ips"))
 	}
 
-	for _, prefix := range parent.Prefixes.OfFamily(addressfamily) {
-		resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: prefix.String()}))
-		if err != nil {
-			var connectErr *connect.Error
-			if errors.As(err, &connectErr) {
-				if connectErr.Code() == connect.CodeNotFound {
-					continue
-				}
-			}
-			return "", "", err
+	for _, preferredIP := range preferredIPs {
+		rq := proto.Clone(req).(*apiv2.IPServiceCreateRequest)
+		rq.Ip = &preferredIP
+
+		ip, err := r.create(ctx, rq, allocateRandom)
+		if err == nil {
+			return ip, nil
+		}
+		if !generic.IsConflict(err) {
+			return nil, err
 		}
 
-		return resp.Msg.Ip.Ip, prefix.String(), nil
+		r.r.log.Debug("preferred ip already allocated, trying next", "ip", preferredIP)
 	}
 
-	return "", "", fmt.Errorf("cannot allocate random free ip in ipam, no ips left in network:%s af:%s parent afs:%#v", parent.ID, addressfamily, parent.Prefixes.AddressFamilies())
-}
-func (r *ipRepository) ConvertToInternal(ip *apiv2.IP) (*metal.IP, error) {
+	if !fallbackToRandom {
+		return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("all preferred ips are already allocated: %v", preferredIPs))
+	}
 
-	panic("unimplemented")
+	return r.create(ctx, req, allocateRandom)
 }
-func (r *ipRepository) ConvertToProto(metalIP *metal.IP) (*apiv2.IP, error) {
-	t := apiv2.IPType_IP_TYPE_UNSPECIFIED
-	switch metalIP.Type {
-	case metal.Ephemeral:
-		t = apiv2.IPType_IP_TYPE_EPHEMERAL
-	case metal.Static:
-		t = apiv2.IPType_IP_TYPE_STATIC
+
+// CreateWithFallback creates an ip with the specific ip of the request, if it is already allocated a random ip of the address family of the request is created instead.
+// Unlike Create both the ip and the address family must be given, the address family must match the one of the ip.
+func (r *ipRepository) CreateWithFallback(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	if req.Ip == nil || req.AddressFamily == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("specificIP and addressfamily must be given to fall back to a random ip"))
 	}
 
-	ip := &apiv2.IP{
-		Ip:          metalIP.IPAddress,
-		Uuid:        metalIP.AllocationUUID,
-		Name:        metalIP.Name,
-		Description: metalIP.Description,
-		Network:     metalIP.NetworkID,
-		Project:     metalIP.ProjectID,
-		Type:        t,
-		Tags:        metalIP.Tags,
-		CreatedAt:   timestamppb.New(metalIP.Created),
-		UpdatedAt:   timestamppb.New(metalIP.Changed),
+	addr, err := netip.ParseAddr(*req.Ip)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid ip %q: %w", *req.Ip, err))
 	}
-	return ip, nil
+	if (*req.AddressFamily == apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4) != addr.Is4() {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip %s does not match the fallback addressfamily %s", *req.Ip, req.AddressFamily.String()))
+	}
+
+	specific := proto.Clone(req).(*apiv2.IPServiceCreateRequest)
+	specific.AddressFamily = nil
+
+	ip, err := r.create(ctx, specific, allocateRandom)
+	if err == nil {
+		return ip, nil
+	}
+	if !generic.IsConflict(err) {
+		return nil, err
+	}
+
+	r.r.log.Debug("specific ip already allocated, falling back to a random ip", "ip", *req.Ip, "addressfamily", req.AddressFamily.String())
+
+	random := proto.Clone(req).(*apiv2.IPServiceCreateRequest)
+	random.Ip = nil
+
+	return r.create(ctx, random, allocateRandom)
 }
 
-func (r *Repostore) IpDeleteAction(ctx context.Context, job tx.Job) error {
-	metalIP, err := r.ds.IP().Find(ctx, queries.IpFilter(&apiv2.IPQuery{Uuid: &job.ID}))
-	if err != nil && !generic.IsNotFound(err) {
-		return err
+// CreateNth creates an ip with the nth usable address of the given prefix of the network, the first usable address is the 1st.
+// This serves fixed address layouts, e.g. the gateway being the 1st and a service being the 5th usable address.
+func (r *ipRepository) CreateNth(ctx context.Context, req *apiv2.IPServiceCreateRequest, prefixCidr string, n uint64) (*metal.IP, error) {
+	if req.Ip != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("it is not possible to specify specificIP and the nth address of a prefix"))
 	}
-	if metalIP == nil {
-		r.log.Info("ds find, metalip is nil", "job", job)
 
-		return nil
+	pfx, err := netip.ParsePrefix(prefixCidr)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid prefix %q: %w", prefixCidr, err))
 	}
-	r.log.Info("ds find", "metalip", metalIP)
 
-	_, err = r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: metalIP.ParentPrefixCidr, Ip: metalIP.IPAddress}))
+	nw, err := r.r.Network(nil).Get(ctx, req.Network)
 	if err != nil {
-		r.log.Error("ipam release", "error", err)
+		return nil, err
+	}
+	if !slices.ContainsFunc(nw.Prefixes, func(p metal.Prefix) bool { return p.String() == pfx.Masked().String() }) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("prefix %s is not part of network:%s", prefixCidr, nw.ID))
+	}
+
+	addr, err := metal.NewPrefixRange(pfx).Nth(n)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	rq := proto.Clone(req).(*apiv2.IPServiceCreateRequest)
+	rq.Ip = pointer.Pointer(addr.String())
+
+	return r.create(ctx, rq, allocateRandom)
+}
+
+// maxBlockSize is the maximum number of ips of a contiguous block, every ip of the block is stored on its own.
+const maxBlockSize = 256
+
+// CreateBlock creates n ips with consecutive addresses in the given prefix of the network, e.g. for appliances which need an address range.
+// The lowest run of n free addresses is taken, the creation fails if no such run is left in the prefix.
+// Either all ips of the block are created or none of them.
+func (r *ipRepository) CreateBlock(ctx context.Context, req *apiv2.IPServiceCreateRequest, prefixCidr string, n int) ([]*metal.IP, error) {
+	if req.Ip != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("it is not possible to specify specificIP and a block of ips"))
+	}
+	if n < 1 || n > maxBlockSize {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("the size of a block must be between 1 and %d, got %d", maxBlockSize, n))
+	}
+
+	pfx, err := netip.ParsePrefix(prefixCidr)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid prefix %q: %w", prefixCidr, err))
+	}
+	pfx = pfx.Masked()
+
+	prepared, err := r.prepare(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	nw := prepared.nw
+	if !slices.ContainsFunc(nw.Prefixes, func(p metal.Prefix) bool { return p.String() == pfx.String() }) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("prefix %s is not part of network:%s", prefixCidr, nw.ID))
+	}
+	if prepared.af != nil && (*prepared.af == metal.IPv4AddressFamily) != pfx.Addr().Is4() {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("prefix %s is not of addressfamily:%s", prefixCidr, *prepared.af))
+	}
+
+	addrs, err := r.AllocateContiguousIPs(ctx, nw, pfx, n)
+	if err != nil {
+		var connectErr *connect.Error
+		if errors.As(err, &connectErr) {
+			return nil, err
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	namespace := r.r.ipamNamespace(nw)
+	ips := make([]*metal.IP, 0, len(addrs))
+	for i, addr := range addrs {
+		ip, err := r.store(ctx, prepared, addr, pfx.String(), metal.AllocationMethodRandom)
+		if err != nil {
+			// store already released the failed address, the rest of the block must not stay allocated either
+			for _, rest := range addrs[i+1:] {
+				r.releaseAcquired(ctx, namespace, IPAMAllocation{IP: rest, ParentPrefixCidr: pfx.String()})
+			}
+			for _, stored := range ips {
+				derr := r.r.ds.IP().Delete(context.WithoutCancel(ctx), stored)
+				if derr != nil {
+					r.r.log.Error("unable to roll back ip of block", "ip", stored.IPAddress, "error", derr)
+					continue
+				}
+				r.releaseAcquired(ctx, namespace, IPAMAllocation{IP: stored.IPAddress, ParentPrefixCidr: stored.ParentPrefixCidr})
+			}
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+
+	r.r.log.Info("allocated block of ips", "first", addrs[0], "last", addrs[len(addrs)-1], "network", nw.ID, "type", prepared.ipType)
+	for _, ip := range ips {
+		r.r.publishIPEvent(ctx, IPEventCreated, ip)
+	}
+
+	return ips, nil
+}
+
+func (r *ipRepository) Update(ctx context.Context, rq *apiv2.IPServiceUpdateRequest) (*metal.IP, error) {
+	return r.update(ctx, rq, nil)
+}
+
+// IPTagPrecondition restricts an update to ips which currently carry all of the required tags and none of the forbidden tags.
+// A tag is either given as key=value to match exactly or as key only to match any value of this key.
+type IPTagPrecondition struct {
+	Required  []string
+	Forbidden []string
+}
+
+// check returns an error if the given tags do not satisfy the precondition.
+func (p IPTagPrecondition) check(ip *metal.IP) error {
+	tm := tag.NewTagMap(ip.Tags)
+
+	has := func(t string) bool {
+		key, value, withValue := strings.Cut(t, "=")
+		if !withValue {
+			_, ok := tm.Value(key)
+			return ok
+		}
+		return tm.Contains(key, value)
+	}
+
+	for _, t := range p.Required {
+		if !has(t) {
+			return fmt.Errorf("ip:%s does not have the required tag %s", ip.IPAddress, t)
+		}
+	}
+	for _, t := range p.Forbidden {
+		if has(t) {
+			return fmt.Errorf("ip:%s has the forbidden tag %s", ip.IPAddress, t)
+		}
+	}
+
+	return nil
+}
+
+// UpdateIf updates the ip only if its current tags satisfy the precondition, e.g. to implement a state machine on tags.
+// The precondition is checked against the same state of the ip the update is based on, a concurrent change lets the update fail with a conflict.
+func (r *ipRepository) UpdateIf(ctx context.Context, rq *apiv2.IPServiceUpdateRequest, precondition IPTagPrecondition) (*metal.IP, error) {
+	return r.update(ctx, rq, &precondition)
+}
+
+func (r *ipRepository) update(ctx context.Context, rq *apiv2.IPServiceUpdateRequest, precondition *IPTagPrecondition) (*metal.IP, error) {
+	old, err := r.Get(ctx, rq.Ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if precondition != nil {
+		err = precondition.check(old)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, err)
+		}
+	}
+
+	// all changes are applied to a copy which is validated as a whole and written at once,
+	// so nothing is persisted if any of the fields is invalid.
+	new := *old
+
+	if rq.Description != nil {
+		new.Description = *rq.Description
+	}
+	if rq.Name != nil {
+		new.Name = *rq.Name
+	}
+	if rq.Type != nil {
+		var t metal.IPType
+		switch *rq.Type {
+		case apiv2.IPType_IP_TYPE_EPHEMERAL:
+			t = metal.Ephemeral
+		case apiv2.IPType_IP_TYPE_STATIC:
+			t = metal.Static
+		case apiv2.IPType_IP_TYPE_UNSPECIFIED:
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip type cannot be unspecified: %s", rq.Type))
+		default:
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("given ip type is not supported:%s", rq.Type))
+		}
+		if t != old.Type {
+			nw, err := r.r.Network(nil).Get(ctx, old.NetworkID)
+			if err != nil {
+				return nil, err
+			}
+			err = nw.AllocationPolicy().CheckIPType(t)
+			if err != nil {
+				return nil, connect.NewError(connect.CodeFailedPrecondition, err)
+			}
+		}
+		new.Type = t
+	}
+	err = validate.ValidateNameAndDescription(new.Name, new.Description, r.r.lengthLimits)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	new.Tags = dedupTags(rq.Tags)
+	if r.scope != nil {
+		// internal tags are not shown to users, they are kept as they are
+		new.Tags = append(slices.DeleteFunc(slices.Clone(new.Tags), isInternalTag), slices.DeleteFunc(slices.Clone(old.Tags), func(t string) bool { return !isInternalTag(t) })...)
+	}
+
+	err = validate.ValidateReservedTags(new.Tags)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	err = validate.ValidateIPTypeAndTags(new.Type, new.Tags)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	// only static ips keep the reason why they were made static
+	if new.Type != metal.Static {
+		new.StaticReason = ""
+	}
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// dedupTags removes tags with the same key, the value given last wins and the tags keep the order of their keys' first occurrence.
+func dedupTags(tags []string) []string {
+	tm := tag.NewTagMap(tags)
+	if len(tm) == len(tags) {
+		return tags
+	}
+
+	var (
+		res  []string
+		seen = map[string]bool{}
+	)
+	for _, t := range tags {
+		key, _, _ := strings.Cut(t, "=")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		value := tm[key]
+		if value == "" && !strings.Contains(t, "=") {
+			res = append(res, key)
+			continue
+		}
+		res = append(res, tag.New(key, value))
+	}
+
+	return res
+}
+
+// internalTagKeys are the keys of the tags which are maintained by metal-stack for machine ips and leases,
+// they are only shown to admins.
+var internalTagKeys = []string{tag.MachineID, metal.TagIPOwner, metal.TagIPLeaseExpiry}
+
+func isInternalTag(t string) bool {
+	key, _, _ := strings.Cut(t, "=")
+	return slices.Contains(internalTagKeys, key)
+}
+
+func (r *ipRepository) Delete(ctx context.Context, ip *metal.IP) (*metal.IP, error) {
+	return r.delete(ctx, ip, false)
+}
+
+// ForceDelete releases the ip like Delete, even if it still has a hostname whose dns records are left dangling.
+// Ips which are still in use are not released anyway.
+func (r *ipRepository) ForceDelete(ctx context.Context, ip *metal.IP) (*metal.IP, error) {
+	return r.delete(ctx, ip, true)
+}
+
+func (r *ipRepository) delete(ctx context.Context, ip *metal.IP, force bool) (*metal.IP, error) {
+	ip, err := r.Get(ctx, ip.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if hostname, ok := tag.NewTagMap(ip.Tags).Value(metal.TagIPHostname); ok && !force {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s still has the hostname %s, remove it first or force the release to leave its dns records dangling", ip.IPAddress, hostname))
+	}
+	if refs := ipReferences(ip); len(refs) > 0 {
+		var users []string
+		for _, ref := range refs {
+			users = append(users, ref.String())
+		}
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s is still in use by %s", ip.IPAddress, strings.Join(users, ", ")))
+	}
+	err = r.r.q.Insert(ctx, &tx.Tx{Jobs: []tx.Job{{ID: ip.AllocationUUID, Action: tx.ActionIpDelete}}})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// IPBulkRelease is the result of releasing ips in bulk.
+type IPBulkRelease struct {
+	Released []*metal.IP
+	// Refused contains the reason by ip address for every ip which was not released.
+	Refused map[string]string
+}
+
+// DeleteByFilter releases all ips matching the query, e.g. when a project or a cluster is decommissioned.
+// Every ip is released on its own like with Delete, an ip which can not be released does not prevent the others from being released.
+// Static ips and ips with a hostname are refused unless force is set, ips which are still in use are refused anyway.
+// A query is required, all ips are never released at once.
+func (r *ipRepository) DeleteByFilter(ctx context.Context, rq *apiv2.IPQuery, force bool) (*IPBulkRelease, error) {
+	if rq == nil || proto.Equal(rq, &apiv2.IPQuery{}) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("a query must be given to release ips in bulk"))
+	}
+
+	qs := r.queries(rq)
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &IPBulkRelease{Refused: map[string]string{}}
+	for _, ip := range ips {
+		if ip.Type == metal.Static && !force {
+			result.Refused[ip.IPAddress] = "ip is static, releasing it must be forced"
+			continue
+		}
+
+		released, err := r.delete(ctx, ip, force)
+		if err != nil {
+			r.r.log.Error("unable to release ip in bulk", "ip", ip.IPAddress, "error", err)
+			result.Refused[ip.IPAddress] = err.Error()
+			continue
+		}
+
+		result.Released = append(result.Released, released)
+	}
+
+	return result, nil
+}
+
+// IPProjectRelease is the result of releasing the ips of a project which is about to be deleted.
+type IPProjectRelease struct {
+	Released []*metal.IP
+	// Blocking are the ips which prevent the deletion of the project, these are static ips and ephemeral ips which could not be released.
+	Blocking []*metal.IP
+}
+
+// ReleaseForProjectDeletion releases all ephemeral ips of the project in ipam and the datastore, it is meant to be called on the deletion of the project.
+// Static ips are never released automatically, they are reported as blocking and must be released explicitly before the project can be deleted.
+func (r *ipRepository) ReleaseForProjectDeletion(ctx context.Context, project string) (*IPProjectRelease, error) {
+	if project == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("project should not be empty"))
+	}
+
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &IPProjectRelease{}
+	for _, ip := range ips {
+		if ip.Type == metal.Static {
+			result.Blocking = append(result.Blocking, ip)
+			continue
+		}
+
+		released, err := r.delete(ctx, ip, false)
+		if err != nil {
+			r.r.log.Error("unable to release ephemeral ip of deleted project", "ip", ip.IPAddress, "project", project, "error", err)
+			result.Blocking = append(result.Blocking, ip)
+			continue
+		}
+
+		result.Released = append(result.Released, released)
+	}
+
+	return result, nil
+}
+
+// Ping checks that the datastore is reachable with a trivial query.
+func (r *ipRepository) Ping(ctx context.Context) error {
+	// no ip has an empty address, a not found error proves that the query was answered
+	_, err := r.r.ds.IP().Get(ctx, "")
+	if err != nil && !generic.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ipReferences returns the resources which still use the given ip according to its tags.
+// This datastore has no records of machines and loadbalancers which could be queried, they mark the ips they use
+// with tags. An ip whose tags were removed is therefore not considered in use, even if a machine still has it.
+func ipReferences(ip *metal.IP) []metal.IPReference {
+	var refs []metal.IPReference
+
+	tm := tag.NewTagMap(ip.Tags)
+	if machineID, ok := tm.Value(tag.MachineID); ok {
+		refs = append(refs, metal.IPReference{Kind: metal.IPReferenceKindMachine, ID: machineID})
+	}
+	if service, ok := tm.Value(tag.ClusterServiceFQN); ok {
+		refs = append(refs, metal.IPReference{Kind: metal.IPReferenceKindService, ID: service})
+	}
+
+	return refs
+}
+
+// ReassignProject moves all ips of the source project to the target project, e.g. to preserve static ips of a
+// project which is going to be deleted. If one of the ips can not be moved, the already moved ips are moved back.
+// Ips with a pending transfer are left in the source project, the transfer must be accepted or cancelled first.
+func (r *ipRepository) ReassignProject(ctx context.Context, sourceProject, targetProject string) ([]*metal.IP, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reassigning ips to another project is only possible unscoped"))
+	}
+	if sourceProject == "" || targetProject == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("source and target project must be given"))
+	}
+	if sourceProject == targetProject {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("source and target project must not be the same"))
+	}
+
+	_, err := r.r.Project(nil).Get(ctx, targetProject)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to find target project %q: %w", targetProject, err))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, queries.IpProjectScoped(sourceProject))
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []*metal.IP
+	for _, old := range ips {
+		if old.Transfer != nil {
+			r.r.log.Info("not reassigning ip with a pending transfer", "ip", old.IPAddress, "transfer-target", old.Transfer.TargetProjectID)
+			continue
+		}
+
+		new := *old
+		new.ProjectID = targetProject
+
+		err := r.r.ds.IP().Update(ctx, &new, old)
+		if err != nil {
+			r.r.log.Error("unable to reassign ip, rolling back", "ip", old.IPAddress, "error", err)
+			r.rollbackReassign(ctx, moved, sourceProject)
+			return nil, err
+		}
+
+		moved = append(moved, &new)
+	}
+
+	for _, ip := range moved {
+		r.r.publishIPEvent(ctx, IPEventUpdated, ip)
+	}
+
+	return moved, nil
+}
+
+func (r *ipRepository) rollbackReassign(ctx context.Context, moved []*metal.IP, sourceProject string) {
+	for _, ip := range moved {
+		reverted := *ip
+		reverted.ProjectID = sourceProject
+
+		err := r.r.ds.IP().Update(context.WithoutCancel(ctx), &reverted, ip)
+		if err != nil {
+			r.r.log.Error("unable to roll back reassigned ip", "ip", ip.IPAddress, "project", sourceProject, "error", err)
+		}
+	}
+}
+
+// MoveParentPrefix sets the parent prefix of all ips of the old prefix to the new prefix, e.g. after a prefix was renumbered.
+// Every ip must be contained in the new prefix, otherwise no ip is moved at all. If one of the ips can not be updated,
+// the already moved ips are moved back. Only the datastore is updated, the allocations in ipam are expected to be renumbered already.
+func (r *ipRepository) MoveParentPrefix(ctx context.Context, oldPrefix, newPrefix string) ([]*metal.IP, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("moving ips to another parent prefix is only possible unscoped"))
+	}
+
+	from, err := netip.ParsePrefix(oldPrefix)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid prefix %q: %w", oldPrefix, err))
+	}
+	to, err := netip.ParsePrefix(newPrefix)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid prefix %q: %w", newPrefix, err))
+	}
+	from, to = from.Masked(), to.Masked()
+	if from == to {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("old and new prefix must not be the same"))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, queries.IpFilter(&apiv2.IPQuery{ParentPrefixCidr: pointer.Pointer(from.String())}))
+	if err != nil {
+		return nil, err
+	}
+
+	var misfits []string
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip.IPAddress)
+		if err != nil || !to.Contains(addr) {
+			misfits = append(misfits, ip.IPAddress)
+		}
+	}
+	if len(misfits) > 0 {
+		slices.Sort(misfits)
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ips %s of prefix:%s are not contained in prefix:%s", strings.Join(misfits, ","), from.String(), to.String()))
+	}
+
+	var moved []*metal.IP
+	for _, old := range ips {
+		new := *old
+		new.ParentPrefixCidr = to.String()
+
+		err := r.r.ds.IP().Update(ctx, &new, old)
+		if err != nil {
+			r.r.log.Error("unable to move ip to new parent prefix, rolling back", "ip", old.IPAddress, "prefix", to.String(), "error", err)
+			r.rollbackMoveParentPrefix(ctx, moved, from.String())
+			return nil, err
+		}
+
+		moved = append(moved, &new)
+	}
+
+	r.r.log.Info("moved ips to new parent prefix", "from", from.String(), "to", to.String(), "count", len(moved))
+	for _, ip := range moved {
+		r.r.publishIPEvent(ctx, IPEventUpdated, ip)
+	}
+
+	return moved, nil
+}
+
+func (r *ipRepository) rollbackMoveParentPrefix(ctx context.Context, moved []*metal.IP, oldPrefix string) {
+	for _, ip := range moved {
+		reverted := *ip
+		reverted.ParentPrefixCidr = oldPrefix
+
+		err := r.r.ds.IP().Update(context.WithoutCancel(ctx), &reverted, ip)
+		if err != nil {
+			r.r.log.Error("unable to roll back moved ip", "ip", ip.IPAddress, "prefix", oldPrefix, "error", err)
+		}
+	}
+}
+
+// IPAddressNormalization describes the rewrite of a stored ip address to its canonical form.
+type IPAddressNormalization struct {
+	From string
+	To   string
+	// Conflict is set if an ip with the canonical address is already stored, the stored ip is left as it is and both must be consolidated manually.
+	Conflict bool
+}
+
+// NormalizeIPAddresses rewrites all stored ip addresses which are not in their canonical form, e.g. ipv6 addresses in upper case.
+// The address is the id of an ip, the ip is therefore stored again with its canonical address and the non-canonical one is removed.
+// If the non-canonical one can not be removed, the canonical copy is removed again so that no ip is stored twice.
+func (r *ipRepository) NormalizeIPAddresses(ctx context.Context) ([]IPAddressNormalization, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("normalizing ip addresses is only possible unscoped"))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []IPAddressNormalization
+	for _, old := range ips {
+		normalized, err := metal.NormalizeIPAddress(old.IPAddress)
+		if err != nil {
+			return res, connect.NewError(connect.CodeInternal, err)
+		}
+		if normalized == old.IPAddress {
+			continue
+		}
+
+		_, err = r.r.ds.IP().Get(ctx, normalized)
+		if err == nil {
+			r.r.log.Error("unable to normalize ip address, an ip with the canonical address already exists", "ip", old.IPAddress, "canonical", normalized)
+			res = append(res, IPAddressNormalization{From: old.IPAddress, To: normalized, Conflict: true})
+			continue
+		}
+		if !generic.IsNotFound(err) {
+			return res, err
+		}
+
+		new := *old
+		new.IPAddress = normalized
+
+		err = r.r.ds.IP().Upsert(ctx, &new)
+		if err != nil {
+			return res, err
+		}
+		err = r.r.ds.IP().Delete(ctx, old)
+		if err != nil {
+			// the ip must not be stored twice, so the normalized copy is removed again
+			derr := r.r.ds.IP().Delete(context.WithoutCancel(ctx), &new)
+			if derr != nil {
+				r.r.log.Error("unable to roll back normalized ip address", "ip", old.IPAddress, "canonical", normalized, "error", derr)
+			}
+			return res, err
+		}
+
+		r.r.publishIPEvent(ctx, IPEventDeleted, old)
+		r.r.publishIPEvent(ctx, IPEventCreated, &new)
+
+		res = append(res, IPAddressNormalization{From: old.IPAddress, To: normalized})
+	}
+
+	return res, nil
+}
+
+// IPTagRepair describes the rewrite of the tags of an ip which had tags without key or with duplicate keys.
+type IPTagRepair struct {
+	IPAddress string
+	From      []string
+	To        []string
+}
+
+// RepairTags removes the tags without key of all ips and collapses tags with duplicate keys to the last value of the key,
+// which is the value a tag map already reads. It is only possible unscoped.
+func (r *ipRepository) RepairTags(ctx context.Context) ([]IPTagRepair, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("repairing tags is only possible unscoped"))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []IPTagRepair
+	for _, old := range ips {
+		if validate.ValidateTagIntegrity(old.Tags) == nil {
+			continue
+		}
+
+		new := *old
+		new.Tags = dedupTags(slices.DeleteFunc(slices.Clone(old.Tags), func(t string) bool {
+			key, _, _ := strings.Cut(t, "=")
+			return key == ""
+		}))
+
+		err = r.r.ds.IP().Update(ctx, &new, old)
+		if err != nil {
+			return res, err
+		}
+
+		r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+		res = append(res, IPTagRepair{IPAddress: old.IPAddress, From: old.Tags, To: new.Tags})
+	}
+
+	return res, nil
+}
+
+// InitiateTransfer offers the ip to the target project, the ip stays in its project until the target project accepts the transfer.
+// It must be called in the scope of the project the ip belongs to, a pending transfer of the ip is replaced.
+func (r *ipRepository) InitiateTransfer(ctx context.Context, ipAddress, targetProject, initiatedBy string) (*metal.IP, error) {
+	if r.scope == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("transferring an ip must be initiated by the project it belongs to"))
+	}
+	if targetProject == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("target project must be given"))
+	}
+	if targetProject == r.scope.projectID {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("target project must not be the project of the ip"))
+	}
+
+	_, err := r.r.Project(nil).Get(ctx, targetProject)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to find target project %q: %w", targetProject, err))
+	}
+
+	old, err := r.Get(ctx, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	new := *old
+	new.Transfer = &metal.IPTransfer{
+		SourceProjectID: old.ProjectID,
+		TargetProjectID: targetProject,
+		InitiatedBy:     initiatedBy,
+		Initiated:       time.Now(),
+	}
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// AcceptTransfer moves the ip into the project its pending transfer offers it to.
+// It must be called in the scope of the target project, ips which are not offered to it are not found.
+func (r *ipRepository) AcceptTransfer(ctx context.Context, ipAddress string) (*metal.IP, error) {
+	if r.scope == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("transferring an ip must be accepted by the target project"))
+	}
+
+	old, err := r.offered(ctx, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	if old.ProjectID != old.Transfer.SourceProjectID {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s was moved to another project after the transfer was initiated", ipAddress))
+	}
+
+	new := *old
+	new.ProjectID = r.scope.projectID
+	new.Transfer = nil
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// RejectTransfer declines the pending transfer of the ip, the ip stays in its project.
+// It must be called in the scope of the target project, ips which are not offered to it are not found.
+func (r *ipRepository) RejectTransfer(ctx context.Context, ipAddress string) (*metal.IP, error) {
+	if r.scope == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("transferring an ip must be rejected by the target project"))
+	}
+
+	old, err := r.offered(ctx, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	new := *old
+	new.Transfer = nil
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// offered returns the ip if it is offered to the project of the scope by a pending transfer.
+func (r *ipRepository) offered(ctx context.Context, ipAddress string) (*metal.IP, error) {
+	ip, err := r.r.ds.IP().Find(ctx, queries.IpFilter(&apiv2.IPQuery{Ip: &ipAddress}), queries.IpTransferTargetScoped(r.scope.projectID))
+	if err != nil {
+		if generic.IsNotFound(err) {
+			// respond exactly like for a non existing ip in order to not leak its existence
+			return nil, generic.NotFound("no ip with id %q offered to project:%s found", ipAddress, r.scope.projectID)
+		}
+		return nil, err
+	}
+
+	return ip, nil
+}
+
+// CancelTransfer withdraws the pending transfer of the ip, it must be called in the scope of the project the ip belongs to.
+func (r *ipRepository) CancelTransfer(ctx context.Context, ipAddress string) (*metal.IP, error) {
+	if r.scope == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("transferring an ip must be canceled by the project it belongs to"))
+	}
+
+	old, err := r.Get(ctx, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	if old.Transfer == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s has no pending transfer", ipAddress))
+	}
+
+	new := *old
+	new.Transfer = nil
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// RefreshLease renews the lease of the ip to the lease duration of its network from now on, e.g. as heartbeat of the controller owning it.
+// Only ips with a lease which has not lapsed yet can be refreshed, an ip with an expired lease must be allocated again.
+func (r *ipRepository) RefreshLease(ctx context.Context, ipAddress string) (*metal.IP, error) {
+	old, err := r.Get(ctx, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := tag.NewTagMap(old.Tags).Value(metal.TagIPLeaseExpiry)
+	if !ok {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s has no lease which could be refreshed", ipAddress))
+	}
+	now := time.Now()
+	err = validate.ValidateIPLease(old.Tags, now)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("lease of ip:%s can not be refreshed, it must be allocated again: %w", ipAddress, err))
+	}
+
+	nw, err := r.r.ds.Network().Get(ctx, old.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	lease := nw.MachineIPLease()
+	if lease == 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("network:%s has no lease duration configured, lease of ip:%s can not be refreshed", nw.ID, ipAddress))
+	}
+
+	new := *old
+	new.Tags = slices.Clone(old.Tags)
+	for i, t := range new.Tags {
+		if t == tag.New(metal.TagIPLeaseExpiry, value) {
+			new.Tags[i] = tag.New(metal.TagIPLeaseExpiry, now.Add(lease).UTC().Format(time.RFC3339))
+		}
+	}
+
+	err = r.r.ds.IP().Update(ctx, &new, old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+
+	return &new, nil
+}
+
+// IPPromotion is the result of promoting ips to static.
+type IPPromotion struct {
+	Promoted []*metal.IP
+	// Refused contains the reason by ip address for every ip which was not promoted.
+	Refused map[string]string
+}
+
+// PromoteToStatic makes all ephemeral ips matching the query static, so they survive the teardown of the machine they are attached to.
+// Every ip is updated on its own, an ip which can not be promoted does not prevent the others from being promoted.
+// Ips which are already static or which must stay ephemeral by policy are refused. The reason is kept on the promoted ips.
+// Like on create, only admins may make machine ips static. A query is required, all ips are never promoted at once.
+func (r *ipRepository) PromoteToStatic(ctx context.Context, rq *apiv2.IPQuery, reason string) (*IPPromotion, error) {
+	if rq == nil || proto.Equal(rq, &apiv2.IPQuery{}) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("a query must be given to promote ips in bulk"))
+	}
+
+	qs := r.queries(rq)
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result   = &IPPromotion{Refused: map[string]string{}}
+		networks = map[string]*metal.Network{}
+	)
+	for _, old := range ips {
+		if old.Type == metal.Static {
+			result.Refused[old.IPAddress] = "ip is already static"
+			continue
+		}
+		if _, ok := tag.NewTagMap(old.Tags).Value(tag.MachineID); ok && r.scope != nil {
+			result.Refused[old.IPAddress] = fmt.Sprintf("ips of machines can not be made %s, they are released together with the machine", metal.Static)
+			continue
+		}
+
+		err := validate.ValidateIPTypeAndTags(metal.Static, old.Tags)
+		if err != nil {
+			result.Refused[old.IPAddress] = err.Error()
+			continue
+		}
+
+		nw, ok := networks[old.NetworkID]
+		if !ok {
+			nw, err = r.r.Network(nil).Get(ctx, old.NetworkID)
+			if err != nil {
+				return nil, err
+			}
+			networks[old.NetworkID] = nw
+		}
+		err = nw.AllocationPolicy().CheckIPType(metal.Static)
+		if err != nil {
+			result.Refused[old.IPAddress] = err.Error()
+			continue
+		}
+
+		new := *old
+		new.Type = metal.Static
+		new.StaticReason = reason
+
+		err = r.r.ds.IP().Update(ctx, &new, old)
+		if err != nil {
+			r.r.log.Error("unable to promote ip to static", "ip", old.IPAddress, "error", err)
+			result.Refused[old.IPAddress] = err.Error()
+			continue
+		}
+
+		r.r.publishIPEvent(ctx, IPEventUpdated, &new)
+		result.Promoted = append(result.Promoted, &new)
+	}
+
+	return result, nil
+}
+
+// IPIssueProblem names the kind of inconsistency detected for an ip.
+type IPIssueProblem string
+
+const (
+	// IPIssueInvalidTags is an ip whose tags do not match its type.
+	IPIssueInvalidTags IPIssueProblem = "invalid-tags"
+	// IPIssueTagIntegrity is an ip with tags without key or with duplicate keys.
+	IPIssueTagIntegrity IPIssueProblem = "tag-integrity"
+	// IPIssueLeaseExpired is an ip whose lease expired, it is considered orphaned.
+	IPIssueLeaseExpired IPIssueProblem = "lease-expired"
+	// IPIssueNotInIPAM is an ip which is recorded in the datastore but not allocated in ipam.
+	IPIssueNotInIPAM IPIssueProblem = "not-in-ipam"
+	// IPIssueOnlyInIPAM is an ip which is allocated in ipam but not recorded in the datastore.
+	IPIssueOnlyInIPAM IPIssueProblem = "only-in-ipam"
+	// IPIssuePrefixMismatch is an ip which is allocated in ipam in another prefix than recorded in the datastore.
+	IPIssuePrefixMismatch IPIssueProblem = "prefix-mismatch"
+	// IPIssueOutsideParentPrefix is an ip whose address is not contained in its recorded parent prefix, e.g. after a bad import.
+	IPIssueOutsideParentPrefix IPIssueProblem = "outside-parent-prefix"
+	// IPIssueNetworkAddressFamilies is a network whose addressfamilies do not match its prefixes.
+	IPIssueNetworkAddressFamilies IPIssueProblem = "network-addressfamilies"
+)
+
+// IPIssue describes an inconsistency detected for an ip with enough context to act on it without looking the ip up.
+type IPIssue struct {
+	IP          *metal.IP
+	Address     string
+	Network     string
+	Project     string
+	Problem     IPIssueProblem
+	Description string
+	Remediation string
+}
+
+func newIPIssue(ip *metal.IP, problem IPIssueProblem, description, remediation string) IPIssue {
+	return IPIssue{
+		IP:          ip,
+		Address:     ip.IPAddress,
+		Network:     ip.NetworkID,
+		Project:     ip.ProjectID,
+		Problem:     problem,
+		Description: description,
+		Remediation: remediation,
+	}
+}
+
+// IPAMAllocation is an ip acquired in ipam.
+type IPAMAllocation struct {
+	IP               string
+	ParentPrefixCidr string
+	// Namespace is the ipam namespace the ip is acquired in, it is empty for the default namespace.
+	Namespace string
+}
+
+// IPPrefixMismatch is an ip which is acquired in ipam in another prefix than recorded in the datastore.
+type IPPrefixMismatch struct {
+	IP                   *metal.IP
+	IPAMParentPrefixCidr string
+}
+
+// IPDiff is the difference between the ips in the datastore and the ips acquired in ipam.
+type IPDiff struct {
+	OnlyInDatastore []*metal.IP
+	OnlyInIPAM      []IPAMAllocation
+	PrefixMismatch  []IPPrefixMismatch
+}
+
+// Diff compares all ips in the datastore with the ips acquired in ipam.
+// Reserved ips, gateways and excluded ips of the networks are taken into account as well.
+func (r *ipRepository) Diff(ctx context.Context) (*IPDiff, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("comparing ips with ipam is only possible unscoped"))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nws, err := r.r.ds.Network().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same address may be acquired in several namespaces, so ips are compared within the namespace of their network.
+	// the default namespace is always compared, ips of networks which do not exist anymore are looked up there.
+	var (
+		namespaces = map[string]*string{"": nil}
+		namespace  = map[string]string{}
+		recorded   = map[string]map[string]bool{"": {}}
+	)
+	for _, nw := range nws {
+		ns := r.r.ipamNamespace(nw)
+		name := pointer.SafeDeref(ns)
+		namespaces[name] = ns
+		namespace[nw.ID] = name
+		if recorded[name] == nil {
+			recorded[name] = map[string]bool{}
+		}
+
+		// gateways are held in ipam by the random allocation of ips
+		for _, gateway := range nw.GatewayIPs() {
+			recorded[name][gateway] = true
+		}
+		for _, reserved := range nw.ReservedIPs {
+			rng, err := metal.ParseReservedRange(reserved)
+			if err != nil {
+				recorded[name][reserved] = true
+				continue
+			}
+			for _, addr := range rng.Addrs() {
+				recorded[name][addr.String()] = true
+			}
+		}
+	}
+
+	acquired := map[string]map[string]string{}
+	for name, ns := range namespaces {
+		acquired[name], err = r.r.ipamAcquiredIPs(ctx, ns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	diff := &IPDiff{}
+	for _, ip := range ips {
+		name := namespace[ip.NetworkID]
+		recorded[name][ip.IPAddress] = true
+
+		prefix, ok := acquired[name][ip.IPAddress]
+		if metal.IsHostPrefix(ip.IPAddress) {
+			prefix, ok, err = r.ipamParentPrefix(ctx, namespaces[name], ip.IPAddress)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case !ok:
+			diff.OnlyInDatastore = append(diff.OnlyInDatastore, ip)
+		case prefix != ip.ParentPrefixCidr:
+			diff.PrefixMismatch = append(diff.PrefixMismatch, IPPrefixMismatch{IP: ip, IPAMParentPrefixCidr: prefix})
+		}
+	}
+
+	for name, ipamIPs := range acquired {
+		for ip, prefix := range ipamIPs {
+			if recorded[name][ip] {
+				continue
+			}
+			// excluded ips are held in ipam by the random allocation of ips, ranges are not enumerated as they can be arbitrary large
+			if slices.ContainsFunc(nws, func(nw *metal.Network) bool { return nw.IsExcludedIP(ip) }) {
+				continue
+			}
+			diff.OnlyInIPAM = append(diff.OnlyInIPAM, IPAMAllocation{IP: ip, ParentPrefixCidr: prefix, Namespace: name})
+		}
+	}
+	slices.SortFunc(diff.OnlyInIPAM, func(a, b IPAMAllocation) int {
+		if c := strings.Compare(a.IP, b.IP); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Namespace, b.Namespace)
+	})
+
+	return diff, nil
+}
+
+// NetworkPrefixDrift summarizes the ips of a network whose parent prefix is not one of the network's prefixes anymore.
+type NetworkPrefixDrift struct {
+	NetworkID string
+	// Total is the number of ips of the network.
+	Total int
+	// Drifted is the number of ips whose parent prefix does not match any prefix of the network.
+	Drifted int
+	// StalePrefixes are the distinct parent prefixes of the drifted ips.
+	StalePrefixes []string
+}
+
+// PrefixDrift reports per network how many of its ips were allocated in a prefix which the network does not have anymore,
+// e.g. after the prefixes of a network were reconfigured. Networks without drift are omitted, the network with the
+// most drifted ips comes first. Ips of networks which do not exist anymore are drifted as a whole.
+func (r *ipRepository) PrefixDrift(ctx context.Context) ([]NetworkPrefixDrift, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reporting prefix drift is only possible unscoped"))
+	}
+
+	nws, err := r.r.ds.Network().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := map[string]map[string]bool{}
+	for _, nw := range nws {
+		prefixes[nw.ID] = map[string]bool{}
+		for _, prefix := range nw.Prefixes {
+			pfx, err := netip.ParsePrefix(prefix.String())
+			if err != nil {
+				continue
+			}
+			prefixes[nw.ID][pfx.Masked().String()] = true
+		}
+	}
+
+	drifts := map[string]*NetworkPrefixDrift{}
+	err = r.r.ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		drift, ok := drifts[ip.NetworkID]
+		if !ok {
+			drift = &NetworkPrefixDrift{NetworkID: ip.NetworkID}
+			drifts[ip.NetworkID] = drift
+		}
+		drift.Total++
+
+		parent := ip.ParentPrefixCidr
+		if pfx, err := netip.ParsePrefix(parent); err == nil {
+			parent = pfx.Masked().String()
+		}
+		if prefixes[ip.NetworkID][parent] {
+			return nil
+		}
+
+		drift.Drifted++
+		if !slices.Contains(drift.StalePrefixes, ip.ParentPrefixCidr) {
+			drift.StalePrefixes = append(drift.StalePrefixes, ip.ParentPrefixCidr)
+		}
+		return nil
+	}, r.queries(nil)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []NetworkPrefixDrift
+	for _, drift := range drifts {
+		if drift.Drifted == 0 {
+			continue
+		}
+		slices.Sort(drift.StalePrefixes)
+		res = append(res, *drift)
+	}
+	slices.SortFunc(res, func(a, b NetworkPrefixDrift) int {
+		if a.Drifted != b.Drifted {
+			return b.Drifted - a.Drifted
+		}
+		return strings.Compare(a.NetworkID, b.NetworkID)
+	})
+
+	return res, nil
+}
+
+// Issues reports inconsistencies of all ips in scope, nothing gets fixed.
+// Unscoped, the differences between the datastore and ipam are reported as well as networks
+// whose addressfamilies do not match their prefixes, as ips can not be allocated reliably in them.
+func (r *ipRepository) Issues(ctx context.Context) ([]IPIssue, error) {
+	var q *apiv2.IPQuery
+	if r.scope != nil {
+		q = &apiv2.IPQuery{Project: &r.scope.projectID}
+	}
+
+	ips, err := r.List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		issues []IPIssue
+		now    = time.Now()
+	)
+	for _, ip := range ips {
+		err := validate.ValidateIPTypeAndTags(ip.Type, ip.Tags)
+		if err != nil {
+			issues = append(issues, newIPIssue(ip, IPIssueInvalidTags, err.Error(), "update the tags of the ip to match its type"))
+		}
+		err = validate.ValidateTagIntegrity(ip.Tags)
+		if err != nil {
+			issues = append(issues, newIPIssue(ip, IPIssueTagIntegrity, err.Error(), "repair the tags of the ip"))
+		}
+		err = validate.ValidateIPLease(ip.Tags, now)
+		if err != nil {
+			issues = append(issues, newIPIssue(ip, IPIssueLeaseExpired, err.Error(), "release the ip or renew its lease"))
+		}
+		err = validate.ValidateIPInParentPrefix(ip.IPAddress, ip.ParentPrefixCidr)
+		if err != nil {
+			issues = append(issues, newIPIssue(ip, IPIssueOutsideParentPrefix, err.Error(), "record the ip with the prefix containing it or release it"))
+		}
+	}
+
+	if r.scope != nil {
+		return issues, nil
+	}
+
+	diff, err := r.Diff(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nws, err := r.r.ds.Network().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	networkOfPrefix := map[string]*metal.Network{}
+	for _, nw := range nws {
+		for _, prefix := range nw.Prefixes {
+			networkOfPrefix[prefix.String()] = nw
+		}
+	}
+
+	for _, ip := range diff.OnlyInDatastore {
+		issues = append(issues, newIPIssue(ip, IPIssueNotInIPAM, "ip is not allocated in ipam", "acquire the ip in ipam again or release it"))
+	}
+	for _, allocation := range diff.OnlyInIPAM {
+		ip := &metal.IP{IPAddress: allocation.IP, ParentPrefixCidr: allocation.ParentPrefixCidr}
+		if nw, ok := networkOfPrefix[allocation.ParentPrefixCidr]; ok {
+			ip.NetworkID = nw.ID
+		}
+		issues = append(issues, newIPIssue(ip, IPIssueOnlyInIPAM,
+			"ip is allocated in ipam but not recorded in the datastore",
+			fmt.Sprintf("release the ip in ipam from prefix:%s or import it", allocation.ParentPrefixCidr),
+		))
+	}
+	for _, mismatch := range diff.PrefixMismatch {
+		issues = append(issues, newIPIssue(mismatch.IP, IPIssuePrefixMismatch,
+			fmt.Sprintf("ip is allocated in ipam in prefix:%s but recorded with prefix:%s", mismatch.IPAMParentPrefixCidr, mismatch.IP.ParentPrefixCidr),
+			fmt.Sprintf("record the ip with prefix:%s or release it in ipam from prefix:%s", mismatch.IPAMParentPrefixCidr, mismatch.IPAMParentPrefixCidr),
+		))
+	}
+
+	for _, nw := range nws {
+		err := validate.ValidateNetworkAddressFamilies(nw)
+		if err != nil {
+			issues = append(issues, newIPIssue(&metal.IP{NetworkID: nw.ID, ProjectID: nw.ProjectID}, IPIssueNetworkAddressFamilies,
+				err.Error(), "update the addressfamilies of the network to match its prefixes",
+			))
+		}
+	}
+
+	return issues, nil
+}
+
+func (r *ipRepository) Find(ctx context.Context, rq *apiv2.IPQuery) (*metal.IP, error) {
+	ip, err := r.r.ds.IP().Find(ctx, r.queries(rq)...)
+	if err != nil {
+		return nil, err
+	}
+	r.expand(ip)
+
+	return ip, nil
+}
+
+func (r *ipRepository) List(ctx context.Context, rq *apiv2.IPQuery) ([]*metal.IP, error) {
+	ip, err := r.r.ds.IP().List(ctx, r.queries(rq)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ip {
+		r.expand(i)
+	}
+
+	return ip, nil
+}
+
+// ListByUUIDs returns the ips with one of the given allocation uuids across all projects, unknown uuids are ignored.
+func (r *ipRepository) ListByUUIDs(ctx context.Context, uuids []string) ([]*metal.IP, error) {
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+
+	qs := append(r.queries(nil), queries.IpAllocationUUIDs(uuids))
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ip, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ip, nil
+}
+
+// NetworkIPCount is the number of ips a project has allocated in a network.
+type NetworkIPCount struct {
+	NetworkID string
+	Count     int
+}
+
+// ListNetworks returns the distinct networks the given project has ips in, together with the number of ips, ordered by network id.
+func (r *ipRepository) ListNetworks(ctx context.Context, project string) ([]NetworkIPCount, error) {
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	counts, err := r.r.ds.IP().CountBy(ctx, "networkid", qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []NetworkIPCount
+	for nw, count := range counts {
+		res = append(res, NetworkIPCount{NetworkID: nw, Count: count})
+	}
+	slices.SortFunc(res, func(a, b NetworkIPCount) int {
+		return strings.Compare(a.NetworkID, b.NetworkID)
+	})
+
+	return res, nil
+}
+
+// NetworkIPTypeCount is the number of ephemeral and static ips a project has allocated in a network.
+type NetworkIPTypeCount struct {
+	NetworkID string
+	Ephemeral int
+	Static    int
+}
+
+// CountByNetworkAndType returns the number of ephemeral and static ips of the given project per network, ordered by network id.
+// The ips are counted by the datastore in a single query, e.g. for an overview of all networks of a project.
+func (r *ipRepository) CountByNetworkAndType(ctx context.Context, project string) ([]NetworkIPTypeCount, error) {
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	counts, err := r.r.ds.IP().CountByFields(ctx, []string{"networkid", "type"}, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	byNetwork := map[string]*NetworkIPTypeCount{}
+	for _, c := range counts {
+		networkID, ipType := c.Values[0], metal.IPType(c.Values[1])
+		count, ok := byNetwork[networkID]
+		if !ok {
+			count = &NetworkIPTypeCount{NetworkID: networkID}
+			byNetwork[networkID] = count
+		}
+		switch ipType {
+		case metal.Ephemeral:
+			count.Ephemeral += c.Count
+		case metal.Static:
+			count.Static += c.Count
+		}
+	}
+
+	res := make([]NetworkIPTypeCount, 0, len(byNetwork))
+	for _, count := range byNetwork {
+		res = append(res, *count)
+	}
+	slices.SortFunc(res, func(a, b NetworkIPTypeCount) int {
+		return strings.Compare(a.NetworkID, b.NetworkID)
+	})
+
+	return res, nil
+}
+
+// TagValueCount is the number of ips which carry a tag with the value.
+type TagValueCount struct {
+	Value string
+	Count int
+}
+
+// TagKeyUsage is the number of ips which carry a tag with the key, together with the most frequent values of it.
+type TagKeyUsage struct {
+	Key       string
+	Count     int
+	TopValues []TagValueCount
+}
+
+// TagUsage returns the distinct tag keys in use by the ips of the given project, the most frequent key first.
+// Every key comes with at most topValues of its most frequent values, a topValues of zero returns all values.
+// Tags without a value are counted with an empty value.
+func (r *ipRepository) TagUsage(ctx context.Context, project string, topValues int) ([]TagKeyUsage, error) {
+	if topValues < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("number of top values must not be negative"))
+	}
+
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	var (
+		keys   = map[string]int{}
+		values = map[string]map[string]int{}
+	)
+	err := r.r.ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		// an ip counts only once per key and value, even if it carries a tag twice
+		for key, value := range tag.NewTagMap(ip.Tags) {
+			keys[key]++
+			if values[key] == nil {
+				values[key] = map[string]int{}
+			}
+			values[key][value]++
+		}
+		return nil
+	}, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []TagKeyUsage
+	for key, count := range keys {
+		usage := TagKeyUsage{Key: key, Count: count}
+		for value, count := range values[key] {
+			usage.TopValues = append(usage.TopValues, TagValueCount{Value: value, Count: count})
+		}
+		slices.SortFunc(usage.TopValues, func(a, b TagValueCount) int {
+			if a.Count != b.Count {
+				return b.Count - a.Count
+			}
+			return strings.Compare(a.Value, b.Value)
+		})
+		if topValues > 0 && len(usage.TopValues) > topValues {
+			usage.TopValues = usage.TopValues[:topValues]
+		}
+		res = append(res, usage)
+	}
+	slices.SortFunc(res, func(a, b TagKeyUsage) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return res, nil
+}
+
+// IPAgeBucket is the number of ips which were created at least Min and less than Max ago, a Max of zero is unbounded.
+type IPAgeBucket struct {
+	Name  string
+	Min   time.Duration
+	Max   time.Duration
+	Count int
+}
+
+// ipAgeBuckets are the buckets of the age report, ordered by age.
+var ipAgeBuckets = []IPAgeBucket{
+	{Name: "<1h", Min: 0, Max: time.Hour},
+	{Name: "1h-1d", Min: time.Hour, Max: 24 * time.Hour},
+	{Name: "1d-30d", Min: 24 * time.Hour, Max: 30 * 24 * time.Hour},
+	{Name: ">30d", Min: 30 * 24 * time.Hour},
+}
+
+// AllocationLatencies returns the p50, p95 and p99 latencies of the recent allocations of ips in ipam.
+// Only successful allocations are recorded, the latencies are kept in memory of this instance and are shared by all scopes.
+func (r *ipRepository) AllocationLatencies() AllocationLatencies {
+	return r.r.allocationLatencies.snapshot()
+}
+
+// AgeReport returns the number of ips of the given project per age bucket, the youngest bucket first.
+// The age of an ip is the time since it was created, every bucket is returned even if it is empty.
+func (r *ipRepository) AgeReport(ctx context.Context, project string) ([]IPAgeBucket, error) {
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	var (
+		buckets = slices.Clone(ipAgeBuckets)
+		now     = time.Now()
+	)
+	err := r.r.ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		age := now.Sub(ip.Created)
+		for i, b := range buckets {
+			if age >= b.Min && (b.Max == 0 || age < b.Max) {
+				buckets[i].Count++
+				break
+			}
+		}
+		return nil
+	}, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// ListByParentPrefixFamily returns the ips matching the query whose parent prefix is of the given address family.
+func (r *ipRepository) ListByParentPrefixFamily(ctx context.Context, rq *apiv2.IPQuery, af apiv2.IPAddressFamily) ([]*metal.IP, error) {
+	ip, err := r.r.ds.IP().List(ctx, append(r.queries(rq), queries.IpParentPrefixFamily(af))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ip, nil
+}
+
+// ListInExhaustedPrefixes returns the ips matching the query whose parent prefix has no free ips left in ipam, e.g. to plan the expansion of networks.
+// The utilization of every prefix is only looked up once per call.
+func (r *ipRepository) ListInExhaustedPrefixes(ctx context.Context, rq *apiv2.IPQuery) ([]*metal.IP, error) {
+	ips, err := r.List(ctx, rq)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		exhausted = map[string]bool{}
+		res       []*metal.IP
+	)
+	for _, ip := range ips {
+		if ip.ParentPrefixCidr == "" {
+			continue
+		}
+
+		// the same prefix may exist in several ipam namespaces
+		key := ip.NetworkID + "/" + ip.ParentPrefixCidr
+		full, ok := exhausted[key]
+		if !ok {
+			namespace, err := r.r.ipamNamespaceOfNetwork(ctx, ip.NetworkID)
+			if err != nil {
+				return nil, err
+			}
+			free, err := r.freePrefixIPs(ctx, namespace, ip.ParentPrefixCidr)
+			if err != nil {
+				return nil, err
+			}
+			full = free == 0
+			exhausted[key] = full
+		}
+
+		if full {
+			res = append(res, ip)
+		}
+	}
+
+	return res, nil
+}
+
+// ListInNetworks returns the ips matching the query which belong to one of the given networks, e.g. to show the ips of several networks at once.
+// The network of the query is applied as well, no networks do not restrict the result.
+func (r *ipRepository) ListInNetworks(ctx context.Context, rq *apiv2.IPQuery, networks []string) ([]*metal.IP, error) {
+	qs := r.queries(rq)
+	if len(networks) > 0 {
+		qs = append(qs, queries.IpNetworks(networks))
+	}
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// ListBlank returns the ips matching the query with an empty name if name is set or with an empty description if description is set,
+// e.g. to find ips which still have to be documented.
+func (r *ipRepository) ListBlank(ctx context.Context, rq *apiv2.IPQuery, name, description bool) ([]*metal.IP, error) {
+	if !name && !description {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at least one of name and description must be requested"))
+	}
+
+	qs := append(r.queries(rq), queries.IpBlank(name, description))
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// ListByOwner returns the ips matching the query which were created for the given owner, e.g. machine:<machine id>.
+func (r *ipRepository) ListByOwner(ctx context.Context, rq *apiv2.IPQuery, owner string) ([]*metal.IP, error) {
+	if owner == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("owner must be given"))
+	}
+
+	qs := append(r.queries(rq), queries.IpOwner(owner))
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// ListOldestEphemeral returns at most limit ephemeral ips of the network, oldest first, e.g. for a reclaim job when the network nears exhaustion.
+// Ips which are bound to a machine are skipped if withoutMachine is set, a limit of zero returns all ephemeral ips.
+func (r *ipRepository) ListOldestEphemeral(ctx context.Context, networkID string, withoutMachine bool, limit int) ([]*metal.IP, error) {
+	if limit < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("limit must not be negative"))
+	}
+
+	qs := r.queries(nil)
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+	// ordering must be the last query, filters would not keep it otherwise
+	qs = append(qs, queries.IpOldestEphemeral(networkID, withoutMachine, limit))
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// ListUnboundStatic returns the static ips of the project which are not bound to a machine, oldest first, e.g. as candidates for a cleanup review.
+func (r *ipRepository) ListUnboundStatic(ctx context.Context, project string) ([]*metal.IP, error) {
+	if project == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("project should not be empty"))
+	}
+
+	qs := r.queries(&apiv2.IPQuery{Project: &project})
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+	// ordering must be the last query, filters would not keep it otherwise
+	qs = append(qs, queries.IpStaticWithoutMachine())
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// Iterate calls fn for every ip matching the query, the ips are not held in memory all at once.
+func (r *ipRepository) Iterate(ctx context.Context, rq *apiv2.IPQuery, fn func(*metal.IP) error) error {
+	return r.r.ds.IP().Iterate(ctx, fn, r.queries(rq)...)
+}
+
+// ExportCSV writes the ips matching the query as csv to w, starting with a header row. Machine ips are not exported.
+// The rows are written while the ips are read from the datastore, so large projects do not have to fit into memory.
+func (r *ipRepository) ExportCSV(ctx context.Context, rq *apiv2.IPQuery, w io.Writer) error {
+	qs := r.queries(rq)
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+
+	cw := csv.NewWriter(w)
+
+	err := cw.Write([]string{"address", "name", "type", "network", "tags", "created"})
+	if err != nil {
+		return err
+	}
+
+	err = r.r.ds.IP().Iterate(ctx, func(ip *metal.IP) error {
+		tm := tag.NewTagMap(ip.Tags)
+		if _, ok := tm.Value(tag.MachineID); ok {
+			return nil
+		}
+
+		return cw.Write([]string{
+			ip.IPAddress,
+			ip.Name,
+			string(ip.Type),
+			ip.NetworkID,
+			strings.Join(ip.Tags, ","),
+			ip.Created.UTC().Format(time.RFC3339),
+		})
+	}, qs...)
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// PrefixRange returns the network address, the usable range and the broadcast address of a prefix,
+// which is either given directly or is the parent prefix of the ip with the given address.
+func (r *ipRepository) PrefixRange(ctx context.Context, ipOrPrefix string) (*metal.PrefixRange, error) {
+	prefix, err := netip.ParsePrefix(ipOrPrefix)
+	if err != nil {
+		ip, err := r.Get(ctx, ipOrPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, err = netip.ParsePrefix(ip.ParentPrefixCidr)
+		if err != nil {
+			return nil, fmt.Errorf("ip:%s has a malformed parent prefix: %w", ip.IPAddress, err)
+		}
+	}
+
+	pr := metal.NewPrefixRange(prefix)
+	return &pr, nil
+}
+
+// ListChangedSince returns the ips which were changed after the given watermark, oldest change first.
+// The returned watermark is the change timestamp of the latest returned ip, or the given one if nothing changed,
+// and is meant to be passed to the next call.
+func (r *ipRepository) ListChangedSince(ctx context.Context, rq *apiv2.IPQuery, since time.Time) ([]*metal.IP, time.Time, error) {
+	qs := r.queries(rq)
+	if r.scope != nil {
+		qs = append(qs, queries.IpProjectScoped(r.scope.projectID))
+	}
+	// ordering must be the last query, filters would not keep it otherwise
+	qs = append(qs, queries.IpChangedSince(since))
+
+	ips, err := r.r.ds.IP().List(ctx, qs...)
+	if err != nil {
+		return nil, since, err
+	}
+
+	watermark := since
+	if len(ips) > 0 {
+		watermark = ips[len(ips)-1].Changed
+	}
+
+	return ips, watermark, nil
+}
+
+func (r *ipRepository) queries(rq *apiv2.IPQuery) []generic.EntityQuery {
+	var qs []generic.EntityQuery
+	if rq != nil {
+		qs = append(qs, queries.IpFilter(rq))
+	}
+	return qs
+}
+
+// SpecificIPAvailability describes whether a specific ip could be allocated in a network.
+type SpecificIPAvailability struct {
+	IP          string
+	Allocatable bool
+	Reason      string
+}
+
+// CheckSpecificIPs reports for every given ip whether it could be allocated in the given network.
+// An ip is taken if it is either stored in the datastore or acquired in ipam.
+// Nothing gets allocated, the result is only valid at the time of the check.
+func (r *ipRepository) CheckSpecificIPs(ctx context.Context, nw *metal.Network, specificIPs []string) ([]SpecificIPAvailability, error) {
+	var (
+		result      []SpecificIPAvailability
+		ipamIPs     map[string]string
+		ipamFetched bool
+	)
+
+	for _, specificIP := range specificIPs {
+		availability := SpecificIPAvailability{IP: specificIP}
+
+		parsedIP, err := netip.ParseAddr(specificIP)
+		if err != nil {
+			availability.Reason = fmt.Sprintf("unable to parse specific ip: %s", err)
+			result = append(result, availability)
+			continue
+		}
+
+		pfx, ok := containingPrefix(nw, parsedIP)
+		if !ok {
+			availability.Reason = "specific ip not contained in any of the defined prefixes"
+			result = append(result, availability)
+			continue
+		}
+
+		if isReservedAddress(pfx, parsedIP) {
+			availability.Reason = fmt.Sprintf("specific ip is reserved in prefix:%s", pfx.String())
+			result = append(result, availability)
+			continue
+		}
+
+		if nw.IsReservedIP(parsedIP.String()) {
+			availability.Reason = fmt.Sprintf("ip is reserved in network:%s", nw.ID)
+			result = append(result, availability)
+			continue
+		}
+
+		if nw.IsGatewayIP(parsedIP.String()) {
+			availability.Reason = fmt.Sprintf("ip is reserved as gateway in network:%s", nw.ID)
+			result = append(result, availability)
+			continue
+		}
+
+		if nw.IsExcludedIP(parsedIP.String()) {
+			availability.Reason = fmt.Sprintf("ip is excluded in network:%s", nw.ID)
+			result = append(result, availability)
+			continue
+		}
+
+		_, err = r.r.ds.IP().Get(ctx, parsedIP.String())
+		if err == nil {
+			availability.Reason = "ip already allocated"
+			result = append(result, availability)
+			continue
+		}
+		if !generic.IsNotFound(err) {
+			return nil, err
+		}
+
+		if !ipamFetched {
+			ipamIPs, err = r.r.ipamAcquiredIPs(ctx, r.r.ipamNamespace(nw))
+			if err != nil {
+				return nil, err
+			}
+			ipamFetched = true
+		}
+		if _, ok := ipamIPs[parsedIP.String()]; ok {
+			availability.Reason = "ip already allocated in ipam"
+			result = append(result, availability)
+			continue
+		}
+
+		availability.Allocatable = true
+		result = append(result, availability)
+	}
+
+	return result, nil
+}
+
+// IPSuggestion is a free address of a network which is suggested for a specific ip.
+// It is not reserved, another allocation might take it before it is requested.
+type IPSuggestion struct {
+	IP               string
+	ParentPrefixCidr string
+}
+
+// SuggestIP returns the lowest free address of the addressfamily in the network, e.g. to prefill the specific ip of a create request.
+// Nothing is acquired, the suggestion is only valid at the time of the call.
+func (r *ipRepository) SuggestIP(ctx context.Context, networkID string, af *metal.AddressFamily) (*IPSuggestion, error) {
+	nw, err := (&networkRepository{r: r.r, scope: r.scope}).getCached(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+	if af != nil && !slices.Contains(nw.Prefixes.AddressFamilies(), *af) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("there is no prefix for the given addressfamily:%s present in network:%s %s", *af, networkID, nw.Prefixes.AddressFamilies()))
+	}
+	addressfamily := randomAddressFamily(nw, af)
+
+	acquired, err := r.r.ipamAcquiredIPs(ctx, r.r.ipamNamespace(nw))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range nw.Prefixes.OfFamily(addressfamily) {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			continue
+		}
+
+		rng := metal.NewPrefixRange(pfx)
+		for addr := rng.FirstUsable; addr.IsValid() && addr.Compare(rng.LastUsable) <= 0; addr = addr.Next() {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if _, ok := acquired[addr.String()]; ok || nw.IsReservedIP(addr.String()) || nw.IsGatewayIP(addr.String()) || nw.IsExcludedIP(addr.String()) {
+				continue
+			}
+
+			// an ip which is only stored in the datastore can not be allocated either
+			_, err := r.r.ds.IP().Get(ctx, addr.String())
+			if err == nil {
+				continue
+			}
+			if !generic.IsNotFound(err) {
+				return nil, err
+			}
+
+			return &IPSuggestion{IP: addr.String(), ParentPrefixCidr: pfx.Masked().String()}, nil
+		}
+	}
+
+	return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("no free ip left in network:%s af:%s", nw.ID, addressfamily))
+}
+
+// ipamAcquiredIPs returns all ips which are acquired in ipam mapped to the prefix they are acquired in.
+// The addresses which are reserved by ipam, e.g. the network address, are not contained.
+func (r *Repostore) ipamAcquiredIPs(ctx context.Context, namespace *string) (map[string]string, error) {
+	resp, err := r.ipam.Dump(ctx, connect.NewRequest(&ipamapiv1.DumpRequest{Namespace: namespace}))
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []struct {
+		Cidr string          `json:"Cidr"`
+		IPs  map[string]bool `json:"IPs"`
+	}
+	err = json.Unmarshal([]byte(resp.Msg.Dump), &prefixes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ipam dump: %w", err)
+	}
+
+	acquired := map[string]string{}
+	for _, prefix := range prefixes {
+		pfx, err := netip.ParsePrefix(prefix.Cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse prefix of ipam dump: %w", err)
+		}
+		for ip := range prefix.IPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse ip of ipam dump: %w", err)
+			}
+			if isReservedAddress(pfx, addr) {
+				continue
+			}
+			acquired[addr.String()] = prefix.Cidr
+		}
+	}
+
+	return acquired, nil
+}
+
+// ipamParentPrefix returns the parent prefix of a child prefix acquired in ipam, it is not ok if the prefix is not acquired.
+func (r *ipRepository) ipamParentPrefix(ctx context.Context, namespace *string, cidr string) (string, bool, error) {
+	resp, err := r.r.ipam.GetPrefix(ctx, connect.NewRequest(&ipamapiv1.GetPrefixRequest{Cidr: cidr, Namespace: namespace}))
+	if connect.CodeOf(err) == connect.CodeNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return resp.Msg.Prefix.ParentCidr, true, nil
+}
+
+// containingPrefix returns the first prefix of the network which contains the given ip.
+func containingPrefix(nw *metal.Network, ip netip.Addr) (netip.Prefix, bool) {
+	af := metal.IPv4AddressFamily
+	if ip.Is6() {
+		af = metal.IPv6AddressFamily
+	}
+
+	for _, prefix := range nw.Prefixes.OfFamily(af) {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			continue
+		}
+		if pfx.Contains(ip) {
+			return pfx, true
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+// prefixesContain returns true if one of the prefixes contains the given ip.
+func prefixesContain(prefixes metal.Prefixes, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			continue
+		}
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedAddress returns true for addresses which are never handed out by ipam,
+// these are the network address, which is the subnet-router anycast address for ipv6, and, for ipv4, the broadcast address of the prefix.
+// A prefix of a single address has no reserved address.
+func isReservedAddress(pfx netip.Prefix, ip netip.Addr) bool {
+	if pfx.Bits() == pfx.Addr().BitLen() {
+		return false
+	}
+	pfx = pfx.Masked()
+	if ip == pfx.Addr() {
+		return true
+	}
+	if ip.Is4() && ip == lastAddress(pfx) {
+		return true
+	}
+	return false
+}
+
+// lastAddress returns the highest address of the given prefix.
+func lastAddress(pfx netip.Prefix) netip.Addr {
+	bytes := pfx.Masked().Addr().AsSlice()
+	for i := pfx.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+func (r *ipRepository) AllocateSpecificIP(ctx context.Context, parent *metal.Network, specificIP string) (ipAddress, parentPrefixCidr string, err error) {
+	parsedIP, err := netip.ParseAddr(specificIP)
+	if err != nil {
+		return "", "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse specific ip: %w", err))
+	}
+	if parent.IsReservedIP(parsedIP.String()) {
+		return "", "", connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip:%s is reserved in network:%s", parsedIP.String(), parent.ID))
+	}
+
+	prefix, err := r.FindContainingPrefix(parent, parsedIP)
+	if err != nil {
+		return "", "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("specific ip not contained in any of the defined prefixes"))
+	}
+	if pfx, err := netip.ParsePrefix(prefix.String()); err == nil && isReservedAddress(pfx, parsedIP) {
+		return "", "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s is reserved in prefix:%s", parsedIP.String(), pfx.String()))
+	}
+
+	resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: prefix.String(), Ip: &specificIP, Namespace: r.r.ipamNamespace(parent)}))
+	var connectErr *connect.Error
+	if errors.As(err, &connectErr) {
+		switch connectErr.Code() {
+		case connect.CodeAlreadyExists:
+			// concurrent requests for the same ip race on ipam, the losing one must not be reported as an internal error
+			return "", "", connect.NewError(connect.CodeAlreadyExists, generic.Conflict("ip already allocated"))
+		case connect.CodeInvalidArgument:
+			// ipam validates the ip on its own, a rejected ip is an error of the request
+			return "", "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s was rejected by ipam: %s", specificIP, connectErr.Message()))
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	acquired, err := acquiredIP(resp, prefix.String())
+	if err != nil {
+		return "", "", err
+	}
+
+	return acquired, prefix.String(), nil
+}
+
+// AllocateHostPrefix acquires a free /64 in one of the ipv6 prefixes of the network which are larger than a /64.
+func (r *ipRepository) AllocateHostPrefix(ctx context.Context, parent *metal.Network) (hostPrefix, parentPrefixCidr string, err error) {
+	var errs []error
+	for _, prefix := range parent.Prefixes.OfFamily(metal.IPv6AddressFamily) {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			return "", "", err
+		}
+		if pfx.Bits() >= hostPrefixLength {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+
+		resp, err := r.r.ipam.AcquireChildPrefix(ctx, connect.NewRequest(&ipamapiv1.AcquireChildPrefixRequest{Cidr: prefix.String(), Length: hostPrefixLength, Namespace: r.r.ipamNamespace(parent)}))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return resp.Msg.Prefix.Cidr, prefix.String(), nil
+	}
+
+	if len(errs) == 0 {
+		return "", "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("network:%s has no ipv6 prefix larger than /%d to allocate host prefixes from", parent.ID, hostPrefixLength))
+	}
+	return "", "", fmt.Errorf("cannot allocate a /%d in network:%s: %w", hostPrefixLength, parent.ID, errors.Join(errs...))
+}
+
+// AllocateTopDownIP allocates the highest free ip of the addressfamily in the network, the prefix with the highest addresses first.
+// ipam always hands out the lowest free ip of a prefix, so the usable addresses of a prefix with free ips are tried from its top downwards.
+func (r *ipRepository) AllocateTopDownIP(ctx context.Context, parent *metal.Network, af *metal.AddressFamily) (ipAddress, parentPrefixCidr string, err error) {
+	addressfamily := randomAddressFamily(parent, af)
+	namespace := r.r.ipamNamespace(parent)
+
+	var prefixes []netip.Prefix
+	for _, prefix := range parent.Prefixes.OfFamily(addressfamily) {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			return "", "", err
+		}
+		prefixes = append(prefixes, pfx.Masked())
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return metal.NewPrefixRange(b).LastUsable.Compare(metal.NewPrefixRange(a).LastUsable)
+	})
+
+	for _, pfx := range prefixes {
+		free, err := r.freePrefixIPs(ctx, namespace, pfx.String())
+		if err != nil {
+			return "", "", err
+		}
+		if free == 0 {
+			continue
+		}
+
+		rng := metal.NewPrefixRange(pfx)
+		for addr := rng.LastUsable; addr.IsValid() && rng.FirstUsable.Compare(addr) <= 0; addr = addr.Prev() {
+			if err := ctx.Err(); err != nil {
+				return "", "", err
+			}
+			if parent.IsReservedIP(addr.String()) || parent.IsGatewayIP(addr.String()) || parent.IsExcludedIP(addr.String()) {
+				continue
+			}
+
+			resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: pfx.String(), Ip: pointer.Pointer(addr.String()), Namespace: namespace}))
+			if connect.CodeOf(err) == connect.CodeAlreadyExists {
+				continue
+			}
+			if err != nil {
+				return "", "", err
+			}
+
+			acquired, err := acquiredIP(resp, pfx.String())
+			if err != nil {
+				return "", "", err
+			}
+			return acquired, pfx.String(), nil
+		}
+	}
+
+	return "", "", connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("cannot allocate top-down free ip in ipam, no ips left in network:%s af:%s", parent.ID, addressfamily))
+}
+
+// AllocateContiguousIPs acquires n consecutive addresses of the prefix in ipam, starting with the lowest free run.
+// Reserved, gateway and excluded addresses interrupt a run like allocated ones, a partially acquired run is released again.
+func (r *ipRepository) AllocateContiguousIPs(ctx context.Context, parent *metal.Network, pfx netip.Prefix, n int) ([]string, error) {
+	var (
+		namespace = r.r.ipamNamespace(parent)
+		rng       = metal.NewPrefixRange(pfx)
+		run       []string
+	)
+
+	release := func() {
+		for _, ip := range run {
+			r.releaseAcquired(ctx, namespace, IPAMAllocation{IP: ip, ParentPrefixCidr: pfx.String()})
+		}
+		run = nil
+	}
+
+	for addr := rng.FirstUsable; addr.IsValid() && addr.Compare(rng.LastUsable) <= 0; addr = addr.Next() {
+		if err := ctx.Err(); err != nil {
+			release()
+			return nil, err
+		}
+		if parent.IsReservedIP(addr.String()) || parent.IsGatewayIP(addr.String()) || parent.IsExcludedIP(addr.String()) {
+			release()
+			continue
+		}
+
+		resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: pfx.String(), Ip: pointer.Pointer(addr.String()), Namespace: namespace}))
+		if connect.CodeOf(err) == connect.CodeAlreadyExists {
+			release()
+			continue
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		acquired, err := acquiredIP(resp, pfx.String())
+		if err != nil {
+			release()
+			return nil, err
+		}
+		run = append(run, acquired)
+		if len(run) == n {
+			return run, nil
+		}
+	}
+
+	release()
+	return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("no contiguous block of %d free ips left in prefix:%s of network:%s", n, pfx.String(), parent.ID))
+}
+
+// acquiredIP returns the address of an ip acquired in ipam, a malformed response results in an internal error instead of a panic.
+func acquiredIP(resp *connect.Response[ipamapiv1.AcquireIPResponse], prefixCidr string) (string, error) {
+	if resp == nil || resp.Msg == nil || resp.Msg.Ip == nil || resp.Msg.Ip.Ip == "" {
+		return "", connect.NewError(connect.CodeInternal, fmt.Errorf("ipam returned no ip for prefix:%s", prefixCidr))
+	}
+	return resp.Msg.Ip.Ip, nil
+}
+
+// FindContainingPrefix returns the longest prefix of the network which contains the given ip, nothing is allocated.
+func (r *ipRepository) FindContainingPrefix(nw *metal.Network, addr netip.Addr) (*metal.Prefix, error) {
+	prefix, ok := r.r.prefixIndex(nw).Lookup(addr)
+	if !ok {
+		return nil, generic.NotFound("ip:%s is not contained in any prefix of network:%s", addr.String(), nw.ID)
+	}
+	return &prefix, nil
+}
+
+type cachedPrefixIndex struct {
+	prefixes metal.Prefixes
+	index    *metal.PrefixIndex
+}
+
+// prefixIndex returns the prefix index of the network, it is only built again if the prefixes of the network differ
+// from the ones the cached index was built of.
+func (r *Repostore) prefixIndex(nw *metal.Network) *metal.PrefixIndex {
+	if nw.ID == "" {
+		return metal.NewPrefixIndex(nw.Prefixes)
+	}
+
+	if cached, ok := r.prefixIndexes.Load(nw.ID); ok && slices.Equal(cached.(*cachedPrefixIndex).prefixes, nw.Prefixes) {
+		return cached.(*cachedPrefixIndex).index
+	}
+
+	index := metal.NewPrefixIndex(nw.Prefixes)
+	r.prefixIndexes.Store(nw.ID, &cachedPrefixIndex{prefixes: slices.Clone(nw.Prefixes), index: index})
+
+	return index
+}
+
+// requestedAddressFamily returns the addressfamily of the specific ip if it is given and valid, the addressfamily a random ip is allocated of otherwise.
+func requestedAddressFamily(parent *metal.Network, af *metal.AddressFamily, specificIP *string) metal.AddressFamily {
+	if specificIP != nil {
+		if addr, err := netip.ParseAddr(*specificIP); err == nil {
+			if addr.Is4() {
+				return metal.IPv4AddressFamily
+			}
+			return metal.IPv6AddressFamily
+		}
+	}
+	return randomAddressFamily(parent, af)
+}
+
+// checkAllowedAddressFamily returns an error if the project is restricted to other addressfamilies.
+func checkAllowedAddressFamily(p *mdcv1.Project, af metal.AddressFamily) error {
+	allowed := putil.AllowedAddressFamilies(p)
+	if len(allowed) == 0 {
+		return nil
+	}
+	if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, string(af)) }) {
+		return fmt.Errorf("project:%s is not allowed to allocate ips of addressfamily:%s, allowed are %s", p.Meta.Id, af, allowed)
+	}
+	return nil
+}
+
+// randomAddressFamily returns the addressfamily a random ip is allocated of if the given addressfamily is nil.
+func randomAddressFamily(parent *metal.Network, af *metal.AddressFamily) metal.AddressFamily {
+	if af != nil {
+		return *af
+	}
+	if len(parent.Prefixes.AddressFamilies()) == 1 {
+		return parent.Prefixes.AddressFamilies()[0]
+	}
+	return metal.IPv4AddressFamily
+}
+
+func (r *ipRepository) AllocateRandomIP(ctx context.Context, parent *metal.Network, af *metal.AddressFamily) (ipAddress, parentPrefixCidr string, err error) {
+	addressfamily := randomAddressFamily(parent, af)
+	namespace := r.r.ipamNamespace(parent)
+
+	prefixes := parent.Prefixes.OfFamily(addressfamily)
+	if weights := parent.PrefixWeights(); len(weights) > 0 {
+		prefixes = prefixes.WeightedOrder(weights, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))) // nolint:gosec
+	}
+
+	var released []string
+	if parent.ReleasedIPReuse() != "" {
+		released, err = r.r.recentlyReleasedIPs(ctx, parent.ID)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if parent.ReleasedIPReuse() == metal.ReleasedIPReuseFirst {
+		for _, ip := range released {
+			if !prefixesContain(prefixes, ip) {
+				continue
+			}
+			ipAddress, parentPrefixCidr, err := r.AllocateSpecificIP(ctx, parent, ip)
+			if err != nil {
+				r.r.log.Debug("recently released ip can not be reused", "ip", ip, "network", parent.ID, "error", err)
+				continue
+			}
+			return ipAddress, parentPrefixCidr, nil
+		}
+	}
+
+	// with ReleasedIPReuseLast recently released ips are held back until no other ip is left
+	var heldBack []IPAMAllocation
+	defer func() {
+		for _, held := range heldBack {
+			if held.IP == ipAddress {
+				continue
+			}
+			r.releaseAcquired(ctx, namespace, held)
+		}
+	}()
+
+	// with many full prefixes the latency of an allocation is bounded by the number of prefixes which are tried
+	tried := prefixes
+	if limit := r.r.maxPrefixAttempts; limit > 0 && len(tried) > limit {
+		tried = tried[:limit]
+	}
+
+	for _, prefix := range tried {
+		for {
+			resp, err := r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: prefix.String(), Namespace: namespace}))
+			if err != nil {
+				var connectErr *connect.Error
+				if errors.As(err, &connectErr) {
+					if connectErr.Code() == connect.CodeNotFound {
+						break
+					}
+				}
+				return "", "", err
+			}
+
+			acquired, err := acquiredIP(resp, prefix.String())
+			if err != nil {
+				return "", "", err
+			}
+
+			// reserved ips are held in ipam, this only happens if the reservation was not acquired in ipam for some reason.
+			// the ip is kept acquired so it is not handed out again.
+			if parent.IsReservedIP(acquired) {
+				r.r.log.Warn("reserved ip was not held in ipam, keeping it acquired", "ip", acquired, "network", parent.ID)
+				continue
+			}
+			// gateways are held in ipam the same way once they were handed out by ipam
+			if parent.IsGatewayIP(acquired) {
+				r.r.log.Info("gateway ip is skipped, keeping it acquired", "ip", acquired, "network", parent.ID)
+				continue
+			}
+			if parent.IsExcludedIP(acquired) {
+				r.r.log.Info("excluded ip is skipped, keeping it acquired", "ip", acquired, "network", parent.ID)
+				continue
+			}
+
+			if parent.ReleasedIPReuse() == metal.ReleasedIPReuseLast && slices.Contains(released, acquired) {
+				heldBack = append(heldBack, IPAMAllocation{IP: acquired, ParentPrefixCidr: prefix.String()})
+				continue
+			}
+
+			return acquired, prefix.String(), nil
+		}
+	}
+
+	if len(heldBack) > 0 {
+		// released is ordered by the latest release first
+		longestReleased := slices.MaxFunc(heldBack, func(a, b IPAMAllocation) int {
+			return slices.Index(released, a.IP) - slices.Index(released, b.IP)
+		})
+		return longestReleased.IP, longestReleased.ParentPrefixCidr, nil
+	}
+
+	if len(tried) < len(prefixes) {
+		return "", "", connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("cannot allocate random free ip in ipam, gave up after %d of %d prefixes in network:%s af:%s, tried prefixes: %s", len(tried), len(prefixes), parent.ID, addressfamily, r.prefixUsageSummary(ctx, namespace, tried)))
+	}
+	return "", "", connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("cannot allocate random free ip in ipam, no ips left in network:%s af:%s parent afs:%#v, tried prefixes: %s", parent.ID, addressfamily, parent.Prefixes.AddressFamilies(), r.prefixUsageSummary(ctx, namespace, prefixes)))
+}
+
+// prefixUsageSummary describes the utilization of the given prefixes, which shows operators whether a prefix must be added to a network.
+func (r *ipRepository) prefixUsageSummary(ctx context.Context, namespace *string, prefixes metal.Prefixes) string {
+	if len(prefixes) == 0 {
+		return "none"
+	}
+
+	var summary []string
+	for _, prefix := range prefixes {
+		usage, err := r.r.ipam.PrefixUsage(ctx, connect.NewRequest(&ipamapiv1.PrefixUsageRequest{Cidr: prefix.String(), Namespace: namespace}))
+		if err != nil {
+			summary = append(summary, fmt.Sprintf("%s (usage unknown: %s)", prefix.String(), err))
+			continue
+		}
+		summary = append(summary, fmt.Sprintf("%s (%d/%d ips acquired)", prefix.String(), usage.Msg.AcquiredIps, usage.Msg.AvailableIps))
+	}
+
+	return strings.Join(summary, ", ")
+}
+
+// PrefixUtilizationWarning returns a warning if the utilization of the parent prefix of the ip reached the configured threshold, empty otherwise.
+// It is meant to be called after an allocation to let clients surface capacity concerns before the prefix is exhausted.
+func (r *ipRepository) PrefixUtilizationWarning(ctx context.Context, ip *metal.IP) (string, error) {
+	if r.r.prefixWarningThreshold <= 0 || ip.ParentPrefixCidr == "" {
+		return "", nil
+	}
+
+	namespace, err := r.r.ipamNamespaceOfNetwork(ctx, ip.NetworkID)
+	if err != nil {
+		return "", err
+	}
+	usage, err := r.r.ipam.PrefixUsage(ctx, connect.NewRequest(&ipamapiv1.PrefixUsageRequest{Cidr: ip.ParentPrefixCidr, Namespace: namespace}))
+	if err != nil {
+		return "", err
+	}
+	if usage.Msg.AvailableIps == 0 {
+		return "", nil
+	}
+
+	utilization := float64(usage.Msg.AcquiredIps) / float64(usage.Msg.AvailableIps) * 100
+	if utilization < float64(r.r.prefixWarningThreshold) {
+		return "", nil
+	}
+
+	return fmt.Sprintf("prefix:%s of network:%s is %.0f%% utilized (%d/%d ips acquired), consider adding a prefix to the network",
+		ip.ParentPrefixCidr, ip.NetworkID, utilization, usage.Msg.AcquiredIps, usage.Msg.AvailableIps), nil
+}
+
+// ReserveIP reserves the given ip in the network, it is never allocated afterwards.
+// The ip is acquired in ipam to prevent it from being handed out, hence it must not be allocated already.
+func (r *ipRepository) ReserveIP(ctx context.Context, networkID, ipAddress string) (*metal.Network, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reserving ips is only possible unscoped"))
+	}
+
+	old, err := r.r.ds.Network().Get(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedIP, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip: %w", err))
+	}
+	err = checkReservable(old, parsedIP)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddress, parentPrefixCidr, err := r.AllocateSpecificIP(ctx, old, parsedIP.String())
+	if err != nil {
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("ip:%s is already allocated in network:%s", parsedIP.String(), networkID))
+		}
+		return nil, err
+	}
+
+	new := *old
+	new.ReservedIPs = append(slices.Clone(old.ReservedIPs), ipAddress)
+
+	err = r.r.ds.Network().Update(ctx, &new, old)
+	r.r.invalidateNetwork(networkID)
+	if err != nil {
+		_, releaseErr := r.r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: parentPrefixCidr, Ip: ipAddress, Namespace: r.r.ipamNamespace(old)}))
+		if releaseErr != nil {
+			r.r.log.Error("unable to release ip of failed reservation in ipam", "ip", ipAddress, "prefix", parentPrefixCidr, "error", releaseErr)
+		}
+		return nil, err
+	}
+
+	r.r.log.Info("reserved ip", "ip", ipAddress, "network", networkID)
+
+	return &new, nil
+}
+
+// checkReservable returns an error if the ip can not be reserved in the network.
+func checkReservable(nw *metal.Network, ip netip.Addr) error {
+	if slices.Contains(nw.ReservedIPs, ip.String()) {
+		return connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("ip:%s is already reserved in network:%s", ip.String(), nw.ID))
+	}
+	if reservation, ok := nw.OverlappingReservation(metal.ReservedRange{First: ip, Last: ip}); ok {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s overlaps with the reservation %s in network:%s", ip.String(), reservation, nw.ID))
+	}
+	pfx, ok := containingPrefix(nw, ip)
+	if !ok {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s is not contained in any of the prefixes of network:%s", ip.String(), nw.ID))
+	}
+	if isReservedAddress(pfx, ip) {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s is never allocated in prefix:%s", ip.String(), pfx.String()))
+	}
+	return nil
+}
+
+// ReserveAndClaim reserves the ip of the create request in its network and creates it for the project of the request at once.
+// The ip is acquired in ipam first, which is the only point of synchronization, so no other caller can reserve or allocate it in between.
+// If the reservation can not be recorded, the created ip is removed again. The ip stays reserved after it was released until it is unreserved.
+func (r *ipRepository) ReserveAndClaim(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reserving ips is only possible unscoped"))
+	}
+	if req.Ip == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("the ip to reserve must be given"))
+	}
+
+	old, err := r.r.ds.Network().Get(ctx, req.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedIP, err := netip.ParseAddr(*req.Ip)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip: %w", err))
+	}
+	err = checkReservable(old, parsedIP)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := r.create(ctx, req, allocateRandom)
+	if err != nil {
+		return nil, err
+	}
+
+	new := *old
+	new.ReservedIPs = append(slices.Clone(old.ReservedIPs), ip.IPAddress)
+
+	err = r.r.ds.Network().Update(ctx, &new, old)
+	r.r.invalidateNetwork(old.ID)
+	if err != nil {
+		r.rollbackClaim(ctx, r.r.ipamNamespace(old), ip)
+		return nil, err
+	}
+
+	r.r.log.Info("reserved and claimed ip", "ip", ip.IPAddress, "network", old.ID, "project", ip.ProjectID)
+
+	return ip, nil
+}
+
+// rollbackClaim removes an ip whose reservation could not be recorded, errors are only logged.
+func (r *ipRepository) rollbackClaim(ctx context.Context, namespace *string, ip *metal.IP) {
+	err := r.r.ds.IP().Delete(context.WithoutCancel(ctx), ip)
+	if err != nil {
+		r.r.log.Error("unable to roll back claimed ip", "ip", ip.IPAddress, "error", err)
+		return
+	}
+	r.releaseAcquired(ctx, namespace, IPAMAllocation{IP: ip.IPAddress, ParentPrefixCidr: ip.ParentPrefixCidr})
+	r.r.publishIPEvent(ctx, IPEventDeleted, ip)
+}
+
+// maxReservedRangeSize is the maximum number of ips of a reserved range, every ip is acquired in ipam on its own.
+const maxReservedRangeSize = 256
+
+// ReserveRange reserves all ips from first to last in the network, they are never allocated afterwards.
+// The range must lie within one prefix of the network and must not overlap with any existing reservation,
+// every ip of the range is acquired in ipam and must not be allocated already.
+func (r *ipRepository) ReserveRange(ctx context.Context, networkID, first, last string) (*metal.Network, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reserving ips is only possible unscoped"))
+	}
+
+	old, err := r.r.ds.Network().Get(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	rng, err := metal.ParseReservedRange(first + "-" + last)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if reservation, ok := old.OverlappingReservation(rng); ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("range:%s overlaps with the reservation %s in network:%s", rng.String(), reservation, networkID))
+	}
+	pfx, ok := containingPrefix(old, rng.First)
+	if !ok || !pfx.Contains(rng.Last) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("range:%s is not contained in one of the prefixes of network:%s", rng.String(), networkID))
+	}
+
+	if rng.Exceeds(maxReservedRangeSize) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("range:%s contains more than %d ips", rng.String(), maxReservedRangeSize))
+	}
+	addrs := rng.Addrs()
+	for _, addr := range addrs {
+		if isReservedAddress(pfx, addr) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s of range:%s is never allocated in prefix:%s", addr.String(), rng.String(), pfx.String()))
+		}
+	}
+
+	var acquired []string
+	release := func() {
+		for _, ip := range acquired {
+			_, err := r.r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: pfx.String(), Ip: ip, Namespace: r.r.ipamNamespace(old)}))
+			if err != nil {
+				r.r.log.Error("unable to release ip of failed range reservation in ipam", "ip", ip, "prefix", pfx.String(), "error", err)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		ipAddress, _, err := r.AllocateSpecificIP(ctx, old, addr.String())
+		if err != nil {
+			release()
+			if generic.IsConflict(err) {
+				return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("ip:%s of range:%s is already allocated in network:%s", addr.String(), rng.String(), networkID))
+			}
+			return nil, err
+		}
+		acquired = append(acquired, ipAddress)
+	}
+
+	new := *old
+	new.ReservedIPs = append(slices.Clone(old.ReservedIPs), rng.String())
+
+	err = r.r.ds.Network().Update(ctx, &new, old)
+	r.r.invalidateNetwork(networkID)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	r.r.log.Info("reserved range", "range", rng.String(), "network", networkID)
+
+	return &new, nil
+}
+
+// UnreserveIP removes the reservation of the given ip in the network, it can be allocated again afterwards.
+// A reserved range is removed as a whole by passing it in the form "first-last".
+func (r *ipRepository) UnreserveIP(ctx context.Context, networkID, ipAddress string) (*metal.Network, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("unreserving ips is only possible unscoped"))
+	}
+
+	old, err := r.r.ds.Network().Get(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	rng, err := metal.ParseReservedRange(ipAddress)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip: %w", err))
+	}
+	if !slices.Contains(old.ReservedIPs, rng.String()) {
+		return nil, generic.NotFound("ip:%s is not reserved in network:%s", rng.String(), networkID)
+	}
+
+	new := *old
+	new.ReservedIPs = slices.DeleteFunc(slices.Clone(old.ReservedIPs), func(reserved string) bool {
+		return reserved == rng.String()
+	})
+
+	err = r.r.ds.Network().Update(ctx, &new, old)
+	r.r.invalidateNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	pfx, ok := containingPrefix(old, rng.First)
+	if ok {
+		for _, addr := range rng.Addrs() {
+			_, err = r.r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: pfx.String(), Ip: addr.String(), Namespace: r.r.ipamNamespace(old)}))
+			var connectErr *connect.Error
+			if errors.As(err, &connectErr) && connectErr.Code() == connect.CodeNotFound {
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r.r.log.Info("unreserved ip", "ip", rng.String(), "network", networkID)
+
+	return &new, nil
+}
+
+// ReleaseInIPAM releases the given ip of a prefix of the network in ipam without consulting or touching the datastore.
+// This is meant for allocations in ipam which were never recorded in the datastore.
+func (r *ipRepository) ReleaseInIPAM(ctx context.Context, networkID, ipAddress, parentPrefixCidr string) error {
+	if r.scope != nil {
+		return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("releasing ips in ipam directly is only possible unscoped"))
+	}
+
+	nw, err := r.r.ds.Network().Get(ctx, networkID)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(nw.Prefixes, func(p metal.Prefix) bool { return p.String() == parentPrefixCidr }) {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("prefix %s is not part of network:%s", parentPrefixCidr, networkID))
+	}
+
+	parsedIP, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip: %w", err))
+	}
+	pfx, err := netip.ParsePrefix(parentPrefixCidr)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse prefix: %w", err))
+	}
+	if !pfx.Contains(parsedIP) {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s is not contained in prefix:%s", ipAddress, parentPrefixCidr))
+	}
+
+	_, err = r.r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: parentPrefixCidr, Ip: ipAddress, Namespace: r.r.ipamNamespace(nw)}))
+	if err != nil {
+		var connectErr *connect.Error
+		if errors.As(err, &connectErr) && connectErr.Code() == connect.CodeNotFound {
+			return generic.NotFound("ip:%s in prefix:%s not found in ipam", ipAddress, parentPrefixCidr)
+		}
+		return err
+	}
+
+	r.r.log.Info("released ip in ipam", "ip", ipAddress, "prefix", parentPrefixCidr)
+
+	return nil
+}
+
+// ReleaseOrphaned releases the ips which are acquired in ipam within the prefixes of the networks but not recorded in the datastore,
+// e.g. left over by creates which failed after the allocation in ipam. With dryRun the orphaned ips are only returned.
+// An ip is looked up in the datastore again right before it is released, so the ip of a create which completed meanwhile is kept.
+// It returns the released ips, ips which could not be released are left for the next run.
+func (r *ipRepository) ReleaseOrphaned(ctx context.Context, dryRun bool) ([]IPAMAllocation, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("releasing orphaned ips in ipam is only possible unscoped"))
+	}
+
+	diff, err := r.Diff(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nws, err := r.r.ds.Network().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// prefixes are only managed within the ipam namespace of their network
+	managed := map[string]map[string]bool{}
+	for _, nw := range nws {
+		namespace := pointer.SafeDeref(r.r.ipamNamespace(nw))
+		if managed[namespace] == nil {
+			managed[namespace] = map[string]bool{}
+		}
+		for _, prefix := range nw.Prefixes {
+			managed[namespace][prefix.String()] = true
+		}
+	}
+
+	var (
+		released []IPAMAllocation
+		errs     []error
+	)
+	for _, orphan := range diff.OnlyInIPAM {
+		if !managed[orphan.Namespace][orphan.ParentPrefixCidr] {
+			continue
+		}
+		if dryRun {
+			released = append(released, orphan)
+			continue
+		}
+
+		_, err := r.r.ds.IP().Get(ctx, orphan.IP)
+		if err == nil {
+			continue
+		}
+		if !generic.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("unable to look up ip:%s: %w", orphan.IP, err))
+			continue
+		}
+
+		var namespace *string
+		if orphan.Namespace != "" {
+			namespace = &orphan.Namespace
+		}
+		err = r.r.releaseInIPAM(ctx, namespace, orphan.IP, orphan.ParentPrefixCidr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to release ip:%s in ipam: %w", orphan.IP, err))
+			continue
+		}
+
+		r.r.log.Info("released orphaned ip in ipam", "ip", orphan.IP, "prefix", orphan.ParentPrefixCidr)
+		released = append(released, orphan)
+	}
+
+	return released, errors.Join(errs...)
+}
+
+// Import stores a pre-existing allocation with the given address and parent prefix without acquiring it in ipam.
+// The request is validated like on create, the ip is flagged to need reconciliation and is acquired in ipam by ReconcileImported afterwards.
+func (r *ipRepository) Import(ctx context.Context, req *apiv2.IPServiceCreateRequest, parentPrefixCidr string) (*metal.IP, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("importing ips is only possible unscoped"))
+	}
+	if req.Ip == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip must be given for an import"))
+	}
+
+	prepared, err := r.prepare(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	nw := prepared.nw
+
+	parsedIP, err := netip.ParseAddr(*req.Ip)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip: %w", err))
+	}
+	pfx, err := netip.ParsePrefix(parentPrefixCidr)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse prefix: %w", err))
+	}
+	if !pfx.Contains(parsedIP) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip:%s is not contained in prefix:%s", *req.Ip, parentPrefixCidr))
+	}
+	if !slices.ContainsFunc(nw.Prefixes, func(p metal.Prefix) bool { return p.String() == pfx.String() }) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("prefix:%s does not belong to network:%s", parentPrefixCidr, nw.ID))
+	}
+
+	allocationUUID, err := uuid.NewV7()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	ip := &metal.IP{
+		AllocationUUID:      allocationUUID.String(),
+		IPAddress:           parsedIP.String(),
+		ParentPrefixCidr:    pfx.String(),
+		Name:                prepared.name,
+		Description:         prepared.description,
+		NetworkID:           nw.ID,
+		ProjectID:           prepared.projectID,
+		Type:                prepared.ipType,
+		Tags:                prepared.tags,
+		NeedsReconciliation: true,
+	}
+
+	resp, err := r.r.ds.IP().Create(ctx, ip)
+	if err != nil {
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, err
+	}
+
+	r.r.log.Info("imported ip, it needs to be reconciled with ipam", "ip", ip.IPAddress, "network", nw.ID)
+	r.r.publishIPEvent(ctx, IPEventCreated, resp)
+
+	return resp, nil
+}
+
+// ReconcileImported acquires all imported ips in ipam which were not acquired yet.
+// An ip which is already acquired in ipam is considered reconciled as the datastore holds at most one ip with this address.
+// It returns the reconciled ips, ips which could not be reconciled are left for the next reconciliation.
+func (r *ipRepository) ReconcileImported(ctx context.Context) ([]*metal.IP, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reconciling imported ips is only possible unscoped"))
+	}
+
+	ips, err := r.r.ds.IP().List(ctx, queries.IpNeedsReconciliation())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reconciled []*metal.IP
+		errs       []error
+	)
+	for _, old := range ips {
+		namespace, err := r.r.ipamNamespaceOfNetwork(ctx, old.NetworkID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to look up the network of ip:%s: %w", old.IPAddress, err))
+			continue
+		}
+
+		_, err = r.r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamapiv1.AcquireIPRequest{PrefixCidr: old.ParentPrefixCidr, Ip: &old.IPAddress, Namespace: namespace}))
+		var connectErr *connect.Error
+		if err != nil && (!errors.As(err, &connectErr) || connectErr.Code() != connect.CodeAlreadyExists) {
+			errs = append(errs, fmt.Errorf("unable to acquire ip:%s in ipam: %w", old.IPAddress, err))
+			continue
+		}
+
+		new := *old
+		new.NeedsReconciliation = false
+
+		err = r.r.ds.IP().Update(ctx, &new, old)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to mark ip:%s as reconciled: %w", old.IPAddress, err))
+			continue
+		}
+
+		reconciled = append(reconciled, &new)
+	}
+
+	return reconciled, errors.Join(errs...)
+}
+
+// Chargeable tells whether the ip is chargeable according to the configured rule, no ip is chargeable without a rule.
+// The api has no field for it yet, so it is not returned with the ip.
+func (r *ipRepository) Chargeable(ip *metal.IP) bool {
+	return r.r.chargeableRule.IsChargeable(ip)
+}
+
+func (r *ipRepository) ConvertToInternal(ip *apiv2.IP) (*metal.IP, error) {
+
+	panic("unimplemented")
+}
+func (r *ipRepository) ConvertToProto(metalIP *metal.IP) (*apiv2.IP, error) {
+	t := apiv2.IPType_IP_TYPE_UNSPECIFIED
+	switch metalIP.Type {
+	case metal.Ephemeral:
+		t = apiv2.IPType_IP_TYPE_EPHEMERAL
+	case metal.Static:
+		t = apiv2.IPType_IP_TYPE_STATIC
+	}
+
+	ip := &apiv2.IP{
+		Ip:          metalIP.IPAddress,
+		Uuid:        metalIP.AllocationUUID,
+		Name:        metalIP.Name,
+		Description: metalIP.Description,
+		Network:     metalIP.NetworkID,
+		Project:     metalIP.ProjectID,
+		Type:        t,
+		Tags:        metalIP.Tags,
+		CreatedAt:   timestamppb.New(metalIP.Created),
+		UpdatedAt:   timestamppb.New(metalIP.Changed),
+	}
+	// project scoped repositories serve the user api, internal tags are only shown to admins which use the unscoped repository
+	if r.scope != nil && slices.ContainsFunc(ip.Tags, isInternalTag) {
+		ip.Tags = slices.DeleteFunc(slices.Clone(ip.Tags), isInternalTag)
+	}
+	return ip, nil
+}
+
+// releaseAcquired releases an ip which was acquired in the ipam namespace but is not used, errors are only logged.
+func (r *ipRepository) releaseAcquired(ctx context.Context, namespace *string, acquired IPAMAllocation) {
+	// the allocation might have been canceled, the ip must be released nevertheless
+	err := r.r.releaseInIPAM(context.WithoutCancel(ctx), namespace, acquired.IP, acquired.ParentPrefixCidr)
+	if err != nil {
+		r.r.log.Error("unable to release unused ip in ipam", "ip", acquired.IP, "prefix", acquired.ParentPrefixCidr, "error", err)
+	}
+}
+
+// releasedIPRetention is the duration a released ip is considered as recently released.
+const releasedIPRetention = 24 * time.Hour
+
+func releasedIPsKey(networkID string) string {
+	return "released-ips:" + networkID
+}
+
+// recordReleasedIP remembers the given ip as recently released in its network.
+func (r *Repostore) recordReleasedIP(ctx context.Context, ip *metal.IP) error {
+	now := time.Now()
+	key := releasedIPsKey(ip.NetworkID)
+
+	err := r.redis.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: ip.IPAddress}).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.redis.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-releasedIPRetention).UnixMilli(), 10)).Err()
+}
+
+// recentlyReleasedIPs returns the ips which were released in the network within the retention, the latest released first.
+func (r *Repostore) recentlyReleasedIPs(ctx context.Context, networkID string) ([]string, error) {
+	return r.redis.ZRevRangeByScore(ctx, releasedIPsKey(networkID), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Add(-releasedIPRetention).UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+// IPEventType is the kind of change of an ip.
+type IPEventType string
+
+const (
+	IPEventCreated IPEventType = "created"
+	IPEventUpdated IPEventType = "updated"
+	IPEventDeleted IPEventType = "deleted"
+)
+
+// IPEvent is a change of an ip, watching can be resumed after an event with its revision.
+type IPEvent struct {
+	Revision string
+	Type     IPEventType
+	IP       *metal.IP
+}
+
+const (
+	// ipEventsKey is the redis stream of ip events, the stream ids are the revisions of the events.
+	ipEventsKey = "metal:ip-events"
+	// ipEventsMaxLen bounds the stream, a watch can not be resumed without missing events from a revision which is trimmed already.
+	ipEventsMaxLen = 10000
+	// ipEventsBlock is the time a watch waits for new events before it checks whether it was canceled.
+	ipEventsBlock = time.Second
+)
+
+// publishIPEvent emits a change of an ip to all watchers, errors are only logged as the change already happened.
+func (r *Repostore) publishIPEvent(ctx context.Context, eventType IPEventType, ip *metal.IP) {
+	data, err := json.Marshal(ip)
+	if err != nil {
+		r.log.Error("unable to marshal ip event", "ip", ip.IPAddress, "type", eventType, "error", err)
+		return
+	}
+
+	err = r.redis.XAdd(context.WithoutCancel(ctx), &redis.XAddArgs{
+		Stream: ipEventsKey,
+		MaxLen: ipEventsMaxLen,
+		Approx: true,
+		Values: map[string]any{"type": string(eventType), "project": ip.ProjectID, "ip": string(data)},
+	}).Err()
+	if err != nil {
+		r.log.Error("unable to publish ip event", "ip", ip.IPAddress, "type", eventType, "error", err)
+	}
+}
+
+// Watch calls fn for every change of an ip after the given revision until the context is canceled or fn returns an error.
+// Without a revision only the changes after the start of the watch are emitted.
+func (r *ipRepository) Watch(ctx context.Context, revision string, fn func(IPEvent) error) error {
+	if revision == "" {
+		latest, err := r.r.redis.XRevRangeN(ctx, ipEventsKey, "+", "-", 1).Result()
+		if err != nil {
+			return err
+		}
+		revision = "0-0"
+		if len(latest) > 0 {
+			revision = latest[0].ID
+		}
+	}
+
+	for {
+		streams, err := r.r.redis.XRead(ctx, &redis.XReadArgs{Streams: []string{ipEventsKey, revision}, Block: ipEventsBlock}).Result()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				revision = msg.ID
+
+				if r.scope != nil && msg.Values["project"] != r.scope.projectID {
+					continue
+				}
+
+				data, _ := msg.Values["ip"].(string)
+				ip := &metal.IP{}
+				err := json.Unmarshal([]byte(data), ip)
+				if err != nil {
+					return fmt.Errorf("malformed ip event %s: %w", msg.ID, err)
+				}
+				eventType, _ := msg.Values["type"].(string)
+
+				err = fn(IPEvent{Revision: msg.ID, Type: IPEventType(eventType), IP: ip})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (r *Repostore) IpDeleteAction(ctx context.Context, job tx.Job) error {
+	metalIP, err := r.ds.IP().Find(ctx, queries.IpFilter(&apiv2.IPQuery{Uuid: &job.ID}))
+	if err != nil && !generic.IsNotFound(err) {
+		return err
+	}
+	if metalIP == nil {
+		r.log.Info("ds find, metalip is nil", "job", job)
+
+		return nil
+	}
+	r.log.Info("ds find", "metalip", metalIP)
+
+	namespace, err := r.ipamNamespaceOfNetwork(ctx, metalIP.NetworkID)
+	if err == nil {
+		err = r.releaseInIPAM(ctx, namespace, metalIP.IPAddress, metalIP.ParentPrefixCidr)
+	}
+	if err != nil {
+		r.log.Error("ipam release", "error", err)
 		var connectErr *connect.Error
-		errors.As(err, &connectErr)
-		if connectErr.Code() != connect.CodeNotFound {
+		if !errors.As(err, &connectErr) || connectErr.Code() != connect.CodeNotFound {
+			r.recordFailedIPRelease(ctx, job, metalIP, err)
 			return err
 		}
+	} else if metalIP.NetworkID != "" {
+		err = r.recordReleasedIP(ctx, metalIP)
+		if err != nil {
+			r.log.Error("unable to record released ip", "ip", metalIP.IPAddress, "network", metalIP.NetworkID, "error", err)
+		}
 	}
 
 	err = r.ds.IP().Delete(ctx, metalIP)
 	if err != nil && !generic.IsNotFound(err) {
 		r.log.Error("ds delete", "error", err)
+		r.recordFailedIPRelease(ctx, job, metalIP, err)
 		return err
 	}
 
+	r.publishIPEvent(ctx, IPEventDeleted, metalIP)
+
 	return nil
 }
+
+// releaseInIPAM releases the ip in the ipam namespace, a host prefix is released as child prefix of its parent prefix.
+func (r *Repostore) releaseInIPAM(ctx context.Context, namespace *string, ip, parentPrefixCidr string) error {
+	if metal.IsHostPrefix(ip) {
+		_, err := r.ipam.ReleaseChildPrefix(ctx, connect.NewRequest(&ipamapiv1.ReleaseChildPrefixRequest{Cidr: ip, Namespace: namespace}))
+		return err
+	}
+	_, err := r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamapiv1.ReleaseIPRequest{PrefixCidr: parentPrefixCidr, Ip: ip, Namespace: namespace}))
+	return err
+}
+
+// failedIPReleasesKey is the redis hash of failed ip releases by allocation uuid.
+const failedIPReleasesKey = "metal:tx:failed-ip-releases"
+
+// FailedIPRelease is a release of an ip which failed either in ipam or in the datastore.
+// The ip delete transactions are not retried by the queue, so they are kept until they are retried explicitly.
+type FailedIPRelease struct {
+	AllocationUUID   string    `json:"allocation_uuid"`
+	IP               string    `json:"ip"`
+	ParentPrefixCidr string    `json:"parent_prefix_cidr"`
+	Error            string    `json:"error"`
+	Failed           time.Time `json:"failed"`
+}
+
+// recordFailedIPRelease stores the failed release, errors are only logged as the release already failed.
+func (r *Repostore) recordFailedIPRelease(ctx context.Context, job tx.Job, ip *metal.IP, cause error) {
+	failed, err := json.Marshal(FailedIPRelease{
+		AllocationUUID:   job.ID,
+		IP:               ip.IPAddress,
+		ParentPrefixCidr: ip.ParentPrefixCidr,
+		Error:            cause.Error(),
+		Failed:           time.Now(),
+	})
+	if err == nil {
+		err = r.redis.HSet(ctx, failedIPReleasesKey, job.ID, failed).Err()
+	}
+	if err != nil {
+		r.log.Error("unable to record failed ip release", "ip", ip.IPAddress, "error", err)
+	}
+}
+
+// FailedReleases returns the ip releases which failed and were not retried successfully yet, ordered by ip.
+func (r *ipRepository) FailedReleases(ctx context.Context) ([]FailedIPRelease, error) {
+	if r.scope != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("listing failed ip releases is only possible unscoped"))
+	}
+
+	values, err := r.r.redis.HGetAll(ctx, failedIPReleasesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []FailedIPRelease
+	for _, value := range values {
+		var failed FailedIPRelease
+		err := json.Unmarshal([]byte(value), &failed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse failed ip release: %w", err)
+		}
+		res = append(res, failed)
+	}
+	slices.SortFunc(res, func(a, b FailedIPRelease) int {
+		return strings.Compare(a.IP, b.IP)
+	})
+
+	return res, nil
+}
+
+// RetryFailedReleases runs all failed ip releases again and returns the ones which still fail.
+func (r *ipRepository) RetryFailedReleases(ctx context.Context) ([]FailedIPRelease, error) {
+	failed, err := r.FailedReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, release := range failed {
+		err := r.r.IpDeleteAction(ctx, tx.Job{ID: release.AllocationUUID, Action: tx.ActionIpDelete})
+		if err != nil {
+			r.r.log.Error("retry of failed ip release failed again", "ip", release.IP, "error", err)
+			continue
+		}
+
+		err = r.r.redis.HDel(ctx, failedIPReleasesKey, release.AllocationUUID).Err()
+		if err != nil {
+			return nil, err
+		}
+		r.r.log.Info("retried failed ip release", "ip", release.IP)
+	}
+
+	return r.FailedReleases(ctx)
+}
@@ -0,0 +1,4633 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/db/repository"
+	"github.com/metal-stack/api-server/pkg/db/validate"
+	putil "github.com/metal-stack/api-server/pkg/project"
+	"github.com/metal-stack/api-server/pkg/test"
+	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	mdmv1 "github.com/metal-stack/masterdata-api/api/v1"
+	mdmock "github.com/metal-stack/masterdata-api/api/v1/mocks"
+	mdm "github.com/metal-stack/masterdata-api/pkg/client"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	testifymock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+func TestIpGetOfAnotherProject(t *testing.T) {
+	ctx := context.Background()
+	logs := &lockedBuffer{}
+	log := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{log: log})
+	defer cleanup()
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p2"})
+	require.NoError(t, err)
+
+	logs.Reset()
+	_, notFoundErr := repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.5")
+	require.True(t, generic.IsNotFound(notFoundErr))
+	notFoundLogs := logs.String()
+
+	logs.Reset()
+	_, forbiddenErr := repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(forbiddenErr))
+	forbiddenLogs := logs.String()
+
+	// clients can not tell the difference
+	assert.Equal(t, strings.ReplaceAll(notFoundErr.Error(), "1.2.3.5", "1.2.3.4"), forbiddenErr.Error())
+	assert.NotContains(t, forbiddenErr.Error(), "p2")
+
+	// admins can
+	assert.Contains(t, notFoundLogs, `"msg":"ip not found"`)
+	assert.NotContains(t, notFoundLogs, "another project")
+	assert.Contains(t, forbiddenLogs, `"msg":"ip belongs to another project, responding with not found"`)
+	assert.Contains(t, forbiddenLogs, `"project":"p2"`)
+}
+
+// lockedBuffer is a bytes.Buffer which can be written to by concurrent loggers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestIpCheckSpecificIPs(t *testing.T) {
+	ctx := context.Background()
+	repo, _, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	nw, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/64"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")})
+	require.NoError(t, err)
+	// an allocation which only exists in ipam
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.6")}))
+	require.NoError(t, err)
+
+	got, err := repo.IP(pointer.Pointer("p1")).CheckSpecificIPs(ctx, nw, []string{"1.2.0.4", "1.2.0.5", "1.2.0.6", "1.3.0.1", "1.2.0.255", "2001:db8::5", "no-ip"})
+	require.NoError(t, err)
+
+	want := []repository.SpecificIPAvailability{
+		{IP: "1.2.0.4", Allocatable: true},
+		{IP: "1.2.0.5", Reason: "ip already allocated"},
+		{IP: "1.2.0.6", Reason: "ip already allocated in ipam"},
+		{IP: "1.3.0.1", Reason: "specific ip not contained in any of the defined prefixes"},
+		{IP: "1.2.0.255", Reason: "specific ip is reserved in prefix:1.2.0.0/24"},
+		{IP: "2001:db8::5", Allocatable: true},
+		{IP: "no-ip", Reason: `unable to parse specific ip: ParseAddr("no-ip"): unable to parse IP`},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CheckSpecificIPs() diff = %s", diff)
+	}
+
+	// nothing must have been allocated by the check
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.4")})
+	require.NoError(t, err)
+}
+
+func TestIpCreatePreferred(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		preferred        []string
+		fallbackToRandom bool
+		want             string
+		wantCode         connect.Code
+	}{
+		{
+			name:      "first preference is free",
+			preferred: []string{"1.2.0.20", "1.2.0.21"},
+			want:      "1.2.0.20",
+		},
+		{
+			name:      "later preference is free",
+			preferred: []string{"1.2.0.10", "1.2.0.20", "1.2.0.21"},
+			want:      "1.2.0.21",
+		},
+		{
+			name:             "all preferences taken, fallback to random",
+			preferred:        []string{"1.2.0.10", "1.2.0.20", "1.2.0.21"},
+			fallbackToRandom: true,
+			want:             "1.2.0.1",
+		},
+		{
+			name:      "all preferences taken without fallback",
+			preferred: []string{"1.2.0.10", "1.2.0.20", "1.2.0.21"},
+			wantCode:  connect.CodeAlreadyExists,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.IP(pointer.Pointer("p1")).CreatePreferred(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"}, tt.preferred, tt.fallbackToRandom)
+			if tt.wantCode != 0 {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.IPAddress)
+		})
+	}
+}
+
+func TestIpCreateInReadOnlyNetwork(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+
+	old, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	readOnly := *old
+	readOnly.Labels = map[string]string{metal.NetworkLabelReadOnly: "true"}
+	require.NoError(t, ds.Network().Update(ctx, &readOnly, old))
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	got, err := repo.IP(pointer.Pointer("p1")).Get(ctx, ip.IPAddress)
+	require.NoError(t, err)
+	assert.Equal(t, ip.IPAddress, got.IPAddress)
+
+	ips, err := repo.IP(pointer.Pointer("p1")).List(ctx, &apiv2.IPQuery{Network: pointer.Pointer("internet")})
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: ip.IPAddress, Project: "p1", Name: pointer.Pointer("still operable")})
+	require.NoError(t, err)
+}
+
+func TestIpCreateInSingleHostPrefix(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("host-v4"), Prefixes: []string{"1.2.3.4/32"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("host-v6"), Prefixes: []string{"2001:db8::1/128"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		network string
+		ip      string
+		random  bool
+	}{
+		{name: "random ipv4", network: "host-v4", ip: "1.2.3.4", random: true},
+		{name: "random ipv6", network: "host-v6", ip: "2001:db8::1", random: true},
+		{name: "specific ipv4", network: "host-v4", ip: "1.2.3.4"},
+		{name: "specific ipv6", network: "host-v6", ip: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &apiv2.IPServiceCreateRequest{Network: tt.network, Project: "p1"}
+			if !tt.random {
+				req.Ip = pointer.Pointer(tt.ip)
+			}
+
+			// the only address of the prefix is free
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.ip, ip.IPAddress)
+
+			// the only address of the prefix is occupied, a retried specific create of the same project returns it
+			retried, err := repo.IP(pointer.Pointer("p1")).Create(ctx, req)
+			if tt.random {
+				require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+				assert.ErrorContains(t, err, "no ips left in network:"+tt.network)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, ip.AllocationUUID, retried.AllocationUUID)
+			}
+
+			_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+			require.NoError(t, err)
+			require.Eventually(t, func() bool {
+				_, err := ds.IP().Get(ctx, ip.IPAddress)
+				return generic.IsNotFound(err)
+			}, 10*time.Second, 50*time.Millisecond)
+		})
+	}
+}
+
+func TestIpCreateSpecificSubnetRouterAnycast(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"2001:db8::/64"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("2001:db8::")})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "ip:2001:db8:: is reserved in prefix:2001:db8::/64")
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("2001:db8::1")})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip.IPAddress)
+}
+
+func TestIpCreateInNetworkPendingDeletion(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+
+	old, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	deleting := *old
+	deleting.Labels = map[string]string{metal.NetworkLabelPendingDeletion: "true"}
+	require.NoError(t, ds.Network().Update(ctx, &deleting, old))
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "network:internet is pending deletion")
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	ips, err := repo.IP(pointer.Pointer("p1")).List(ctx, &apiv2.IPQuery{Network: pointer.Pointer("internet")})
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, ip.IPAddress, ips[0].IPAddress)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+	require.NoError(t, err)
+}
+
+func TestIpCreateWithWeightedPrefixes(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("internet"),
+		Prefixes: []string{"1.2.0.0/24", "1.2.1.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelPrefixWeights: "1.2.0.0/24=1,1.2.1.0/24=9"},
+	})
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for range 200 {
+		ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+		counts[ip.ParentPrefixCidr]++
+	}
+
+	// expected are 180 vs. 20 allocations
+	assert.Greater(t, counts["1.2.1.0/24"], 150)
+	assert.Less(t, counts["1.2.0.0/24"], 50)
+}
+
+func TestIpReassignProject(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "1.2.3.7", ProjectID: "p3", Type: metal.Static},
+		{IPAddress: "1.2.3.8", ProjectID: "p1", Type: metal.Static, Transfer: &metal.IPTransfer{SourceProjectID: "p1", TargetProjectID: "p3"}},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	_, err := repo.IP(nil).ReassignProject(ctx, "p1", "p-unknown")
+	require.Error(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).ReassignProject(ctx, "p1", "p2")
+	require.Error(t, err)
+
+	moved, err := repo.IP(nil).ReassignProject(ctx, "p1", "p2")
+	require.NoError(t, err)
+	require.Len(t, moved, 3)
+
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"} {
+		_, err := repo.IP(pointer.Pointer("p1")).Get(ctx, ip)
+		require.True(t, generic.IsNotFound(err))
+
+		got, err := repo.IP(pointer.Pointer("p2")).Get(ctx, ip)
+		require.NoError(t, err)
+		assert.Equal(t, "p2", got.ProjectID)
+	}
+
+	got, err := repo.IP(pointer.Pointer("p3")).Get(ctx, "1.2.3.7")
+	require.NoError(t, err)
+	assert.Equal(t, "p3", got.ProjectID)
+
+	// an ip with a pending transfer stays in the source project
+	got, err = repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.8")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", got.ProjectID)
+	require.NotNil(t, got.Transfer)
+}
+
+func TestIpTransfer(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"), testProject("p3"))
+	defer cleanup()
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static})
+	require.NoError(t, err)
+
+	_, err = repo.IP(nil).InitiateTransfer(ctx, "1.2.3.4", "p2", "alice")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, "1.2.3.4", "p1", "alice")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, "1.2.3.4", "p-unknown", "alice")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p2")).InitiateTransfer(ctx, "1.2.3.4", "p3", "mallory")
+	require.True(t, generic.IsNotFound(err), "only the project of the ip may initiate a transfer")
+
+	// without a pending transfer the ip can not be accepted
+	_, err = repo.IP(pointer.Pointer("p2")).AcceptTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+
+	initiated, err := repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, "1.2.3.4", "p2", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", initiated.ProjectID)
+	require.NotNil(t, initiated.Transfer)
+	assert.Equal(t, "p1", initiated.Transfer.SourceProjectID)
+	assert.Equal(t, "p2", initiated.Transfer.TargetProjectID)
+	assert.Equal(t, "alice", initiated.Transfer.InitiatedBy)
+
+	// until the transfer is accepted the ip can not be used by the target project
+	_, err = repo.IP(pointer.Pointer("p2")).Get(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+	_, err = repo.IP(pointer.Pointer("p2")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: "1.2.3.4", Project: "p2", Name: pointer.Pointer("taken")})
+	require.True(t, generic.IsNotFound(err))
+	// and it can only be accepted by the target project
+	_, err = repo.IP(pointer.Pointer("p3")).AcceptTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+	_, err = repo.IP(nil).AcceptTransfer(ctx, "1.2.3.4")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	accepted, err := repo.IP(pointer.Pointer("p2")).AcceptTransfer(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, "p2", accepted.ProjectID)
+	assert.Nil(t, accepted.Transfer)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+	got, err := repo.IP(pointer.Pointer("p2")).Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Nil(t, got.Transfer)
+
+	// an accepted transfer can not be accepted again
+	_, err = repo.IP(pointer.Pointer("p2")).AcceptTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+}
+
+func TestIpTransferCanceled(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).CancelTransfer(ctx, "1.2.3.4")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	_, err = repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, "1.2.3.4", "p2", "alice")
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p2")).CancelTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err), "only the project of the ip may cancel a transfer")
+
+	canceled, err := repo.IP(pointer.Pointer("p1")).CancelTransfer(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Nil(t, canceled.Transfer)
+
+	_, err = repo.IP(pointer.Pointer("p2")).AcceptTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+	got, err := repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", got.ProjectID)
+}
+
+func TestIpTransferWithdrawn(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		ip       string
+		withdraw func(ip string) (*metal.IP, error)
+	}{
+		{
+			name: "rejected by the target project",
+			ip:   "1.2.3.4",
+			withdraw: func(ip string) (*metal.IP, error) {
+				return repo.IP(pointer.Pointer("p2")).RejectTransfer(ctx, ip)
+			},
+		},
+		{
+			name: "canceled by the source project",
+			ip:   "1.2.3.5",
+			withdraw: func(ip string) (*metal.IP, error) {
+				return repo.IP(pointer.Pointer("p1")).CancelTransfer(ctx, ip)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: tt.ip, ProjectID: "p1", Type: metal.Static})
+			require.NoError(t, err)
+			_, err = repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, tt.ip, "p2", "alice")
+			require.NoError(t, err)
+
+			withdrawn, err := tt.withdraw(tt.ip)
+			require.NoError(t, err)
+			assert.Nil(t, withdrawn.Transfer)
+			assert.Equal(t, "p1", withdrawn.ProjectID)
+
+			// a withdrawn transfer can neither be accepted nor rejected anymore
+			_, err = repo.IP(pointer.Pointer("p2")).AcceptTransfer(ctx, tt.ip)
+			require.True(t, generic.IsNotFound(err))
+			_, err = repo.IP(pointer.Pointer("p2")).RejectTransfer(ctx, tt.ip)
+			require.True(t, generic.IsNotFound(err))
+
+			got, err := repo.IP(pointer.Pointer("p1")).Get(ctx, tt.ip)
+			require.NoError(t, err)
+			assert.Nil(t, got.Transfer)
+		})
+	}
+}
+
+func TestIpRejectTransfer(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static})
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).InitiateTransfer(ctx, "1.2.3.4", "p2", "alice")
+	require.NoError(t, err)
+
+	_, err = repo.IP(nil).RejectTransfer(ctx, "1.2.3.4")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p1")).RejectTransfer(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err), "only the target project may reject a transfer")
+	_, err = repo.IP(pointer.Pointer("p2")).RejectTransfer(ctx, "1.2.3.9")
+	require.True(t, generic.IsNotFound(err))
+}
+
+func TestIpReassignProjectRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the request is cancelled when the update fails, the rollback must be done nevertheless
+	executor := &failingExecutor{failOnReplace: 3, onFailure: cancel}
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{executor: executor}, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	ips := []string{"1.2.3.4", "1.2.3.5", "1.2.3.6", "1.2.3.7"}
+	for _, ip := range ips {
+		_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: ip, ProjectID: "p1", Type: metal.Static})
+		require.NoError(t, err)
+	}
+
+	_, err := repo.IP(nil).ReassignProject(ctx, "p1", "p2")
+	require.Error(t, err)
+	require.Greater(t, executor.replaces, 3, "moved ips must have been rolled back")
+
+	for _, ip := range ips {
+		got, err := repo.IP(nil).Get(context.Background(), ip)
+		require.NoError(t, err)
+		assert.Equal(t, "p1", got.ProjectID, "ip %s was not rolled back", ip)
+	}
+}
+
+// failingExecutor fails the n-th replace query, which is what an update of an entity is executed with,
+// or the n-th delete query.
+type failingExecutor struct {
+	*r.Session
+	failOnReplace int
+	replaces      int
+	failOnDelete  int
+	deletes       int
+	// onFailure is called when a query is failed
+	onFailure func()
+}
+
+func (f *failingExecutor) Query(ctx context.Context, q r.Query) (*r.Cursor, error) {
+	if q.Term != nil && strings.Contains(q.Term.String(), ".Replace(") {
+		f.replaces++
+		if f.replaces == f.failOnReplace {
+			f.fail()
+			return nil, fmt.Errorf("replace number %d failed", f.replaces)
+		}
+	}
+	if q.Term != nil && strings.Contains(q.Term.String(), ".Delete(") {
+		f.deletes++
+		if f.deletes == f.failOnDelete {
+			f.fail()
+			return nil, fmt.Errorf("delete number %d failed", f.deletes)
+		}
+	}
+	return f.Session.Query(ctx, q)
+}
+
+func (f *failingExecutor) fail() {
+	if f.onFailure != nil {
+		f.onFailure()
+	}
+}
+
+func TestIpIssues(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Ephemeral, Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Type: metal.Static, Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw2")}},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", Type: metal.Static, Tags: []string{tag.New(tag.MachineID, "m1")}},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	issues, err := repo.IP(pointer.Pointer("p1")).Issues(ctx)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "1.2.3.5", issues[0].IP.IPAddress)
+	assert.Equal(t, "1.2.3.5", issues[0].Address)
+	assert.Equal(t, "p1", issues[0].Project)
+	assert.Equal(t, repository.IPIssueInvalidTags, issues[0].Problem)
+	assert.Equal(t, "ip with tag firewall.metal-stack.io/ephemeral-ip must be of type ephemeral but is static", issues[0].Description)
+	assert.NotEmpty(t, issues[0].Remediation)
+}
+
+func TestIpIssuesOutsideParentPrefix(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ParentPrefixCidr: "1.2.3.0/24", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "1.2.4.4", ParentPrefixCidr: "1.2.3.0/24", ProjectID: "p1", Type: metal.Static},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	issues, err := repo.IP(pointer.Pointer("p1")).Issues(ctx)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "1.2.4.4", issues[0].Address)
+	assert.Equal(t, repository.IPIssueOutsideParentPrefix, issues[0].Problem)
+	assert.Equal(t, "ip address 1.2.4.4 is not contained in its parent prefix 1.2.3.0/24", issues[0].Description)
+}
+
+func TestIpDiff(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "1.2.1.0/24"}})
+	require.NoError(t, err)
+
+	// consistent
+	consistent, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+	// only in datastore
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.0.50", ParentPrefixCidr: "1.2.0.0/24", ProjectID: "p1"})
+	require.NoError(t, err)
+	// only in ipam
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.60")}))
+	require.NoError(t, err)
+	// prefix mismatch
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.1.0/24", Ip: pointer.Pointer("1.2.1.70")}))
+	require.NoError(t, err)
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.1.70", ParentPrefixCidr: "1.2.0.0/24", ProjectID: "p1"})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Diff(ctx)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+
+	require.Len(t, diff.OnlyInDatastore, 1)
+	assert.Equal(t, "1.2.0.50", diff.OnlyInDatastore[0].IPAddress)
+	assert.Equal(t, []repository.IPAMAllocation{{IP: "1.2.0.60", ParentPrefixCidr: "1.2.0.0/24"}}, diff.OnlyInIPAM)
+	require.Len(t, diff.PrefixMismatch, 1)
+	assert.Equal(t, "1.2.1.70", diff.PrefixMismatch[0].IP.IPAddress)
+	assert.Equal(t, "1.2.1.0/24", diff.PrefixMismatch[0].IPAMParentPrefixCidr)
+
+	issues, err := repo.IP(nil).Issues(ctx)
+	require.NoError(t, err)
+	var descriptions []string
+	for _, issue := range issues {
+		require.NotEqual(t, consistent.IPAddress, issue.IP.IPAddress)
+		descriptions = append(descriptions, issue.IP.IPAddress+": "+issue.Description)
+	}
+	assert.ElementsMatch(t, []string{
+		"1.2.0.50: ip is not allocated in ipam",
+		"1.2.0.60: ip is allocated in ipam but not recorded in the datastore",
+		"1.2.1.70: ip is allocated in ipam in prefix:1.2.1.0/24 but recorded with prefix:1.2.0.0/24",
+	}, descriptions)
+}
+
+func TestIpIssuesCarryContext(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "1.2.1.0/24"}})
+	require.NoError(t, err)
+	_, err = ds.Network().Create(ctx, &metal.Network{
+		Base:            metal.Base{ID: "inconsistent"},
+		ProjectID:       "p1",
+		Prefixes:        metal.Prefixes{{IP: "1.3.0.0", Length: "24"}},
+		AddressFamilies: metal.AddressFamilies{metal.IPv4AddressFamily, metal.IPv6AddressFamily},
+	})
+	require.NoError(t, err)
+
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.0.40", ParentPrefixCidr: "1.2.0.0/24", NetworkID: "internet", ProjectID: "p1", Type: metal.Static,
+		Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")}})
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.40")}))
+	require.NoError(t, err)
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.0.41", ParentPrefixCidr: "1.2.0.0/24", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral,
+		Tags: []string{tag.New(metal.TagIPOwner, "machine:m1"), tag.New(metal.TagIPLeaseExpiry, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))}})
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.41")}))
+	require.NoError(t, err)
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.0.50", ParentPrefixCidr: "1.2.0.0/24", NetworkID: "internet", ProjectID: "p1"})
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.60")}))
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.1.0/24", Ip: pointer.Pointer("1.2.1.70")}))
+	require.NoError(t, err)
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.1.70", ParentPrefixCidr: "1.2.0.0/24", NetworkID: "internet", ProjectID: "p1"})
+	require.NoError(t, err)
+
+	issues, err := repo.IP(nil).Issues(ctx)
+	require.NoError(t, err)
+
+	type issueContext struct {
+		Address string
+		Network string
+		Project string
+		Problem repository.IPIssueProblem
+	}
+	var contexts []issueContext
+	for _, issue := range issues {
+		assert.NotEmpty(t, issue.Description, issue.Problem)
+		assert.NotEmpty(t, issue.Remediation, issue.Problem)
+		contexts = append(contexts, issueContext{Address: issue.Address, Network: issue.Network, Project: issue.Project, Problem: issue.Problem})
+	}
+	assert.ElementsMatch(t, []issueContext{
+		{Address: "1.2.0.40", Network: "internet", Project: "p1", Problem: repository.IPIssueInvalidTags},
+		{Address: "1.2.0.41", Network: "internet", Project: "p1", Problem: repository.IPIssueLeaseExpired},
+		{Address: "1.2.0.50", Network: "internet", Project: "p1", Problem: repository.IPIssueNotInIPAM},
+		{Address: "1.2.0.60", Network: "internet", Problem: repository.IPIssueOnlyInIPAM},
+		{Address: "1.2.1.70", Network: "internet", Project: "p1", Problem: repository.IPIssuePrefixMismatch},
+		{Address: "1.2.1.70", Network: "internet", Project: "p1", Problem: repository.IPIssueOutsideParentPrefix},
+		{Network: "inconsistent", Project: "p1", Problem: repository.IPIssueNetworkAddressFamilies},
+	}, contexts)
+}
+
+func TestIpReleaseInIPAM(t *testing.T) {
+	ctx := context.Background()
+	repo, _, ipam, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.5")}))
+	require.NoError(t, err)
+
+	err = repo.IP(pointer.Pointer("p1")).ReleaseInIPAM(ctx, "internet", "1.2.0.5", "1.2.0.0/24")
+	require.Error(t, err)
+	err = repo.IP(nil).ReleaseInIPAM(ctx, "internet", "1.3.0.5", "1.2.0.0/24")
+	require.Error(t, err)
+	err = repo.IP(nil).ReleaseInIPAM(ctx, "internet", "1.3.0.5", "1.3.0.0/24")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	err = repo.IP(nil).ReleaseInIPAM(ctx, "internet", "1.2.0.5", "1.2.0.0/24")
+	require.NoError(t, err)
+
+	err = repo.IP(nil).ReleaseInIPAM(ctx, "internet", "1.2.0.5", "1.2.0.0/24")
+	require.True(t, generic.IsNotFound(err), "expected not found, got %v", err)
+
+	// the ip can be acquired again
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.5")}))
+	require.NoError(t, err)
+}
+
+func TestIpCreateInSuspendedProject(t *testing.T) {
+	ctx := context.Background()
+	suspended := testProject("p2")
+	suspended.Meta.Annotations = map[string]string{putil.SuspendedProjectAnnotation: "true"}
+
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"), suspended)
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p2")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2"})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestIpCreateWithRestrictedAddressFamilies(t *testing.T) {
+	ctx := context.Background()
+	v4Only := testProject("p2")
+	v4Only.Meta.Annotations = map[string]string{putil.AddressFamiliesAnnotation: "IPv4"}
+
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"), v4Only)
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("dualstack"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/96"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("v6"), Prefixes: []string{"2001:db9::/96"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		project string
+		req     *apiv2.IPServiceCreateRequest
+		wantErr bool
+	}{
+		{name: "unrestricted project gets ipv6", project: "p1", req: &apiv2.IPServiceCreateRequest{Network: "dualstack", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}},
+		{name: "allowed family", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "dualstack", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4.Enum()}},
+		{name: "allowed family inferred", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "dualstack"}},
+		{name: "allowed specific ip", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "dualstack", Ip: pointer.Pointer("1.2.0.10")}},
+		{name: "disallowed family", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "dualstack", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}, wantErr: true},
+		{name: "disallowed family inferred", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "v6"}, wantErr: true},
+		{name: "disallowed specific ip", project: "p2", req: &apiv2.IPServiceCreateRequest{Network: "dualstack", Ip: pointer.Pointer("2001:db8::10")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Project = tt.project
+			_, err := repo.IP(&tt.project).Create(ctx, tt.req)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+				assert.ErrorContains(t, err, "project:p2 is not allowed to allocate ips of addressfamily:IPv6")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestIpReservedIPs(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).ReserveIP(ctx, "internet", "1.2.0.1")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.3.0.1")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.0")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	nw, err := repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.1"}, nw.ReservedIPs)
+
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.1")
+	require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+	// reserved ips are never allocated randomly
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.2", ip.IPAddress)
+
+	// allocated ips can not be reserved
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.2")
+	require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+	// reserved ips can not be allocated specifically
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.1")})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	availabilities, err := repo.IP(nil).CheckSpecificIPs(ctx, nw, []string{"1.2.0.1"})
+	require.NoError(t, err)
+	require.Len(t, availabilities, 1)
+	assert.False(t, availabilities[0].Allocatable)
+	assert.Equal(t, "ip is reserved in network:internet", availabilities[0].Reason)
+
+	// reservations are no inconsistency
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+
+	nw, err = repo.IP(nil).UnreserveIP(ctx, "internet", "1.2.0.1")
+	require.NoError(t, err)
+	assert.Empty(t, nw.ReservedIPs)
+	_, err = repo.IP(nil).UnreserveIP(ctx, "internet", "1.2.0.1")
+	require.True(t, generic.IsNotFound(err), "expected not found, got %v", err)
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.1")})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.1", ip.IPAddress)
+
+	// reservations which are not held in ipam are skipped by random allocation as well
+	old, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	reserved := *old
+	reserved.ReservedIPs = []string{"1.2.0.3"}
+	require.NoError(t, ds.Network().Update(ctx, &reserved, old))
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.4", ip.IPAddress)
+}
+
+func TestIpReserveAndClaim(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).ReserveAndClaim(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")})
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveAndClaim(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveAndClaim(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.3.0.5")})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	// concurrent callers race for the same ip, exactly one of them wins
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		claimed []*metal.IP
+		codes   []connect.Code
+	)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			project := fmt.Sprintf("p%d", i%2+1)
+			ip, err := repo.IP(nil).ReserveAndClaim(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project, Ip: pointer.Pointer("1.2.0.5")})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				codes = append(codes, connect.CodeOf(err))
+				return
+			}
+			claimed = append(claimed, ip)
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, claimed, 1)
+	assert.Equal(t, "1.2.0.5", claimed[0].IPAddress)
+	assert.Len(t, codes, 9)
+	for _, code := range codes {
+		// depending on when they lost, the ip is either allocated or already reserved
+		assert.Contains(t, []connect.Code{connect.CodeAlreadyExists, connect.CodeFailedPrecondition}, code)
+	}
+
+	nw, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.5"}, nw.ReservedIPs)
+
+	stored, err := ds.IP().Get(ctx, "1.2.0.5")
+	require.NoError(t, err)
+	assert.Equal(t, claimed[0].ProjectID, stored.ProjectID)
+
+	// the claimed ip can neither be reserved nor allocated by anyone else
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.5")
+	require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p2")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2", Ip: pointer.Pointer("1.2.0.5")})
+	require.Error(t, err)
+	ip, err := repo.IP(pointer.Pointer("p2")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2"})
+	require.NoError(t, err)
+	assert.NotEqual(t, "1.2.0.5", ip.IPAddress)
+}
+
+func TestIpReservedRanges(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	nw, err := repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.10", "1.2.0.20")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.10-1.2.0.20"}, nw.ReservedIPs)
+
+	for _, tt := range []struct {
+		name        string
+		first, last string
+	}{
+		{name: "overlapping at the start", first: "1.2.0.5", last: "1.2.0.10"},
+		{name: "overlapping at the end", first: "1.2.0.20", last: "1.2.0.25"},
+		{name: "contained", first: "1.2.0.12", last: "1.2.0.14"},
+		{name: "containing", first: "1.2.0.1", last: "1.2.0.30"},
+		{name: "same", first: "1.2.0.10", last: "1.2.0.20"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := repo.IP(nil).ReserveRange(ctx, "internet", tt.first, tt.last)
+			require.Error(t, err)
+			assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+			assert.ErrorContains(t, err, "overlaps with the reservation 1.2.0.10-1.2.0.20 in network:internet")
+		})
+	}
+
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.15")
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	// adjacent ranges do not overlap
+	_, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.21", "1.2.0.30")
+	require.NoError(t, err)
+	nw, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.5", "1.2.0.9")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.10-1.2.0.20", "1.2.0.21-1.2.0.30", "1.2.0.5-1.2.0.9"}, nw.ReservedIPs)
+
+	// the reservation must lie within one prefix and must not contain the network address
+	_, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.250", "1.2.1.5")
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.0", "1.2.0.2")
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.40", "1.2.0.35")
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.15")})
+	require.Error(t, err)
+	require.Nil(t, ip)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// an allocated ip within the range fails the reservation and releases what was acquired so far
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.45")})
+	require.NoError(t, err)
+	_, err = repo.IP(nil).ReserveRange(ctx, "internet", "1.2.0.40", "1.2.0.50")
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.40")})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.40", ip.IPAddress)
+
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+
+	nw, err = repo.IP(nil).UnreserveIP(ctx, "internet", "1.2.0.10-1.2.0.20")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.21-1.2.0.30", "1.2.0.5-1.2.0.9"}, nw.ReservedIPs)
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.15")})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.15", ip.IPAddress)
+}
+
+func TestIpListChangedSince(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	var created []*metal.IP
+	for _, project := range []string{"p1", "p1", "p2"} {
+		ip, err := repo.IP(&project).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project})
+		require.NoError(t, err)
+		created = append(created, ip)
+		// the datastore stores timestamps with millisecond precision
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ips, watermark, err := repo.IP(pointer.Pointer("p1")).ListChangedSince(ctx, nil, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	assert.Equal(t, created[0].IPAddress, ips[0].IPAddress)
+	assert.Equal(t, created[1].IPAddress, ips[1].IPAddress)
+	assert.Equal(t, ips[1].Changed, watermark)
+
+	ips, _, err = repo.IP(nil).ListChangedSince(ctx, nil, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, ips, 3)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: created[0].IPAddress, Project: "p1", Name: pointer.Pointer("changed")})
+	require.NoError(t, err)
+
+	ips, next, err := repo.IP(pointer.Pointer("p1")).ListChangedSince(ctx, nil, watermark)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, created[0].IPAddress, ips[0].IPAddress)
+	assert.Equal(t, "changed", ips[0].Name)
+	assert.True(t, next.After(watermark))
+
+	ips, last, err := repo.IP(pointer.Pointer("p1")).ListChangedSince(ctx, nil, next)
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+	assert.Equal(t, next, last)
+}
+
+func TestIpExportCSV(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "internet", Type: metal.Static, Tags: []string{"a=b", "c=d"}},
+		{Name: "ip2, with comma", IPAddress: "1.2.3.5", ProjectID: "p1", NetworkID: "internet", Type: metal.Ephemeral},
+		{Name: "ip3", IPAddress: "1.2.3.6", ProjectID: "p1", NetworkID: "internet", Type: metal.Ephemeral, Tags: []string{tag.New(tag.MachineID, "m1")}},
+		{Name: "ip4", IPAddress: "2.3.4.5", ProjectID: "p2", NetworkID: "internet", Type: metal.Ephemeral},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	created := func(ip string) string {
+		stored, err := ds.IP().Get(ctx, ip)
+		require.NoError(t, err)
+		return stored.Created.UTC().Format(time.RFC3339)
+	}
+
+	// the scope wins over the project of the query
+	var buf bytes.Buffer
+	err := repo.IP(pointer.Pointer("p1")).ExportCSV(ctx, &apiv2.IPQuery{Project: pointer.Pointer("p2")}, &buf)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "address,name,type,network,tags,created", lines[0])
+	assert.ElementsMatch(t, []string{
+		`1.2.3.4,ip1,static,internet,"a=b,c=d",` + created("1.2.3.4"),
+		`1.2.3.5,"ip2, with comma",ephemeral,internet,,` + created("1.2.3.5"),
+	}, lines[1:])
+
+	buf.Reset()
+	err = repo.IP(pointer.Pointer("p1")).ExportCSV(ctx, &apiv2.IPQuery{Name: pointer.Pointer("ip1")}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "address,name,type,network,tags,created\n1.2.3.4,ip1,static,internet,\"a=b,c=d\","+created("1.2.3.4")+"\n", buf.String())
+}
+
+func TestIpPrefixRange(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "internet", ParentPrefixCidr: "1.2.3.0/24"})
+	require.NoError(t, err)
+
+	want := &metal.PrefixRange{
+		Network:     netip.MustParseAddr("1.2.3.0"),
+		FirstUsable: netip.MustParseAddr("1.2.3.1"),
+		LastUsable:  netip.MustParseAddr("1.2.3.254"),
+		Broadcast:   netip.MustParseAddr("1.2.3.255"),
+	}
+
+	got, err := repo.IP(pointer.Pointer("p1")).PrefixRange(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	got, err = repo.IP(pointer.Pointer("p1")).PrefixRange(ctx, "1.2.3.0/24")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = repo.IP(pointer.Pointer("p2")).PrefixRange(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+}
+
+func TestIpPing(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	require.NoError(t, repo.IP(nil).Ping(ctx))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, repo.IP(nil).Ping(canceled))
+}
+
+func TestIpWithReferences(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Tags: []string{tag.New(tag.MachineID, "m1")}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Tags: []string{tag.New(tag.ClusterServiceFQN, "c1/default/lb")}},
+		{IPAddress: "1.2.3.6", ProjectID: "p1"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	// references are only resolved on demand
+	ip, err := repo.IP(pointer.Pointer("p1")).Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Nil(t, ip.References)
+
+	expanded := repo.IP(pointer.Pointer("p1")).WithReferences()
+
+	ip, err = expanded.Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, []metal.IPReference{{Kind: metal.IPReferenceKindMachine, ID: "m1"}}, ip.References)
+
+	ips, err := expanded.List(ctx, &apiv2.IPQuery{Project: pointer.Pointer("p1")})
+	require.NoError(t, err)
+	references := map[string][]metal.IPReference{}
+	for _, ip := range ips {
+		references[ip.IPAddress] = ip.References
+	}
+	assert.Equal(t, map[string][]metal.IPReference{
+		"1.2.3.4": {{Kind: metal.IPReferenceKindMachine, ID: "m1"}},
+		"1.2.3.5": {{Kind: metal.IPReferenceKindService, ID: "c1/default/lb"}},
+		"1.2.3.6": nil,
+	}, references)
+
+	_, err = repo.IP(pointer.Pointer("p2")).WithReferences().Get(ctx, "1.2.3.4")
+	require.True(t, generic.IsNotFound(err))
+}
+
+func TestIpDeleteReferenced(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	machineIP, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1")})
+	require.NoError(t, err)
+	serviceIP, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Tags: []string{tag.New(tag.ClusterServiceFQN, "c1/default/lb")}})
+	require.NoError(t, err)
+	unreferenced, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, machineIP)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "machine:m1")
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, serviceIP)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "service:c1/default/lb")
+
+	_, err = repo.IP(pointer.Pointer("p1")).Get(ctx, machineIP.IPAddress)
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, unreferenced)
+	require.NoError(t, err)
+}
+
+func TestIpCreateWithNetworkDefaultType(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("mgmt"),
+		Prefixes: []string{"1.3.0.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelDefaultIPType: string(metal.Static)},
+	})
+	require.NoError(t, err)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, metal.Ephemeral, ip.Type)
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "mgmt", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, metal.Static, ip.Type)
+
+	// an explicit type wins over the default of the network
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "mgmt", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+	require.NoError(t, err)
+	assert.Equal(t, metal.Ephemeral, ip.Type)
+}
+
+func TestIpIssuesOfInconsistentNetwork(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("consistent"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/96"}})
+	require.NoError(t, err)
+	_, err = ds.Network().Create(ctx, &metal.Network{
+		Base:            metal.Base{ID: "inconsistent"},
+		Prefixes:        metal.Prefixes{{IP: "1.3.0.0", Length: "24"}},
+		AddressFamilies: metal.AddressFamilies{metal.IPv4AddressFamily, metal.IPv6AddressFamily},
+	})
+	require.NoError(t, err)
+
+	issues, err := repo.IP(nil).Issues(ctx)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "inconsistent", issues[0].IP.NetworkID)
+	assert.Equal(t, "network:inconsistent claims addressfamily IPv6 but has no prefix of it", issues[0].Description)
+}
+
+func TestIpDeleteWithHostname(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(tags ...string) *metal.IP {
+		ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum(), Tags: tags})
+		require.NoError(t, err)
+		return ip
+	}
+
+	var (
+		withHostname    = create(tag.New(metal.TagIPHostname, "www.example.com"))
+		withoutHostname = create()
+		inBulk          = create("cluster=a", tag.New(metal.TagIPHostname, "api.example.com"))
+		inUse           = create(tag.New(metal.TagIPHostname, "lb.example.com"), tag.New(tag.ClusterServiceFQN, "default/ingress"))
+	)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, withHostname)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "still has the hostname www.example.com")
+	_, err = ds.IP().Get(ctx, withHostname.IPAddress)
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, withoutHostname)
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).ForceDelete(ctx, withHostname)
+	require.NoError(t, err)
+
+	// a forced release does not release ips which are still in use
+	_, err = repo.IP(pointer.Pointer("p1")).ForceDelete(ctx, inUse)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "is still in use by service:default/ingress")
+
+	result, err := repo.IP(pointer.Pointer("p1")).DeleteByFilter(ctx, &apiv2.IPQuery{Tags: []string{"cluster=a"}}, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Released)
+	assert.Contains(t, result.Refused, inBulk.IPAddress)
+	result, err = repo.IP(pointer.Pointer("p1")).DeleteByFilter(ctx, &apiv2.IPQuery{Tags: []string{"cluster=a"}}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{inBulk.IPAddress}, ipAddresses(result.Released))
+
+	for _, ip := range []*metal.IP{withHostname, withoutHostname, inBulk} {
+		require.Eventually(t, func() bool {
+			_, err := ds.IP().Get(ctx, ip.IPAddress)
+			return generic.IsNotFound(err)
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+}
+
+func TestIpDeleteByFilter(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(project string, ipType apiv2.IPType, tags ...string) *metal.IP {
+		ip, err := repo.IP(&project).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project, Type: ipType.Enum(), Tags: tags})
+		require.NoError(t, err)
+		return ip
+	}
+
+	var (
+		ephemeral  = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL, "cluster=a")
+		ephemeral2 = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL, "cluster=a")
+		static     = create("p1", apiv2.IPType_IP_TYPE_STATIC, "cluster=a")
+		inUse      = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL, "cluster=a", tag.New(tag.ClusterServiceFQN, "default/ingress"))
+		otherTag   = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL, "cluster=b")
+		otherProj  = create("p2", apiv2.IPType_IP_TYPE_EPHEMERAL, "cluster=a")
+	)
+
+	_, err = repo.IP(pointer.Pointer("p1")).DeleteByFilter(ctx, &apiv2.IPQuery{}, false)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	result, err := repo.IP(pointer.Pointer("p1")).DeleteByFilter(ctx, &apiv2.IPQuery{Tags: []string{"cluster=a"}}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{ephemeral.IPAddress, ephemeral2.IPAddress}, ipAddresses(result.Released))
+	require.Len(t, result.Refused, 2)
+	assert.Equal(t, "ip is static, releasing it must be forced", result.Refused[static.IPAddress])
+	assert.Contains(t, result.Refused[inUse.IPAddress], "is still in use by service:default/ingress")
+
+	for _, ip := range result.Released {
+		require.Eventually(t, func() bool {
+			_, err := ds.IP().Get(ctx, ip.IPAddress)
+			return generic.IsNotFound(err)
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+	for _, ip := range []*metal.IP{static, inUse, otherTag, otherProj} {
+		_, err := ds.IP().Get(ctx, ip.IPAddress)
+		require.NoError(t, err, ip.IPAddress)
+	}
+
+	result, err = repo.IP(pointer.Pointer("p1")).DeleteByFilter(ctx, &apiv2.IPQuery{Tags: []string{"cluster=a"}}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{static.IPAddress}, ipAddresses(result.Released))
+	assert.Len(t, result.Refused, 1)
+	assert.Contains(t, result.Refused, inUse.IPAddress)
+}
+
+func TestIpCreateWithReleasedIPReuse(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	release := func(ip *metal.IP) {
+		_, err := repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, err := ds.IP().Get(ctx, ip.IPAddress)
+			return generic.IsNotFound(err)
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		release []int
+		want    int
+	}{
+		{
+			name:    "without policy ipam hands out the lowest free ip",
+			release: []int{1, 2},
+			want:    1,
+		},
+		{
+			name:    "reuse last avoids released ips",
+			policy:  metal.ReleasedIPReuseLast,
+			release: []int{1, 2},
+			want:    4,
+		},
+		{
+			name:    "reuse first hands out the latest released ip",
+			policy:  metal.ReleasedIPReuseFirst,
+			release: []int{1, 2},
+			want:    2,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := fmt.Sprintf("n%d", i)
+			_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+				Id:       &network,
+				Prefixes: []string{fmt.Sprintf("1.2.%d.0/29", i)},
+				Labels:   map[string]string{metal.NetworkLabelReleasedIPReuse: tt.policy},
+			})
+			require.NoError(t, err)
+
+			ips := map[string]*metal.IP{}
+			for range 3 {
+				ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: network, Project: "p1"})
+				require.NoError(t, err)
+				ips[ip.IPAddress] = ip
+			}
+			for _, octet := range tt.release {
+				release(ips[fmt.Sprintf("1.2.%d.%d", i, octet)])
+				// the release order must be distinguishable
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: network, Project: "p1"})
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("1.2.%d.%d", i, tt.want), ip.IPAddress)
+		})
+	}
+}
+
+func TestIpCreateWithReleasedIPReuseLastWhenExhausted(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("internet"),
+		Prefixes: []string{"1.2.0.0/30"},
+		Labels:   map[string]string{metal.NetworkLabelReleasedIPReuse: metal.ReleasedIPReuseLast},
+	})
+	require.NoError(t, err)
+
+	var ips []*metal.IP
+	for range 2 {
+		ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+		ips = append(ips, ip)
+	}
+	for _, ip := range ips {
+		_, err := repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, err := ds.IP().Get(ctx, ip.IPAddress)
+			return generic.IsNotFound(err)
+		}, 10*time.Second, 50*time.Millisecond)
+		// the release order must be distinguishable
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// only recently released ips are left, the longest released one is handed out and the other one is not leaked
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, ips[0].IPAddress, ip.IPAddress)
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, ips[1].IPAddress, ip.IPAddress)
+}
+
+func TestIpListByAddressFamily(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []string{"1.2.3.4", "10.0.0.1", "2001:db8::1", "::ffff:1.2.3.5"} {
+		_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: ip, ProjectID: "p1"})
+		require.NoError(t, err)
+	}
+
+	addresses := func(af apiv2.IPAddressFamily) []string {
+		ips, err := repo.IP(nil).List(ctx, &apiv2.IPQuery{AddressFamily: &af})
+		require.NoError(t, err)
+		var res []string
+		for _, ip := range ips {
+			res = append(res, ip.IPAddress)
+		}
+		return res
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "10.0.0.1"}, addresses(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4))
+	assert.ElementsMatch(t, []string{"2001:db8::1", "::ffff:1.2.3.5"}, addresses(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6))
+	assert.Len(t, addresses(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED), 4)
+}
+
+func TestIpCreateExhausted(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/30", "1.2.1.0/30"}})
+	require.NoError(t, err)
+
+	for range 4 {
+		_, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+	}
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "no ips left in network:internet")
+	assert.ErrorContains(t, err, "1.2.0.0/30 (4/4 ips acquired)")
+	assert.ErrorContains(t, err, "1.2.1.0/30 (4/4 ips acquired)")
+}
+
+func TestIpListInExhaustedPrefixes(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeIpam{}
+	repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: fake}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/30", "1.2.1.0/24"}})
+	require.NoError(t, err)
+
+	for _, ip := range []string{"1.2.0.1", "1.2.0.2", "1.2.1.1", "1.2.1.2"} {
+		_, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer(ip)})
+		require.NoError(t, err)
+	}
+
+	ips, err := repo.IP(pointer.Pointer("p1")).ListInExhaustedPrefixes(ctx, &apiv2.IPQuery{Project: pointer.Pointer("p1")})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.0.1", "1.2.0.2"}, ipAddresses(ips))
+
+	// the utilization of every prefix is looked up once
+	assert.Equal(t, map[string]int{"1.2.0.0/30": 1, "1.2.1.0/24": 1}, fake.counts("usage"))
+
+	ips, err = repo.IP(pointer.Pointer("p1")).ListInExhaustedPrefixes(ctx, &apiv2.IPQuery{Project: pointer.Pointer("p1"), Ip: pointer.Pointer("1.2.1.1")})
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestIpCanAllocate(t *testing.T) {
+	ctx := context.Background()
+	suspended := testProject("suspended")
+	suspended.Meta.Annotations = map[string]string{putil.SuspendedProjectAnnotation: "true"}
+	v6Only := testProject("v6-only")
+	v6Only.Meta.Annotations = map[string]string{putil.AddressFamiliesAnnotation: "IPv6"}
+
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), suspended, v6Only)
+	defer cleanup()
+
+	for _, nw := range []*apiv2.NetworkServiceCreateRequest{
+		{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/96"}},
+		{Id: pointer.Pointer("read-only"), Prefixes: []string{"1.3.0.0/24"}, Labels: map[string]string{metal.NetworkLabelReadOnly: "true"}},
+		{Id: pointer.Pointer("pending"), Prefixes: []string{"1.4.0.0/24"}, Labels: map[string]string{metal.NetworkLabelPendingDeletion: "true"}},
+		{Id: pointer.Pointer("ephemeral-only"), Prefixes: []string{"1.5.0.0/24"}, Labels: map[string]string{metal.NetworkLabelEphemeralOnly: "true"}},
+		{Id: pointer.Pointer("no-specific"), Prefixes: []string{"1.6.0.0/24"}, Labels: map[string]string{metal.NetworkLabelNoSpecificIP: "true"}},
+		{Id: pointer.Pointer("full"), Prefixes: []string{"1.7.0.1/32"}},
+	} {
+		_, err := repo.Network(nil).Create(ctx, nw)
+		require.NoError(t, err)
+	}
+	_, err := ds.Network().Create(ctx, &metal.Network{Base: metal.Base{ID: "empty"}})
+	require.NoError(t, err)
+	_, err = ds.Network().Create(ctx, &metal.Network{Base: metal.Base{ID: "private"}, ProjectID: "p9", ParentNetworkID: "super", Prefixes: metal.Prefixes{{IP: "10.0.0.0", Length: "24"}}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "full", Project: "p1"})
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		req  *apiv2.IPServiceCreateRequest
+		want []repository.IPAllocationBlockReason
+	}{
+		{name: "all clear random", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"}},
+		{name: "all clear ipv6", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}},
+		{name: "all clear specific", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.11")}},
+		{name: "unknown project", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p-unknown"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedProjectNotFound}},
+		{name: "suspended project", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "suspended"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedProjectSuspended}},
+		{name: "unknown network", req: &apiv2.IPServiceCreateRequest{Network: "unknown", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNetworkNotFound}},
+		{name: "private network of another project", req: &apiv2.IPServiceCreateRequest{Network: "private", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNetworkNotShared}},
+		{name: "read-only network", req: &apiv2.IPServiceCreateRequest{Network: "read-only", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNetworkReadOnly}},
+		{name: "network pending deletion", req: &apiv2.IPServiceCreateRequest{Network: "pending", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNetworkPendingDeletion}},
+		{name: "network without prefixes", req: &apiv2.IPServiceCreateRequest{Network: "empty", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNoPrefixes}},
+		{name: "addressfamily not in network", req: &apiv2.IPServiceCreateRequest{Network: "read-only", Project: "p1", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedNetworkReadOnly, repository.AllocationBlockedAddressFamilyUnavailable}},
+		{name: "addressfamily not allowed for project", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "v6-only"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedAddressFamilyUnavailable}},
+		{name: "ip type not allowed", req: &apiv2.IPServiceCreateRequest{Network: "ephemeral-only", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum()}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedIPTypeNotAllowed}},
+		{name: "specific ip not allowed", req: &apiv2.IPServiceCreateRequest{Network: "no-specific", Project: "p1", Ip: pointer.Pointer("1.6.0.10")}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedSpecificIPUnavailable}},
+		{name: "specific ip taken", req: &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedSpecificIPUnavailable}},
+		{name: "network exhausted", req: &apiv2.IPServiceCreateRequest{Network: "full", Project: "p1"}, want: []repository.IPAllocationBlockReason{repository.AllocationBlockedExhausted}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readiness, err := repo.IP(&tt.req.Project).CanAllocate(ctx, tt.req)
+			require.NoError(t, err)
+
+			var reasons []repository.IPAllocationBlockReason
+			for _, b := range readiness.Blocks {
+				assert.NotEmpty(t, b.Description)
+				reasons = append(reasons, b.Reason)
+			}
+			assert.Equal(t, tt.want, reasons)
+			assert.Equal(t, len(tt.want) == 0, readiness.Ready)
+		})
+	}
+
+	ips, err := repo.IP(nil).List(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, ips, 2, "nothing must be allocated by the check")
+}
+
+func TestIpCreateThenGet(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	for range 20 {
+		created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+
+		// no waiting, rethinkdb acknowledges inserts durably and reads from the primary replica by default
+		got, err := repo.IP(pointer.Pointer("p1")).Get(ctx, created.IPAddress)
+		require.NoError(t, err)
+		assert.Equal(t, created.AllocationUUID, got.AllocationUUID)
+	}
+}
+
+func TestIpCreateAllocationUUIDs(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	seen := map[string]bool{}
+	for range 3 {
+		ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+
+		id, err := uuid.Parse(ip.AllocationUUID)
+		require.NoError(t, err)
+		assert.Equal(t, uuid.Version(7), id.Version())
+		assert.False(t, seen[ip.AllocationUUID], "allocation uuid %s was handed out twice", ip.AllocationUUID)
+		seen[ip.AllocationUUID] = true
+	}
+}
+
+func TestIpCreateWithMachineRetryWindow(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{MachineRetryWindow: time.Minute}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/96"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet-2"), Prefixes: []string{"1.3.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(network, machine string, af apiv2.IPAddressFamily) *metal.IP {
+		ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: network, Project: "p1", MachineId: &machine, AddressFamily: af.Enum()})
+		require.NoError(t, err)
+		return ip
+	}
+
+	first := create("internet", "m1", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+
+	retried := create("internet", "m1", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+	assert.Equal(t, first.IPAddress, retried.IPAddress)
+	assert.Equal(t, first.AllocationUUID, retried.AllocationUUID)
+
+	assert.NotEqual(t, first.IPAddress, create("internet", "m2", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4).IPAddress, "another machine gets its own ip")
+	assert.NotEqual(t, first.IPAddress, create("internet", "m1", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6).IPAddress, "another addressfamily gets its own ip")
+	assert.NotEqual(t, first.IPAddress, create("internet-2", "m1", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4).IPAddress, "another network gets its own ip")
+
+	// outside of the window a new ip is allocated
+	first.Created = time.Now().Add(-2 * time.Minute)
+	require.NoError(t, ds.IP().Upsert(ctx, first))
+	assert.NotEqual(t, first.IPAddress, create("internet", "m1", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4).IPAddress)
+
+	ips, err := repo.IP(pointer.Pointer("p1")).List(ctx, &apiv2.IPQuery{Network: pointer.Pointer("internet"), MachineId: pointer.Pointer("m1")})
+	require.NoError(t, err)
+	assert.Len(t, ips, 3)
+}
+
+func TestIpCreateStaticMachineIP(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	req := &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1"), Type: apiv2.IPType_IP_TYPE_STATIC.Enum()}
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, req)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1"), Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+	require.NoError(t, err)
+	assert.Equal(t, metal.Ephemeral, ip.Type)
+
+	// admins create ips unscoped
+	ip, err = repo.IP(nil).Create(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, metal.Static, ip.Type)
+	assert.Contains(t, ip.Tags, tag.New(tag.MachineID, "m1"))
+}
+
+func TestIpCreateTopDown(t *testing.T) {
+	ctx := context.Background()
+	repo, _, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "1.2.1.0/24", "2001:db8::/126"}})
+	require.NoError(t, err)
+
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.1.0/24", Ip: pointer.Pointer("1.2.1.253")}))
+	require.NoError(t, err)
+
+	create := func(af apiv2.IPAddressFamily) *metal.IP {
+		ip, err := repo.IP(pointer.Pointer("p1")).CreateTopDown(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", AddressFamily: af.Enum()})
+		require.NoError(t, err)
+		return ip
+	}
+
+	first := create(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+	assert.Equal(t, "1.2.1.254", first.IPAddress)
+	assert.Equal(t, "1.2.1.0/24", first.ParentPrefixCidr)
+	assert.Equal(t, "1.2.1.252", create(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4).IPAddress, "allocated ips are skipped")
+
+	assert.Equal(t, "2001:db8::3", create(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6).IPAddress)
+	assert.Equal(t, "2001:db8::2", create(apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6).IPAddress)
+
+	// a regular create still starts at the bottom of the prefix
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4.Enum()})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.1", ip.IPAddress)
+
+	// an exhausted network is reported as such
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tiny"), Prefixes: []string{"1.3.0.0/30"}})
+	require.NoError(t, err)
+	for range 2 {
+		_, err := repo.IP(pointer.Pointer("p1")).CreateTopDown(ctx, &apiv2.IPServiceCreateRequest{Network: "tiny", Project: "p1"})
+		require.NoError(t, err)
+	}
+	_, err = repo.IP(pointer.Pointer("p1")).CreateTopDown(ctx, &apiv2.IPServiceCreateRequest{Network: "tiny", Project: "p1"})
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "no ips left in network:tiny")
+}
+
+func TestIpCreateHostPrefix(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/48"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("small"), Prefixes: []string{"1.3.0.0/24", "2001:db9::/64"}})
+	require.NoError(t, err)
+
+	parent := netip.MustParsePrefix("2001:db8::/48")
+	seen := map[string]bool{}
+	for range 3 {
+		ip, err := repo.IP(pointer.Pointer("p1")).CreateHostPrefix(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+
+		hostPrefix, err := netip.ParsePrefix(ip.IPAddress)
+		require.NoError(t, err, "the address of a host prefix is the prefix")
+		assert.Equal(t, 64, hostPrefix.Bits())
+		assert.True(t, parent.Contains(hostPrefix.Addr()))
+		assert.Equal(t, "2001:db8::/48", ip.ParentPrefixCidr)
+		assert.False(t, seen[ip.IPAddress], "%s allocated twice", ip.IPAddress)
+		seen[ip.IPAddress] = true
+	}
+
+	// host prefixes are no inconsistency
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInDatastore)
+	assert.Empty(t, diff.PrefixMismatch)
+	issues, err := repo.IP(pointer.Pointer("p1")).Issues(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	for _, req := range []*apiv2.IPServiceCreateRequest{
+		{Network: "internet", Project: "p1", AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4.Enum()},
+		{Network: "internet", Project: "p1", Ip: pointer.Pointer("2001:db8::1")},
+		{Network: "small", Project: "p1"},
+	} {
+		_, err := repo.IP(pointer.Pointer("p1")).CreateHostPrefix(ctx, req)
+		require.Error(t, err)
+		assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err), req.String())
+	}
+}
+
+func TestIpCreateNth(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "1.2.1.0/29", "2001:db8::/96"}})
+	require.NoError(t, err)
+
+	create := func(prefix string, n uint64) (*metal.IP, error) {
+		return repo.IP(pointer.Pointer("p1")).CreateNth(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"}, prefix, n)
+	}
+
+	ip, err := create("1.2.1.0/29", 5)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.1.5", ip.IPAddress)
+	assert.Equal(t, "1.2.1.0/29", ip.ParentPrefixCidr)
+	assert.Equal(t, metal.AllocationMethodSpecific, ip.AllocationMethod)
+
+	ip, err = create("2001:db8::/96", 5)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::5", ip.IPAddress)
+
+	// the address is already allocated
+	_, err = create("1.2.1.0/29", 5)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+	for _, tt := range []struct {
+		prefix string
+		n      uint64
+	}{
+		{prefix: "1.2.1.0/29", n: 7},
+		{prefix: "1.2.1.0/29", n: 0},
+		{prefix: "1.3.0.0/24", n: 1},
+		{prefix: "no-prefix", n: 1},
+	} {
+		_, err := create(tt.prefix, tt.n)
+		require.Error(t, err, "%s %d", tt.prefix, tt.n)
+		assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err), "%s %d", tt.prefix, tt.n)
+	}
+
+	_, err = repo.IP(pointer.Pointer("p1")).CreateNth(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")}, "1.2.0.0/24", 5)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestIpCreateWithMaxPrefixAttempts(t *testing.T) {
+	var prefixes []string
+	for i := range 10 {
+		prefixes = append(prefixes, fmt.Sprintf("1.2.%d.0/30", i))
+	}
+	prefixes = append(prefixes, "1.2.10.0/24")
+
+	tests := []struct {
+		name         string
+		attempts     int
+		wantErr      string
+		wantAcquired []string
+		wantPrefix   string
+	}{
+		{
+			name:         "limited",
+			attempts:     3,
+			wantErr:      "gave up after 3 of 11 prefixes in network:internet",
+			wantAcquired: prefixes[:3],
+		},
+		{
+			name:       "without a limit the last prefix is reached",
+			wantPrefix: "1.2.10.0/24",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			fake := &fakeIpam{}
+			repo, _, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: fake, config: repository.Config{MaxPrefixAttempts: tt.attempts}}, testProject("p1"))
+			defer cleanup()
+
+			_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: prefixes})
+			require.NoError(t, err)
+
+			// fill the /30 prefixes, only the last prefix has ips left, the acquisitions are not counted
+			for _, prefix := range prefixes[:10] {
+				for range 2 {
+					_, err := ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: prefix}))
+					require.NoError(t, err)
+				}
+			}
+
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+			if tt.wantErr != "" {
+				require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.ErrorContains(t, err, "1.2.2.0/30 (4/4 ips acquired)")
+				assert.NotContains(t, err.Error(), "1.2.3.0/30")
+
+				acquired := fake.counts("acquire")
+				assert.Len(t, acquired, len(tt.wantAcquired))
+				for _, prefix := range tt.wantAcquired {
+					assert.Equal(t, 1, acquired[prefix], prefix)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPrefix, ip.ParentPrefixCidr)
+		})
+	}
+}
+
+func TestIpImportAndReconcile(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Import(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")}, "1.2.0.0/24")
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	_, err = repo.IP(nil).Import(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.3.0.5")}, "1.3.0.0/24")
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	imported, err := repo.IP(nil).Import(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Name: pointer.Pointer("legacy")}, "1.2.0.0/24")
+	require.NoError(t, err)
+	assert.True(t, imported.NeedsReconciliation)
+	assert.Equal(t, "legacy", imported.Name)
+
+	// the import did not acquire the ip in ipam
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.0.5"}, ipAddresses(diff.OnlyInDatastore))
+
+	// an ip which is acquired in ipam already is reconciled as well
+	already, err := repo.IP(nil).Import(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.6")}, "1.2.0.0/24")
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.6")}))
+	require.NoError(t, err)
+
+	reconciled, err := repo.IP(nil).ReconcileImported(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{imported.IPAddress, already.IPAddress}, ipAddresses(reconciled))
+
+	for _, ip := range []string{"1.2.0.5", "1.2.0.6"} {
+		stored, err := ds.IP().Get(ctx, ip)
+		require.NoError(t, err)
+		assert.False(t, stored.NeedsReconciliation)
+
+		_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer(ip)}))
+		require.Error(t, err)
+		assert.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+	}
+
+	reconciled, err = repo.IP(nil).ReconcileImported(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, reconciled)
+}
+
+func TestIpImportValidation(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}, Labels: map[string]string{metal.NetworkLabelReserveGateway: "true", metal.NetworkLabelExcludedIPs: "1.2.0.100"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("read-only"), Prefixes: []string{"1.3.0.0/24"}, Labels: map[string]string{metal.NetworkLabelReadOnly: "true"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		req      *apiv2.IPServiceCreateRequest
+		prefix   string
+		wantCode connect.Code
+		wantTags []string
+	}{
+		{
+			name:     "name too long",
+			req:      &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Name: pointer.Pointer(strings.Repeat("a", 129))},
+			prefix:   "1.2.0.0/24",
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "reserved tag",
+			req:      &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Tags: []string{metal.TagIPChargeable + "=false"}},
+			prefix:   "1.2.0.0/24",
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "read-only network",
+			req:      &apiv2.IPServiceCreateRequest{Network: "read-only", Project: "p1", Ip: pointer.Pointer("1.3.0.5")},
+			prefix:   "1.3.0.0/24",
+			wantCode: connect.CodeFailedPrecondition,
+		},
+		{
+			name:     "gateway",
+			req:      &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.1")},
+			prefix:   "1.2.0.0/24",
+			wantCode: connect.CodeFailedPrecondition,
+		},
+		{
+			name:     "excluded ip",
+			req:      &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.100")},
+			prefix:   "1.2.0.0/24",
+			wantCode: connect.CodeFailedPrecondition,
+		},
+		{
+			name:     "duplicate tags are deduplicated",
+			req:      &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Tags: []string{"color=red", "color=blue"}},
+			prefix:   "1.2.0.0/24",
+			wantTags: []string{"color=blue"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported, err := repo.IP(nil).Import(ctx, tt.req, tt.prefix)
+			if tt.wantCode != 0 {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTags, imported.Tags)
+		})
+	}
+}
+
+func TestIpWatch(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	var (
+		mu     sync.Mutex
+		events []repository.IPEvent
+	)
+	received := func() []repository.IPEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(events)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watching := make(chan error)
+	go func() {
+		watching <- repo.IP(pointer.Pointer("p1")).Watch(watchCtx, "", func(event repository.IPEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+			return nil
+		})
+	}()
+	// give the watch some time to determine the latest revision
+	time.Sleep(100 * time.Millisecond)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p2")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2"})
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: ip.IPAddress, Project: "p1", Name: pointer.Pointer("renamed")})
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(received()) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	cancel()
+	require.NoError(t, <-watching)
+
+	got := received()
+	for _, event := range got {
+		assert.Equal(t, ip.IPAddress, event.IP.IPAddress)
+	}
+	assert.Equal(t, repository.IPEventCreated, got[0].Type)
+	assert.Equal(t, repository.IPEventUpdated, got[1].Type)
+	assert.Equal(t, "renamed", got[1].IP.Name)
+	assert.Equal(t, repository.IPEventDeleted, got[2].Type)
+
+	// resuming from a revision streams the later events only
+	resumeCtx, cancelResume := context.WithCancel(ctx)
+	defer cancelResume()
+	var resumed []repository.IPEventType
+	err = repo.IP(pointer.Pointer("p1")).Watch(resumeCtx, got[0].Revision, func(event repository.IPEvent) error {
+		resumed = append(resumed, event.Type)
+		if len(resumed) == 2 {
+			cancelResume()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPEventType{repository.IPEventUpdated, repository.IPEventDeleted}, resumed)
+}
+
+func TestIpListByParentPrefixFamily(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for ip, prefix := range map[string]string{
+		"1.2.3.4":        "1.2.3.0/24",
+		"10.0.0.1":       "10.0.0.0/8",
+		"2001:db8::1":    "2001:db8::/96",
+		"::ffff:1.2.3.5": "::ffff:1.2.3.0/120",
+	} {
+		_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: ip, ParentPrefixCidr: prefix, ProjectID: "p1"})
+		require.NoError(t, err)
+	}
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "2001:db8::2", ParentPrefixCidr: "2001:db8::/96", ProjectID: "p2"})
+	require.NoError(t, err)
+
+	addresses := func(query *apiv2.IPQuery, af apiv2.IPAddressFamily) []string {
+		ips, err := repo.IP(nil).ListByParentPrefixFamily(ctx, query, af)
+		require.NoError(t, err)
+		var res []string
+		for _, ip := range ips {
+			res = append(res, ip.IPAddress)
+		}
+		return res
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "10.0.0.1"}, addresses(nil, apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4))
+	assert.ElementsMatch(t, []string{"2001:db8::1", "::ffff:1.2.3.5", "2001:db8::2"}, addresses(nil, apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6))
+	assert.ElementsMatch(t, []string{"2001:db8::1", "::ffff:1.2.3.5"}, addresses(&apiv2.IPQuery{Project: pointer.Pointer("p1")}, apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6))
+	assert.Len(t, addresses(nil, apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED), 5)
+}
+
+func TestIpListInNetworks(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", NetworkID: "internet", ProjectID: "p1", Name: "a"},
+		{IPAddress: "1.2.3.5", NetworkID: "internet", ProjectID: "p1", Name: "b"},
+		{IPAddress: "10.0.0.1", NetworkID: "storage", ProjectID: "p1", Name: "a"},
+		{IPAddress: "10.1.0.1", NetworkID: "tenant", ProjectID: "p1", Name: "a"},
+		{IPAddress: "10.0.0.2", NetworkID: "storage", ProjectID: "p2", Name: "a"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	addresses := func(project *string, query *apiv2.IPQuery, networks ...string) []string {
+		ips, err := repo.IP(project).ListInNetworks(ctx, query, networks)
+		require.NoError(t, err)
+		return ipAddresses(ips)
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5", "10.0.0.1", "10.0.0.2"}, addresses(nil, nil, "internet", "storage"))
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5", "10.0.0.1"}, addresses(pointer.Pointer("p1"), nil, "internet", "storage"))
+	assert.ElementsMatch(t, []string{"1.2.3.4", "10.0.0.1"}, addresses(pointer.Pointer("p1"), &apiv2.IPQuery{Name: pointer.Pointer("a")}, "internet", "storage"))
+	assert.ElementsMatch(t, []string{"10.0.0.1"}, addresses(pointer.Pointer("p1"), &apiv2.IPQuery{Network: pointer.Pointer("storage")}, "internet", "storage"))
+	assert.Empty(t, addresses(pointer.Pointer("p1"), &apiv2.IPQuery{Network: pointer.Pointer("tenant")}, "internet", "storage"))
+	assert.Len(t, addresses(pointer.Pointer("p1"), nil), 4)
+}
+
+func TestIpListByOwner(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	owner := func(o string) string { return tag.New(metal.TagIPOwner, o) }
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "internet", Tags: []string{owner("machine:m1"), "env=prod"}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", NetworkID: "storage", Tags: []string{owner("machine:m1")}},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", NetworkID: "internet", Tags: []string{owner("machine:m10")}},
+		{IPAddress: "1.2.3.7", ProjectID: "p1", NetworkID: "internet", Tags: []string{owner("firewall:m1")}},
+		{IPAddress: "1.2.3.8", ProjectID: "p1", NetworkID: "internet"},
+		{IPAddress: "1.2.3.9", ProjectID: "p2", NetworkID: "internet", Tags: []string{owner("machine:m1")}},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	addresses := func(project *string, query *apiv2.IPQuery, o string) []string {
+		ips, err := repo.IP(project).ListByOwner(ctx, query, o)
+		require.NoError(t, err)
+		return ipAddresses(ips)
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5", "1.2.3.9"}, addresses(nil, nil, "machine:m1"))
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5"}, addresses(pointer.Pointer("p1"), nil, "machine:m1"))
+	assert.ElementsMatch(t, []string{"1.2.3.4"}, addresses(pointer.Pointer("p1"), &apiv2.IPQuery{Network: pointer.Pointer("internet")}, "machine:m1"))
+	assert.ElementsMatch(t, []string{"1.2.3.6"}, addresses(nil, nil, "machine:m10"), "owners are matched exactly")
+	assert.ElementsMatch(t, []string{"1.2.3.7"}, addresses(nil, nil, "firewall:m1"))
+	assert.Empty(t, addresses(nil, nil, "machine:m2"))
+
+	_, err := repo.IP(nil).ListByOwner(ctx, nil, "")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestIpTagUsage(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Tags: []string{"cluster=a", "env=prod", "managed"}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Tags: []string{"cluster=a", "env=prod"}},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", Tags: []string{"cluster=b", "env=dev", "cluster=b"}},
+		{IPAddress: "1.2.3.7", ProjectID: "p1", Tags: []string{"cluster=c"}},
+		{IPAddress: "1.2.3.8", ProjectID: "p1"},
+		{IPAddress: "1.2.3.9", ProjectID: "p2", Tags: []string{"cluster=a", "other=x"}},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	usage, err := repo.IP(pointer.Pointer("p1")).TagUsage(ctx, "p1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.TagKeyUsage{
+		{Key: "cluster", Count: 4, TopValues: []repository.TagValueCount{{Value: "a", Count: 2}, {Value: "b", Count: 1}, {Value: "c", Count: 1}}},
+		{Key: "env", Count: 3, TopValues: []repository.TagValueCount{{Value: "prod", Count: 2}, {Value: "dev", Count: 1}}},
+		{Key: "managed", Count: 1, TopValues: []repository.TagValueCount{{Value: "", Count: 1}}},
+	}, usage)
+
+	usage, err = repo.IP(nil).TagUsage(ctx, "p1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.TagKeyUsage{
+		{Key: "cluster", Count: 4, TopValues: []repository.TagValueCount{{Value: "a", Count: 2}}},
+		{Key: "env", Count: 3, TopValues: []repository.TagValueCount{{Value: "prod", Count: 2}}},
+		{Key: "managed", Count: 1, TopValues: []repository.TagValueCount{{Value: "", Count: 1}}},
+	}, usage)
+
+	usage, err = repo.IP(pointer.Pointer("p2")).TagUsage(ctx, "p1", 0)
+	require.NoError(t, err)
+	assert.Empty(t, usage)
+
+	_, err = repo.IP(pointer.Pointer("p1")).TagUsage(ctx, "p1", -1)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestIpAgeReport(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	now := time.Now()
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.1", ProjectID: "p1", Created: now.Add(-time.Minute)},
+		{IPAddress: "1.2.3.2", ProjectID: "p1", Created: now.Add(-59 * time.Minute)},
+		{IPAddress: "1.2.3.3", ProjectID: "p1", Created: now.Add(-2 * time.Hour)},
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Created: now.Add(-3 * 24 * time.Hour)},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Created: now.Add(-29 * 24 * time.Hour)},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", Created: now.Add(-29 * 24 * time.Hour)},
+		{IPAddress: "1.2.3.7", ProjectID: "p1", Created: now.Add(-365 * 24 * time.Hour)},
+		{IPAddress: "1.2.3.8", ProjectID: "p2", Created: now.Add(-365 * 24 * time.Hour)},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	counts := func(buckets []repository.IPAgeBucket) map[string]int {
+		res := map[string]int{}
+		for _, b := range buckets {
+			res[b.Name] = b.Count
+		}
+		return res
+	}
+
+	buckets, err := repo.IP(pointer.Pointer("p1")).AgeReport(ctx, "p1")
+	require.NoError(t, err)
+	require.Len(t, buckets, 4)
+	assert.Equal(t, map[string]int{"<1h": 2, "1h-1d": 1, "1d-30d": 3, ">30d": 1}, counts(buckets))
+
+	buckets, err = repo.IP(nil).AgeReport(ctx, "p2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"<1h": 0, "1h-1d": 0, "1d-30d": 0, ">30d": 1}, counts(buckets))
+
+	buckets, err = repo.IP(pointer.Pointer("p2")).AgeReport(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"<1h": 0, "1h-1d": 0, "1d-30d": 0, ">30d": 0}, counts(buckets))
+}
+
+func TestIpListNetworks(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", NetworkID: "internet", ProjectID: "p1"},
+		{IPAddress: "1.2.3.5", NetworkID: "internet", ProjectID: "p1"},
+		{IPAddress: "10.0.0.1", NetworkID: "tenant-a", ProjectID: "p1"},
+		{IPAddress: "2001:db8::1", NetworkID: "internet-v6", ProjectID: "p1"},
+		{IPAddress: "2001:db8::2", NetworkID: "internet-v6", ProjectID: "p1"},
+		{IPAddress: "2001:db8::3", NetworkID: "internet-v6", ProjectID: "p1"},
+		{IPAddress: "10.1.0.1", NetworkID: "tenant-b", ProjectID: "p2"},
+		{IPAddress: "1.2.3.6", NetworkID: "internet", ProjectID: "p2"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	networks, err := repo.IP(nil).ListNetworks(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, []repository.NetworkIPCount{
+		{NetworkID: "internet", Count: 2},
+		{NetworkID: "internet-v6", Count: 3},
+		{NetworkID: "tenant-a", Count: 1},
+	}, networks)
+
+	networks, err = repo.IP(pointer.Pointer("p2")).ListNetworks(ctx, "p2")
+	require.NoError(t, err)
+	assert.Equal(t, []repository.NetworkIPCount{
+		{NetworkID: "internet", Count: 1},
+		{NetworkID: "tenant-b", Count: 1},
+	}, networks)
+
+	networks, err = repo.IP(pointer.Pointer("p2")).ListNetworks(ctx, "p1")
+	require.NoError(t, err)
+	assert.Empty(t, networks)
+
+	networks, err = repo.IP(nil).ListNetworks(ctx, "p3")
+	require.NoError(t, err)
+	assert.Empty(t, networks)
+}
+
+func TestIpCountByNetworkAndType(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "1.2.3.5", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "1.2.3.7", NetworkID: "internet", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "10.0.0.1", NetworkID: "tenant-a", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "2001:db8::1", NetworkID: "internet-v6", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "10.1.0.1", NetworkID: "tenant-b", ProjectID: "p2", Type: metal.Static},
+		{IPAddress: "1.2.3.6", NetworkID: "internet", ProjectID: "p2", Type: metal.Ephemeral},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	counts, err := repo.IP(nil).CountByNetworkAndType(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, []repository.NetworkIPTypeCount{
+		{NetworkID: "internet", Ephemeral: 2, Static: 1},
+		{NetworkID: "internet-v6", Ephemeral: 1},
+		{NetworkID: "tenant-a", Static: 1},
+	}, counts)
+
+	counts, err = repo.IP(pointer.Pointer("p2")).CountByNetworkAndType(ctx, "p2")
+	require.NoError(t, err)
+	assert.Equal(t, []repository.NetworkIPTypeCount{
+		{NetworkID: "internet", Ephemeral: 1},
+		{NetworkID: "tenant-b", Static: 1},
+	}, counts)
+
+	counts, err = repo.IP(pointer.Pointer("p2")).CountByNetworkAndType(ctx, "p1")
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func TestIpListOldestEphemeral(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	now := time.Now()
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral, Created: now.Add(-1 * time.Hour)},
+		{IPAddress: "1.2.3.5", NetworkID: "internet", ProjectID: "p2", Type: metal.Ephemeral, Created: now.Add(-3 * time.Hour)},
+		{IPAddress: "1.2.3.6", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral, Created: now.Add(-2 * time.Hour), Tags: []string{tag.New(tag.MachineID, "m1")}},
+		{IPAddress: "1.2.3.7", NetworkID: "internet", ProjectID: "p1", Type: metal.Static, Created: now.Add(-4 * time.Hour)},
+		{IPAddress: "10.0.0.1", NetworkID: "tenant", ProjectID: "p1", Type: metal.Ephemeral, Created: now.Add(-6 * time.Hour)},
+		{IPAddress: "1.2.3.9", NetworkID: "internet", ProjectID: "p1", Type: metal.Ephemeral, Created: now.Add(-30 * time.Minute), Tags: []string{"purpose=test"}},
+	} {
+		// upsert keeps the creation timestamp
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	ips, err := repo.IP(nil).ListOldestEphemeral(ctx, "internet", false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.5", "1.2.3.6", "1.2.3.4", "1.2.3.9"}, ipAddresses(ips))
+
+	ips, err = repo.IP(nil).ListOldestEphemeral(ctx, "internet", true, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.5", "1.2.3.4", "1.2.3.9"}, ipAddresses(ips))
+
+	ips, err = repo.IP(nil).ListOldestEphemeral(ctx, "internet", true, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.5", "1.2.3.4"}, ipAddresses(ips))
+
+	ips, err = repo.IP(pointer.Pointer("p1")).ListOldestEphemeral(ctx, "internet", false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.6", "1.2.3.4", "1.2.3.9"}, ipAddresses(ips))
+
+	_, err = repo.IP(nil).ListOldestEphemeral(ctx, "internet", false, -1)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestIpPrefixDrift(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "1.2.1.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"10.0.1.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("storage"), Prefixes: []string{"10.1.0.0/24"}})
+	require.NoError(t, err)
+
+	for _, ip := range []*metal.IP{
+		// one of three drifted
+		{IPAddress: "1.2.0.1", ParentPrefixCidr: "1.2.0.0/24", NetworkID: "internet"},
+		{IPAddress: "1.2.1.1", ParentPrefixCidr: "1.2.1.0/24", NetworkID: "internet"},
+		{IPAddress: "1.2.2.1", ParentPrefixCidr: "1.2.2.0/24", NetworkID: "internet"},
+		// all drifted, the prefix of the network was replaced
+		{IPAddress: "10.0.0.1", ParentPrefixCidr: "10.0.0.0/24", NetworkID: "tenant"},
+		{IPAddress: "10.0.0.2", ParentPrefixCidr: "10.0.0.0/24", NetworkID: "tenant"},
+		{IPAddress: "10.0.2.1", ParentPrefixCidr: "10.0.2.0/24", NetworkID: "tenant"},
+		// no drift
+		{IPAddress: "10.1.0.1", ParentPrefixCidr: "10.1.0.0/24", NetworkID: "storage"},
+		// the network is gone
+		{IPAddress: "10.2.0.1", ParentPrefixCidr: "10.2.0.0/24", NetworkID: "gone"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	drift, err := repo.IP(nil).PrefixDrift(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.NetworkPrefixDrift{
+		{NetworkID: "tenant", Total: 3, Drifted: 3, StalePrefixes: []string{"10.0.0.0/24", "10.0.2.0/24"}},
+		{NetworkID: "gone", Total: 1, Drifted: 1, StalePrefixes: []string{"10.2.0.0/24"}},
+		{NetworkID: "internet", Total: 3, Drifted: 1, StalePrefixes: []string{"1.2.2.0/24"}},
+	}, drift)
+
+	_, err = repo.IP(pointer.Pointer("p1")).PrefixDrift(ctx)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestIpListByUUIDs(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	var uuids []string
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1"},
+		{IPAddress: "1.2.3.5", ProjectID: "p2"},
+		{IPAddress: "1.2.3.6", ProjectID: "p2"},
+	} {
+		ip.AllocationUUID = uuid.NewString()
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+		uuids = append(uuids, ip.AllocationUUID)
+	}
+
+	ips, err := repo.IP(nil).ListByUUIDs(ctx, []string{uuids[0], uuids[2], uuid.NewString(), "unknown"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.6"}, ipAddresses(ips))
+
+	ips, err = repo.IP(pointer.Pointer("p2")).ListByUUIDs(ctx, uuids)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.3.5", "1.2.3.6"}, ipAddresses(ips))
+
+	ips, err = repo.IP(nil).ListByUUIDs(ctx, []string{uuid.NewString()})
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+
+	ips, err = repo.IP(nil).ListByUUIDs(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestIpCreateForMachine(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("leased"),
+		Prefixes: []string{"1.3.0.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelMachineIPLease: "24h"},
+	})
+	require.NoError(t, err)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1")})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{tag.New(tag.MachineID, "m1"), tag.New(metal.TagIPOwner, "machine:m1")}, ip.Tags)
+
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "leased", Project: "p1", MachineId: pointer.Pointer("m2")})
+	require.NoError(t, err)
+	tm := tag.NewTagMap(ip.Tags)
+	owner, _ := tm.Value(metal.TagIPOwner)
+	assert.Equal(t, "machine:m2", owner)
+	value, ok := tm.Value(metal.TagIPLeaseExpiry)
+	require.True(t, ok)
+	expiry, err := time.Parse(time.RFC3339, value)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), expiry, time.Minute)
+
+	// ips which are not created for a machine have no owner and no lease
+	ip, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "leased", Project: "p1"})
+	require.NoError(t, err)
+	assert.Empty(t, ip.Tags)
+
+	// expired leases are reported
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.3.0.100", ProjectID: "p1", Tags: []string{
+		tag.New(metal.TagIPOwner, "machine:m3"),
+		tag.New(metal.TagIPLeaseExpiry, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)),
+	}})
+	require.NoError(t, err)
+
+	issues, err := repo.IP(pointer.Pointer("p1")).Issues(ctx)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "1.3.0.100", issues[0].IP.IPAddress)
+	assert.Contains(t, issues[0].Description, `ip lease of owner "machine:m3" expired at`)
+}
+
+func TestIpRefreshLease(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("leased"),
+		Prefixes: []string{"1.3.0.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelMachineIPLease: "24h"},
+	})
+	require.NoError(t, err)
+
+	leased, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "leased", Project: "p1", MachineId: pointer.Pointer("m1")})
+	require.NoError(t, err)
+	unleased, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "leased", Project: "p1"})
+	require.NoError(t, err)
+
+	expireIn := func(d time.Duration) {
+		got, err := ds.IP().Get(ctx, leased.IPAddress)
+		require.NoError(t, err)
+		var tags []string
+		for _, tg := range got.Tags {
+			if !strings.HasPrefix(tg, metal.TagIPLeaseExpiry+"=") {
+				tags = append(tags, tg)
+			}
+		}
+		got.Tags = append(tags, tag.New(metal.TagIPLeaseExpiry, time.Now().Add(d).UTC().Format(time.RFC3339)))
+		require.NoError(t, ds.IP().Upsert(ctx, got))
+	}
+	expiry := func(ip *metal.IP) time.Time {
+		value, ok := tag.NewTagMap(ip.Tags).Value(metal.TagIPLeaseExpiry)
+		require.True(t, ok)
+		expiry, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return expiry
+	}
+
+	expireIn(time.Hour)
+	refreshed, err := repo.IP(pointer.Pointer("p1")).RefreshLease(ctx, leased.IPAddress)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), expiry(refreshed), time.Minute)
+	assert.Len(t, refreshed.Tags, len(leased.Tags))
+
+	got, err := repo.IP(pointer.Pointer("p1")).Get(ctx, leased.IPAddress)
+	require.NoError(t, err)
+	assert.Equal(t, expiry(refreshed), expiry(got))
+
+	_, err = repo.IP(pointer.Pointer("p2")).RefreshLease(ctx, leased.IPAddress)
+	require.True(t, generic.IsNotFound(err))
+	_, err = repo.IP(pointer.Pointer("p1")).RefreshLease(ctx, unleased.IPAddress)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// an expired lease is not refreshed
+	expireIn(-time.Minute)
+	_, err = repo.IP(pointer.Pointer("p1")).RefreshLease(ctx, leased.IPAddress)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "it must be allocated again")
+
+	got, err = repo.IP(pointer.Pointer("p1")).Get(ctx, leased.IPAddress)
+	require.NoError(t, err)
+	assert.True(t, expiry(got).Before(time.Now()))
+}
+
+func TestIpRetryFailedReleases(t *testing.T) {
+	ctx := context.Background()
+	var failReleases atomic.Int32
+	repo, ds, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: &fakeIpam{
+		releaseIP: func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.ReleaseIPRequest]) (*connect.Response[ipamv1.ReleaseIPResponse], error) {
+			if failReleases.Add(-1) >= 0 {
+				return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("ipam is unavailable"))
+			}
+			return ipam.ReleaseIP(ctx, req)
+		},
+	}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+
+	failReleases.Store(1)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, ip)
+	require.NoError(t, err)
+
+	var failed []repository.FailedIPRelease
+	require.Eventually(t, func() bool {
+		failed, err = repo.IP(nil).FailedReleases(ctx)
+		require.NoError(t, err)
+		return len(failed) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, ip.IPAddress, failed[0].IP)
+	assert.Equal(t, ip.AllocationUUID, failed[0].AllocationUUID)
+	assert.Equal(t, "1.2.0.0/24", failed[0].ParentPrefixCidr)
+	assert.Contains(t, failed[0].Error, "ipam is unavailable")
+
+	_, err = repo.IP(pointer.Pointer("p1")).FailedReleases(ctx)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// the ip is still recorded as the release in ipam failed
+	_, err = ds.IP().Get(ctx, ip.IPAddress)
+	require.NoError(t, err)
+
+	stillFailing, err := repo.IP(nil).RetryFailedReleases(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, stillFailing)
+
+	_, err = ds.IP().Get(ctx, ip.IPAddress)
+	require.True(t, generic.IsNotFound(err), "expected not found, got %v", err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: &ip.IPAddress}))
+	require.NoError(t, err)
+}
+
+func TestIpCreateWithAllocationTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:    "allocation takes longer than the timeout",
+			timeout: 20 * time.Millisecond,
+			wantErr: "allocation of ip in network:internet took longer than 20ms",
+		},
+		{
+			name:    "allocation within the timeout",
+			timeout: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{
+				ipam: &fakeIpam{
+					acquireIP: func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.AcquireIPRequest]) (*connect.Response[ipamv1.AcquireIPResponse], error) {
+						select {
+						case <-ctx.Done():
+							return nil, connect.NewError(connect.CodeDeadlineExceeded, ctx.Err())
+						case <-time.After(200 * time.Millisecond):
+						}
+						return ipam.AcquireIP(ctx, req)
+					},
+				},
+				config: repository.Config{AllocationTimeout: tt.timeout},
+			}, testProject("p1"))
+			defer cleanup()
+
+			_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+			require.NoError(t, err)
+
+			start := time.Now()
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, connect.CodeDeadlineExceeded, connect.CodeOf(err))
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Less(t, time.Since(start), 200*time.Millisecond)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "1.2.0.1", ip.IPAddress)
+		})
+	}
+}
+
+func TestIpPromoteToStatic(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("ephemeral"),
+		Prefixes: []string{"1.3.0.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelEphemeralOnly: "true"},
+	})
+	require.NoError(t, err)
+
+	create := func(rq *apiv2.IPServiceCreateRequest) *metal.IP {
+		ip, err := repo.IP(&rq.Project).Create(ctx, rq)
+		require.NoError(t, err)
+		return ip
+	}
+
+	ephemeral := create(&apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+	static := create(&apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum()})
+	firewall := create(&apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum(), Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")}})
+	ephemeralOnly := create(&apiv2.IPServiceCreateRequest{Network: "ephemeral", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+	otherProject := create(&apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+
+	promotion, err := repo.IP(nil).PromoteToStatic(ctx, &apiv2.IPQuery{Project: pointer.Pointer("p1")}, "topology change")
+	require.NoError(t, err)
+
+	require.Len(t, promotion.Promoted, 1)
+	assert.Equal(t, ephemeral.IPAddress, promotion.Promoted[0].IPAddress)
+	assert.Equal(t, metal.Static, promotion.Promoted[0].Type)
+	assert.Equal(t, "topology change", promotion.Promoted[0].StaticReason)
+
+	require.Len(t, promotion.Refused, 3)
+	assert.Equal(t, "ip is already static", promotion.Refused[static.IPAddress])
+	assert.Contains(t, promotion.Refused[firewall.IPAddress], "must be of type ephemeral")
+	assert.Contains(t, promotion.Refused[ephemeralOnly.IPAddress], "network:ephemeral only allows ephemeral ips")
+
+	for ip, want := range map[string]metal.IPType{
+		ephemeral.IPAddress:     metal.Static,
+		static.IPAddress:        metal.Static,
+		firewall.IPAddress:      metal.Ephemeral,
+		ephemeralOnly.IPAddress: metal.Ephemeral,
+		otherProject.IPAddress:  metal.Ephemeral,
+	} {
+		stored, err := ds.IP().Get(ctx, ip)
+		require.NoError(t, err)
+		assert.Equal(t, want, stored.Type, "ip:%s", ip)
+	}
+
+	// the scope restricts the promotion to the ips of the project
+	promotion, err = repo.IP(pointer.Pointer("p2")).PromoteToStatic(ctx, &apiv2.IPQuery{Network: pointer.Pointer("internet")}, "topology change")
+	require.NoError(t, err)
+	require.Len(t, promotion.Promoted, 1)
+	assert.Equal(t, otherProject.IPAddress, promotion.Promoted[0].IPAddress)
+	assert.Empty(t, promotion.Refused)
+}
+
+func TestIpPromoteToStaticGuards(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	machineIP, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		scope        *string
+		query        *apiv2.IPQuery
+		wantCode     connect.Code
+		wantRefused  string
+		wantPromoted bool
+	}{
+		{
+			name:     "without query",
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "with empty query",
+			query:    &apiv2.IPQuery{},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:        "machine ip by a user",
+			scope:       pointer.Pointer("p1"),
+			query:       &apiv2.IPQuery{Ip: &machineIP.IPAddress},
+			wantRefused: "ips of machines can not be made static, they are released together with the machine",
+		},
+		{
+			name:         "machine ip by an admin",
+			query:        &apiv2.IPQuery{Ip: &machineIP.IPAddress},
+			wantPromoted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promotion, err := repo.IP(tt.scope).PromoteToStatic(ctx, tt.query, "topology change")
+			if tt.wantCode != 0 {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.wantRefused != "" {
+				assert.Empty(t, promotion.Promoted)
+				assert.Equal(t, map[string]string{machineIP.IPAddress: tt.wantRefused}, promotion.Refused)
+			}
+			if tt.wantPromoted {
+				require.Len(t, promotion.Promoted, 1)
+				assert.Empty(t, promotion.Refused)
+			}
+
+			stored, err := ds.IP().Get(ctx, machineIP.IPAddress)
+			require.NoError(t, err)
+			if tt.wantPromoted {
+				assert.Equal(t, metal.Static, stored.Type)
+			} else {
+				assert.Equal(t, metal.Ephemeral, stored.Type)
+			}
+		})
+	}
+}
+
+func TestIpStaticReason(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Tags: []string{"a=b"}})
+	require.NoError(t, err)
+	promotion, err := repo.IP(nil).PromoteToStatic(ctx, &apiv2.IPQuery{Ip: &ip.IPAddress}, "dns entry")
+	require.NoError(t, err)
+	require.Len(t, promotion.Promoted, 1)
+	assert.Equal(t, "dns entry", promotion.Promoted[0].StaticReason)
+
+	// the reason persists through updates
+	ip, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: ip.IPAddress, Project: "p1", Name: pointer.Pointer("renamed"), Tags: []string{"c=d"}})
+	require.NoError(t, err)
+	assert.Equal(t, "dns entry", ip.StaticReason)
+
+	stored, err := ds.IP().Get(ctx, ip.IPAddress)
+	require.NoError(t, err)
+	assert.Equal(t, "dns entry", stored.StaticReason)
+	assert.Equal(t, []string{"c=d"}, stored.Tags)
+
+	// the api has no field for the reason, it is not returned as tag either
+	converted, err := repo.IP(pointer.Pointer("p1")).ConvertToProto(stored)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c=d"}, converted.Tags)
+
+	// an ephemeral ip has no reason to be static
+	ip, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: ip.IPAddress, Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL.Enum()})
+	require.NoError(t, err)
+	assert.Empty(t, ip.StaticReason)
+}
+
+func TestIpReservedTags(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	existing, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum(), Tags: []string{"a=b"}})
+	require.NoError(t, err)
+
+	for _, reserved := range []string{
+		tag.New(metal.TagIPStaticReason, "dns entry"),
+		tag.New(metal.TagIPAllocationMethod, string(metal.AllocationMethodSpecific)),
+		tag.New(metal.TagIPChargeable, "false"),
+		tag.New(metal.TagIPTransferTarget, "p2"),
+	} {
+		t.Run(reserved, func(t *testing.T) {
+			_, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum(), Tags: []string{"a=b", reserved}})
+			require.Error(t, err)
+			assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+			_, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: existing.IPAddress, Project: "p1", Tags: []string{reserved}})
+			require.Error(t, err)
+			assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+			stored, err := ds.IP().Get(ctx, existing.IPAddress)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"a=b"}, stored.Tags)
+		})
+	}
+}
+
+func TestIpInternalTagVisibility(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	var (
+		machine = tag.New(tag.MachineID, "m1")
+		owner   = tag.New(metal.TagIPOwner, "machine:m1")
+		lease   = tag.New(metal.TagIPLeaseExpiry, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	)
+
+	ip, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "internet", Type: metal.Ephemeral, Tags: []string{"a=b", machine, owner, lease}})
+	require.NoError(t, err)
+
+	user, err := repo.IP(pointer.Pointer("p1")).ConvertToProto(ip)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=b"}, user.Tags)
+
+	admin, err := repo.IP(nil).ConvertToProto(ip)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=b", machine, owner, lease}, admin.Tags)
+	assert.Equal(t, []string{"a=b", machine, owner, lease}, ip.Tags, "the stored tags are not modified")
+
+	// users can neither remove nor change the internal tags they do not see
+	updated, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: ip.IPAddress, Project: "p1", Tags: []string{"c=d", tag.New(tag.MachineID, "m2")}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c=d", machine, owner, lease}, updated.Tags)
+
+	user, err = repo.IP(pointer.Pointer("p1")).ConvertToProto(updated)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c=d"}, user.Tags)
+}
+
+func TestIpNormalizeIPAddresses(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	created := time.Now().Add(-time.Hour)
+	for _, ip := range []*metal.IP{
+		{IPAddress: "2001:DB8::1", ProjectID: "p1", Name: "upper"},
+		{IPAddress: "2001:0db8:0000:0000:0000:0000:0000:0002", ProjectID: "p1", Name: "expanded", Created: created},
+		{IPAddress: "2001:db8::3", ProjectID: "p1", Name: "canonical"},
+		{IPAddress: "2001:db8::4", ProjectID: "p1", Name: "existing"},
+		{IPAddress: "2001:DB8::4", ProjectID: "p1", Name: "duplicate"},
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Name: "v4"},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	_, err := repo.IP(pointer.Pointer("p1")).NormalizeIPAddresses(ctx)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	normalized, err := repo.IP(nil).NormalizeIPAddresses(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []repository.IPAddressNormalization{
+		{From: "2001:DB8::1", To: "2001:db8::1"},
+		{From: "2001:0db8:0000:0000:0000:0000:0000:0002", To: "2001:db8::2"},
+		{From: "2001:DB8::4", To: "2001:db8::4", Conflict: true},
+	}, normalized)
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "2001:db8::4", "2001:DB8::4", "1.2.3.4"}, ipAddresses(ips))
+
+	expanded, err := ds.IP().Get(ctx, "2001:db8::2")
+	require.NoError(t, err)
+	assert.Equal(t, "expanded", expanded.Name)
+	assert.WithinDuration(t, created, expanded.Created, time.Second, "the ip keeps its creation date")
+
+	existing, err := ds.IP().Get(ctx, "2001:db8::4")
+	require.NoError(t, err)
+	assert.Equal(t, "existing", existing.Name, "a conflicting ip is not overwritten")
+
+	// normalizing again does not change anything but the conflict
+	normalized, err = repo.IP(nil).NormalizeIPAddresses(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPAddressNormalization{{From: "2001:DB8::4", To: "2001:db8::4", Conflict: true}}, normalized)
+}
+
+func TestIpNormalizeIPAddressesRollback(t *testing.T) {
+	ctx := context.Background()
+	executor := &failingExecutor{failOnDelete: 1}
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{executor: executor}, testProject("p1"))
+	defer cleanup()
+
+	require.NoError(t, ds.IP().Upsert(ctx, &metal.IP{IPAddress: "2001:DB8::1", ProjectID: "p1", Name: "upper"}))
+
+	_, err := repo.IP(nil).NormalizeIPAddresses(ctx)
+	require.Error(t, err)
+	require.Equal(t, 2, executor.deletes, "the normalized copy must have been removed again")
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2001:DB8::1"}, ipAddresses(ips))
+}
+
+func TestIpCreateWithTags(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{
+		Network: "internet",
+		Project: "p1",
+		Tags: []string{
+			tag.New(tag.ClusterServiceFQN, "default/ingress"),
+			"purpose=loadbalancer",
+			"cost-center=42",
+			"purpose=ingress",
+			"pinned",
+			"cost-center=42",
+		},
+	})
+	require.NoError(t, err)
+
+	want := []string{
+		tag.New(tag.ClusterServiceFQN, "default/ingress"),
+		"purpose=ingress",
+		"cost-center=42",
+		"pinned",
+	}
+	assert.Equal(t, want, created.Tags)
+
+	// the stored row carries all tags from the start, there is no update after the insert
+	stored, err := ds.IP().Get(ctx, created.IPAddress)
+	require.NoError(t, err)
+	assert.Equal(t, want, stored.Tags)
+	assert.Equal(t, stored.Created, stored.Changed)
+
+	updated, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Tags: []string{"purpose=a", "purpose=b"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"purpose=b"}, updated.Tags)
+}
+
+func TestIpNameAndDescriptionLength(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{LengthLimits: validate.LengthLimits{Name: 8, Description: 16}}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Name: pointer.Pointer(strings.Repeat("n", 8)), Description: pointer.Pointer(strings.Repeat("d", 16))})
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("n", 8), created.Name)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Name: pointer.Pointer(strings.Repeat("n", 9))})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "name must not be longer than 8 characters but has 9")
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Description: pointer.Pointer(strings.Repeat("d", 17))})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	_, err = repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Description: pointer.Pointer(strings.Repeat("d", 17))})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "description must not be longer than 16 characters but has 17")
+
+	updated, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Name: pointer.Pointer(strings.Repeat("m", 8))})
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("m", 8), updated.Name)
+}
+
+func TestIpUpdateIf(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Tags: []string{"state=pending", "owner=team-a"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		precondition repository.IPTagPrecondition
+		wantErr      string
+	}{
+		{
+			name:         "required tag with other value",
+			precondition: repository.IPTagPrecondition{Required: []string{"state=ready"}},
+			wantErr:      "ip:" + created.IPAddress + " does not have the required tag state=ready",
+		},
+		{
+			name:         "required key missing",
+			precondition: repository.IPTagPrecondition{Required: []string{"state", "locked"}},
+			wantErr:      "ip:" + created.IPAddress + " does not have the required tag locked",
+		},
+		{
+			name:         "forbidden tag present",
+			precondition: repository.IPTagPrecondition{Required: []string{"state=pending"}, Forbidden: []string{"owner=team-a"}},
+			wantErr:      "ip:" + created.IPAddress + " has the forbidden tag owner=team-a",
+		},
+		{
+			name:         "forbidden key present",
+			precondition: repository.IPTagPrecondition{Forbidden: []string{"owner"}},
+			wantErr:      "ip:" + created.IPAddress + " has the forbidden tag owner",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := repo.IP(pointer.Pointer("p1")).UpdateIf(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Tags: []string{"state=ready"}}, tt.precondition)
+			require.Error(t, err)
+			assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	// a violated precondition does not change the ip
+	unchanged, err := repo.IP(pointer.Pointer("p1")).Get(ctx, created.IPAddress)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"state=pending", "owner=team-a"}, unchanged.Tags)
+
+	updated, err := repo.IP(pointer.Pointer("p1")).UpdateIf(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Tags: []string{"state=ready", "owner=team-a"}},
+		repository.IPTagPrecondition{Required: []string{"state=pending", "owner"}, Forbidden: []string{"state=ready", "locked"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"state=ready", "owner=team-a"}, updated.Tags)
+
+	// the transition is only done once
+	_, err = repo.IP(pointer.Pointer("p1")).UpdateIf(ctx, &apiv2.IPServiceUpdateRequest{Ip: created.IPAddress, Project: "p1", Tags: []string{"state=ready", "owner=team-a"}},
+		repository.IPTagPrecondition{Required: []string{"state=pending"}})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestIpUpdateAtomic(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{
+		Id:       pointer.Pointer("internet"),
+		Prefixes: []string{"1.2.0.0/24"},
+		Labels:   map[string]string{metal.NetworkLabelEphemeralOnly: "true"},
+	})
+	require.NoError(t, err)
+
+	created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{
+		Network:     "internet",
+		Project:     "p1",
+		Name:        pointer.Pointer("old-name"),
+		Description: pointer.Pointer("old description"),
+		Tags:        []string{"a=b"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		typ      apiv2.IPType
+		wantCode connect.Code
+	}{
+		{
+			name:     "unspecified type",
+			typ:      apiv2.IPType_IP_TYPE_UNSPECIFIED,
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "unknown type",
+			typ:      apiv2.IPType(42),
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "type not allowed in network",
+			typ:      apiv2.IPType_IP_TYPE_STATIC,
+			wantCode: connect.CodeFailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{
+				Ip:          created.IPAddress,
+				Project:     "p1",
+				Name:        pointer.Pointer("new-name"),
+				Description: pointer.Pointer("new description"),
+				Type:        &tt.typ,
+				Tags:        []string{"c=d"},
+			})
+			require.Error(t, err)
+			assert.Equal(t, tt.wantCode, connect.CodeOf(err))
+
+			// none of the valid fields was persisted
+			stored, err := ds.IP().Get(ctx, created.IPAddress)
+			require.NoError(t, err)
+			assert.Equal(t, "old-name", stored.Name)
+			assert.Equal(t, "old description", stored.Description)
+			assert.Equal(t, []string{"a=b"}, stored.Tags)
+			assert.Equal(t, metal.Ephemeral, stored.Type)
+		})
+	}
+
+	updated, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{
+		Ip:          created.IPAddress,
+		Project:     "p1",
+		Name:        pointer.Pointer("new-name"),
+		Description: pointer.Pointer("new description"),
+		Type:        apiv2.IPType_IP_TYPE_EPHEMERAL.Enum(),
+		Tags:        []string{"c=d"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "new-name", updated.Name)
+	assert.Equal(t, "new description", updated.Description)
+	assert.Equal(t, []string{"c=d"}, updated.Tags)
+	assert.Equal(t, metal.Ephemeral, updated.Type)
+}
+
+func TestIpCreateWithNetworkCache(t *testing.T) {
+	ctx := context.Background()
+	ttl := 500 * time.Millisecond
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{NetworkCacheTTL: ttl}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func() error {
+		_, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		return err
+	}
+
+	require.NoError(t, create())
+	cachedAt := time.Now()
+
+	// the network is changed behind the back of the repository, repeated lookups are served from the cache
+	old, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	readOnly := *old
+	readOnly.Labels = map[string]string{metal.NetworkLabelReadOnly: "true"}
+	require.NoError(t, ds.Network().Update(ctx, &readOnly, old))
+
+	require.NoError(t, create())
+	require.NoError(t, create())
+	require.Less(t, time.Since(cachedAt), ttl, "test took too long to assert the cached network")
+
+	// after the ttl the network is fetched again
+	time.Sleep(ttl)
+	err = create()
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// changes through the repository invalidate the cache immediately
+	old, err = ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	writable := *old
+	writable.Labels = nil
+	require.NoError(t, ds.Network().Update(ctx, &writable, old))
+	time.Sleep(ttl)
+	require.NoError(t, create())
+
+	_, err = repo.IP(nil).ReserveIP(ctx, "internet", "1.2.0.100")
+	require.NoError(t, err)
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.100")})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestIpCreateRecordsAllocationMethod(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	random, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	specific, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	for ip, want := range map[string]metal.IPAllocationMethod{
+		random.IPAddress:   metal.AllocationMethodRandom,
+		specific.IPAddress: metal.AllocationMethodSpecific,
+	} {
+		stored, err := ds.IP().Get(ctx, ip)
+		require.NoError(t, err)
+		assert.Equal(t, want, stored.AllocationMethod)
+		assert.Empty(t, stored.Tags)
+	}
+
+	// updates keep the allocation method
+	updated, err := repo.IP(pointer.Pointer("p1")).Update(ctx, &apiv2.IPServiceUpdateRequest{Ip: random.IPAddress, Project: "p1", Name: pointer.Pointer("renamed")})
+	require.NoError(t, err)
+	assert.Equal(t, metal.AllocationMethodRandom, updated.AllocationMethod)
+}
+
+func TestIpChargeable(t *testing.T) {
+	ips := []*metal.IP{
+		{IPAddress: "1.2.0.1", Type: metal.Static, NetworkID: "internet", ProjectID: "p1"},
+		{IPAddress: "1.2.0.2", Type: metal.Ephemeral, NetworkID: "internet", ProjectID: "p1"},
+		{IPAddress: "10.0.0.1", Type: metal.Static, NetworkID: "tenant-network", ProjectID: "p1"},
+	}
+
+	tests := []struct {
+		name string
+		rule metal.ChargeableRule
+		want []bool
+	}{
+		{
+			name: "without a rule no ip is chargeable",
+			want: []bool{false, false, false},
+		},
+		{
+			name: "static ips of the internet",
+			rule: metal.ChargeableRule{Types: []metal.IPType{metal.Static}, Networks: []string{"internet"}},
+			want: []bool{true, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{ChargeableRule: tt.rule}})
+			defer cleanup()
+
+			for i, ip := range ips {
+				assert.Equal(t, tt.want[i], repo.IP(pointer.Pointer("p1")).Chargeable(ip), ip.IPAddress)
+			}
+		})
+	}
+}
+
+func TestIpCreateSpecificConcurrently(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		errs  = make([]error, 2)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			project := []string{"p1", "p2"}[i]
+			_, errs[i] = repo.IP(&project).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project, Ip: pointer.Pointer("1.2.0.5")})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var succeeded int
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+	}
+	assert.Equal(t, 1, succeeded)
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "1.2.0.5", ips[0].IPAddress)
+}
+
+func TestIpCreateWithMalformedIpamResponse(t *testing.T) {
+	ctx := context.Background()
+	// ipam acknowledges ip acquisitions without returning the acquired ip
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: &fakeIpam{
+		acquireIP: func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.AcquireIPRequest]) (*connect.Response[ipamv1.AcquireIPResponse], error) {
+			return connect.NewResponse(&ipamv1.AcquireIPResponse{}), nil
+		},
+	}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		rq   *apiv2.IPServiceCreateRequest
+	}{
+		{
+			name: "random ip",
+			rq:   &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"},
+		},
+		{
+			name: "specific ip",
+			rq:   &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NotPanics(t, func() {
+				_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, tt.rq)
+			})
+			require.Error(t, err)
+			assert.Equal(t, connect.CodeInternal, connect.CodeOf(err))
+			assert.ErrorContains(t, err, "ipam returned no ip for prefix:1.2.0.0/24")
+		})
+	}
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestIpCreateSpecificRejectedByIpam(t *testing.T) {
+	ctx := context.Background()
+	// ipam rejects every specific ip as invalid, like it does with an address it can not parse
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: &fakeIpam{
+		acquireIP: func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.AcquireIPRequest]) (*connect.Response[ipamv1.AcquireIPResponse], error) {
+			if req.Msg.Ip != nil {
+				return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip %q", *req.Msg.Ip))
+			}
+			return ipam.AcquireIP(ctx, req)
+		},
+	}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5")})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	assert.ErrorContains(t, err, `ip:1.2.0.5 was rejected by ipam: unable to parse ip "1.2.0.5"`)
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+
+	// random allocations are not affected
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.1", ip.IPAddress)
+}
+
+// slowProjects delays the project lookups.
+type slowProjects struct {
+	mdmv1.ProjectServiceClient
+	delay time.Duration
+}
+
+func (s *slowProjects) Get(ctx context.Context, in *mdmv1.ProjectGetRequest, opts ...grpc.CallOption) (*mdmv1.ProjectResponse, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	return s.ProjectServiceClient.Get(ctx, in, opts...)
+}
+
+func TestIpCreateWithProjectLookupTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:    "lookup takes longer than the timeout",
+			timeout: 20 * time.Millisecond,
+			wantErr: "lookup of project:p1 took longer than 20ms",
+		},
+		{
+			name:    "lookup within the timeout",
+			timeout: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{projectDelay: 200 * time.Millisecond, config: repository.Config{ProjectLookupTimeout: tt.timeout}}, testProject("p1"))
+			defer cleanup()
+
+			_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+			require.NoError(t, err)
+
+			start := time.Now()
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, connect.CodeDeadlineExceeded, connect.CodeOf(err))
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Less(t, time.Since(start), 200*time.Millisecond)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "1.2.0.1", ip.IPAddress)
+		})
+	}
+}
+
+func testProject(id string) *mdmv1.Project {
+	return &mdmv1.Project{
+		Meta: &mdmv1.Meta{Id: id},
+	}
+}
+
+func ipAddresses(ips []*metal.IP) []string {
+	var res []string
+	for _, ip := range ips {
+		res = append(res, ip.IPAddress)
+	}
+	return res
+}
+
+type ipRepositoryOpts struct {
+	log    *slog.Logger
+	config repository.Config
+	// executor is put in front of the session of the datastore
+	executor *failingExecutor
+	// ipam is put in front of the ipam of the test, the returned ipam is the one of the test
+	ipam *fakeIpam
+	// projectDelay delays every project lookup
+	projectDelay time.Duration
+}
+
+func startIpRepository(t *testing.T, projects ...*mdmv1.Project) (*repository.Repostore, *generic.Datastore, ipamv1connect.IpamServiceClient, func()) {
+	return startIpRepositoryWithOpts(t, ipRepositoryOpts{}, projects...)
+}
+
+func startIpRepositoryWithOpts(t *testing.T, opts ipRepositoryOpts, projects ...*mdmv1.Project) (*repository.Repostore, *generic.Datastore, ipamv1connect.IpamServiceClient, func()) {
+	log := slog.Default()
+	if opts.log != nil {
+		log = opts.log
+	}
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	container, c, err := test.StartRethink(t)
+	require.NoError(t, err)
+
+	ipam := test.StartIpam(t)
+	var repoIpam ipamv1connect.IpamServiceClient = ipam
+	if opts.ipam != nil {
+		opts.ipam.IpamServiceClient = ipam
+		repoIpam = opts.ipam
+	}
+
+	var executor r.QueryExecutor = c
+	if opts.executor != nil {
+		opts.executor.Session = c
+		executor = opts.executor
+	}
+
+	ds, err := generic.New(log, "metal", executor)
+	require.NoError(t, err)
+
+	psc := mdmock.ProjectServiceClient{}
+	for _, p := range projects {
+		psc.On("Get", testifymock.Anything, &mdmv1.ProjectGetRequest{Id: p.Meta.Id}).Return(&mdmv1.ProjectResponse{Project: p}, nil)
+	}
+	psc.On("Get", testifymock.Anything, testifymock.Anything).Return(nil, fmt.Errorf("project not found"))
+	var projectClient mdmv1.ProjectServiceClient = &psc
+	if opts.projectDelay > 0 {
+		projectClient = &slowProjects{ProjectServiceClient: projectClient, delay: opts.projectDelay}
+	}
+	tsc := mdmock.TenantServiceClient{}
+	mdc := mdm.NewMock(projectClient, &tsc, nil, nil)
+
+	repo, err := repository.New(log, mdc, ds, repoIpam, rc, opts.config)
+	require.NoError(t, err)
+
+	return repo, ds, ipam, func() {
+		_ = container.Terminate(context.Background())
+	}
+}
+
+// fakeIpam records the namespace of the calls to ipam by call and prefix, the default namespace is recorded as empty.
+// The hooks replace the respective call, they are given the ipam of the test to pass the call on.
+type fakeIpam struct {
+	ipamv1connect.IpamServiceClient
+
+	acquireIP func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.AcquireIPRequest]) (*connect.Response[ipamv1.AcquireIPResponse], error)
+	releaseIP func(ctx context.Context, ipam ipamv1connect.IpamServiceClient, req *connect.Request[ipamv1.ReleaseIPRequest]) (*connect.Response[ipamv1.ReleaseIPResponse], error)
+
+	mu    sync.Mutex
+	calls map[string][]string
+}
+
+func (f *fakeIpam) record(call, prefix string, namespace *string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = map[string][]string{}
+	}
+	f.calls[call+" "+prefix] = append(f.calls[call+" "+prefix], pointer.SafeDeref(namespace))
+}
+
+// namespaces returns the namespaces of the recorded calls to the prefix.
+func (f *fakeIpam) namespaces(call, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls[call+" "+prefix])
+}
+
+// counts returns the number of recorded calls per prefix.
+func (f *fakeIpam) counts(call string) map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := map[string]int{}
+	for key, namespaces := range f.calls {
+		if prefix, ok := strings.CutPrefix(key, call+" "); ok {
+			res[prefix] = len(namespaces)
+		}
+	}
+	return res
+}
+
+func (f *fakeIpam) CreatePrefix(ctx context.Context, req *connect.Request[ipamv1.CreatePrefixRequest]) (*connect.Response[ipamv1.CreatePrefixResponse], error) {
+	f.record("create", req.Msg.Cidr, req.Msg.Namespace)
+	return f.IpamServiceClient.CreatePrefix(ctx, req)
+}
+
+func (f *fakeIpam) GetPrefix(ctx context.Context, req *connect.Request[ipamv1.GetPrefixRequest]) (*connect.Response[ipamv1.GetPrefixResponse], error) {
+	f.record("get", req.Msg.Cidr, req.Msg.Namespace)
+	return f.IpamServiceClient.GetPrefix(ctx, req)
+}
+
+func (f *fakeIpam) AcquireChildPrefix(ctx context.Context, req *connect.Request[ipamv1.AcquireChildPrefixRequest]) (*connect.Response[ipamv1.AcquireChildPrefixResponse], error) {
+	f.record("acquire-child", req.Msg.Cidr, req.Msg.Namespace)
+	return f.IpamServiceClient.AcquireChildPrefix(ctx, req)
+}
+
+func (f *fakeIpam) PrefixUsage(ctx context.Context, req *connect.Request[ipamv1.PrefixUsageRequest]) (*connect.Response[ipamv1.PrefixUsageResponse], error) {
+	f.record("usage", req.Msg.Cidr, req.Msg.Namespace)
+	return f.IpamServiceClient.PrefixUsage(ctx, req)
+}
+
+func (f *fakeIpam) AcquireIP(ctx context.Context, req *connect.Request[ipamv1.AcquireIPRequest]) (*connect.Response[ipamv1.AcquireIPResponse], error) {
+	f.record("acquire", req.Msg.PrefixCidr, req.Msg.Namespace)
+	if f.acquireIP != nil {
+		return f.acquireIP(ctx, f.IpamServiceClient, req)
+	}
+	return f.IpamServiceClient.AcquireIP(ctx, req)
+}
+
+func (f *fakeIpam) ReleaseIP(ctx context.Context, req *connect.Request[ipamv1.ReleaseIPRequest]) (*connect.Response[ipamv1.ReleaseIPResponse], error) {
+	f.record("release", req.Msg.PrefixCidr, req.Msg.Namespace)
+	if f.releaseIP != nil {
+		return f.releaseIP(ctx, f.IpamServiceClient, req)
+	}
+	return f.IpamServiceClient.ReleaseIP(ctx, req)
+}
+
+func (f *fakeIpam) Dump(ctx context.Context, req *connect.Request[ipamv1.DumpRequest]) (*connect.Response[ipamv1.DumpResponse], error) {
+	f.record("dump", "", req.Msg.Namespace)
+	return f.IpamServiceClient.Dump(ctx, req)
+}
+
+func TestIpAllocationLatencies(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, repository.AllocationLatencies{}, repo.IP(nil).AllocationLatencies())
+
+	for range 3 {
+		_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+		require.NoError(t, err)
+	}
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.1")})
+	require.Error(t, err)
+
+	latencies := repo.IP(pointer.Pointer("p1")).AllocationLatencies()
+	assert.Equal(t, 3, latencies.Count, "failed allocations are not recorded")
+	assert.Positive(t, latencies.P50)
+	assert.LessOrEqual(t, latencies.P50, latencies.P95)
+	assert.LessOrEqual(t, latencies.P95, latencies.P99)
+	assert.Equal(t, latencies, repo.IP(nil).AllocationLatencies(), "latencies are shared by all scopes")
+}
+
+func TestIpCreateWithFallback(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/64"}})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		ip       string
+		af       apiv2.IPAddressFamily
+		want     string
+		wantCode connect.Code
+	}{
+		{
+			name: "specific ip is available",
+			ip:   "1.2.0.20",
+			af:   apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4,
+			want: "1.2.0.20",
+		},
+		{
+			name: "specific ip is taken, fallback to random",
+			ip:   "1.2.0.10",
+			af:   apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4,
+			want: "1.2.0.1",
+		},
+		{
+			name: "specific v6 ip is available",
+			ip:   "2001:db8::20",
+			af:   apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6,
+			want: "2001:db8::20",
+		},
+		{
+			name:     "addressfamily does not match the ip",
+			ip:       "1.2.0.30",
+			af:       apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6,
+			wantCode: connect.CodeInvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.IP(pointer.Pointer("p1")).CreateWithFallback(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: &tt.ip, AddressFamily: tt.af.Enum()})
+			if tt.wantCode != 0 {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.IPAddress)
+		})
+	}
+
+	_, err = repo.IP(pointer.Pointer("p1")).CreateWithFallback(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.40")})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err), "the fallback addressfamily is required")
+}
+
+func TestIpRepairTags(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.1", ProjectID: "p1", Type: metal.Static, Tags: []string{"a=1", "b=2"}},
+		{IPAddress: "1.2.3.2", ProjectID: "p1", Type: metal.Static, Tags: []string{"a=1", "b=2", "a=3"}},
+		{IPAddress: "1.2.3.3", ProjectID: "p1", Type: metal.Static, Tags: []string{"=orphan", "a=1", ""}},
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static, Tags: []string{"a=1", "a=1"}},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	issues, err := repo.IP(pointer.Pointer("p1")).Issues(ctx)
+	require.NoError(t, err)
+	var flagged []string
+	for _, issue := range issues {
+		if issue.Problem == repository.IPIssueTagIntegrity {
+			flagged = append(flagged, issue.Address)
+		}
+	}
+	assert.ElementsMatch(t, []string{"1.2.3.2", "1.2.3.3", "1.2.3.4"}, flagged)
+
+	_, err = repo.IP(pointer.Pointer("p1")).RepairTags(ctx)
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	repaired, err := repo.IP(nil).RepairTags(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []repository.IPTagRepair{
+		{IPAddress: "1.2.3.2", From: []string{"a=1", "b=2", "a=3"}, To: []string{"a=3", "b=2"}},
+		{IPAddress: "1.2.3.3", From: []string{"=orphan", "a=1", ""}, To: []string{"a=1"}},
+		{IPAddress: "1.2.3.4", From: []string{"a=1", "a=1"}, To: []string{"a=1"}},
+	}, repaired)
+
+	ip, err := ds.IP().Get(ctx, "1.2.3.2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=3", "b=2"}, ip.Tags, "the last value of a duplicate key is kept")
+
+	untouched, err := ds.IP().Get(ctx, "1.2.3.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "b=2"}, untouched.Tags)
+
+	// repairing again does not change anything
+	repaired, err = repo.IP(nil).RepairTags(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, repaired)
+}
+
+func TestIpIPAMNamespace(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeIpam{}
+	repo, ds, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: fake, config: repository.Config{IPAMNamespace: repository.IPAMNamespaceOfNetwork}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	random, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.1", random.IPAddress)
+	specific, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).Delete(ctx, specific)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := ds.IP().Get(ctx, specific.IPAddress)
+		return generic.IsNotFound(err)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, []string{"tenant"}, fake.namespaces("create", "1.2.0.0/24"))
+	assert.Equal(t, []string{"tenant", "tenant"}, fake.namespaces("acquire", "1.2.0.0/24"))
+	assert.Equal(t, []string{"tenant"}, fake.namespaces("release", "1.2.0.0/24"))
+
+	// the prefix only exists in the namespace of the network
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24"}))
+	require.Error(t, err)
+	usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: "1.2.0.0/24", Namespace: pointer.Pointer("tenant")}))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), usage.Msg.AcquiredIps, "the network and broadcast addresses and the random ip are acquired, the deleted ip is released")
+}
+
+func TestIpIPAMNamespaceDefault(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeIpam{}
+	repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: fake, config: repository.Config{IPAMNamespace: repository.IPAMNamespaceOfProject}}, testProject("p1"))
+	defer cleanup()
+
+	// a network which resolves to the default namespace is served without namespace
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("default"), Prefixes: []string{"1.1.0.0/24"}})
+	require.NoError(t, err)
+	ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "default", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1.0.1", ip.IPAddress)
+
+	assert.Equal(t, []string{""}, fake.namespaces("create", "1.1.0.0/24"), "networks of the default namespace are created without namespace")
+	assert.Equal(t, []string{""}, fake.namespaces("acquire", "1.1.0.0/24"))
+}
+
+func TestIpIPAMNamespaceOfEveryCall(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeIpam{}
+	repo, _, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{ipam: fake, config: repository.Config{IPAMNamespace: repository.IPAMNamespaceOfNetwork}}, testProject("p1"))
+	defer cleanup()
+
+	nw, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant-v6"), Prefixes: []string{"2001:db8::/56"}})
+	require.NoError(t, err)
+
+	ipRepo := repo.IP(nil)
+	_, err = ipRepo.CreateHostPrefix(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant-v6", Project: "p1"})
+	require.NoError(t, err)
+
+	availability, err := ipRepo.CheckSpecificIPs(ctx, nw, []string{"1.2.0.7"})
+	require.NoError(t, err)
+	assert.True(t, availability[0].Allocatable)
+	_, err = ipRepo.SuggestIP(ctx, "tenant", nil)
+	require.NoError(t, err)
+
+	// the last ip of the range is taken, the acquired ones are released again
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.22"), Namespace: pointer.Pointer("tenant")}))
+	require.NoError(t, err)
+	_, err = ipRepo.ReserveRange(ctx, "tenant", "1.2.0.20", "1.2.0.22")
+	require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+	_, err = ipRepo.ReserveIP(ctx, "tenant", "1.2.0.30")
+	require.NoError(t, err)
+	_, err = ipRepo.UnreserveIP(ctx, "tenant", "1.2.0.30")
+	require.NoError(t, err)
+	err = ipRepo.ReleaseInIPAM(ctx, "tenant", "1.2.0.22", "1.2.0.0/24")
+	require.NoError(t, err)
+
+	_, err = ipRepo.Import(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer("1.2.0.40")}, "1.2.0.0/24")
+	require.NoError(t, err)
+	reconciled, err := ipRepo.ReconcileImported(ctx)
+	require.NoError(t, err)
+	require.Len(t, reconciled, 1)
+
+	diff, err := ipRepo.Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInDatastore)
+	assert.Empty(t, diff.OnlyInIPAM)
+	assert.Empty(t, diff.PrefixMismatch)
+
+	fake.mu.Lock()
+	for call, namespaces := range fake.calls {
+		if call == "dump " {
+			continue
+		}
+		for _, namespace := range namespaces {
+			assert.Contains(t, []string{"tenant", "tenant-v6"}, namespace, "%s was not called in the namespace of the network", call)
+		}
+	}
+	fake.mu.Unlock()
+	dumped := map[string]int{}
+	for _, namespace := range fake.namespaces("dump", "") {
+		dumped[namespace]++
+	}
+	assert.Equal(t, 1, dumped[""], "the default namespace is only dumped by the diff")
+	assert.Positive(t, dumped["tenant"])
+	assert.Positive(t, dumped["tenant-v6"])
+	assert.Len(t, dumped, 3)
+	assert.Equal(t, []string{"tenant"}, fake.namespaces("release", "1.2.0.0/24")[:1])
+	assert.NotEmpty(t, fake.namespaces("get", "2001:db8::/64"))
+}
+
+func TestIpReleaseOrphaned(t *testing.T) {
+	ctx := context.Background()
+	repo, _, ipam, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	recorded, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+	// left over by a failed create
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.60")}))
+	require.NoError(t, err)
+	// prefixes which do not belong to any network are not managed by the api-server
+	_, err = ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: "10.0.0.0/24"}))
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "10.0.0.0/24", Ip: pointer.Pointer("10.0.0.5")}))
+	require.NoError(t, err)
+
+	_, err = repo.IP(pointer.Pointer("p1")).ReleaseOrphaned(ctx, false)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	orphaned := []repository.IPAMAllocation{{IP: "1.2.0.60", ParentPrefixCidr: "1.2.0.0/24"}}
+
+	// a dry-run only reports
+	released, err := repo.IP(nil).ReleaseOrphaned(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, orphaned, released)
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPAMAllocation{{IP: "1.2.0.60", ParentPrefixCidr: "1.2.0.0/24"}, {IP: "10.0.0.5", ParentPrefixCidr: "10.0.0.0/24"}}, diff.OnlyInIPAM)
+
+	released, err = repo.IP(nil).ReleaseOrphaned(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, orphaned, released)
+	diff, err = repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPAMAllocation{{IP: "10.0.0.5", ParentPrefixCidr: "10.0.0.0/24"}}, diff.OnlyInIPAM)
+
+	// the released ip can be allocated again, the recorded one is untouched
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.60")})
+	require.NoError(t, err)
+	again, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: &recorded.IPAddress})
+	require.NoError(t, err)
+	assert.Equal(t, recorded.AllocationUUID, again.AllocationUUID)
+
+	released, err = repo.IP(nil).ReleaseOrphaned(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, released)
+}
+
+func TestIpReleaseOrphanedNamespaced(t *testing.T) {
+	ctx := context.Background()
+	repo, _, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{IPAMNamespace: repository.IPAMNamespaceOfNetwork}}, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+	// left over by a failed create in the namespace of the network
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.60"), Namespace: pointer.Pointer("tenant")}))
+	require.NoError(t, err)
+	// the same prefix in the default namespace is not managed by the network
+	_, err = ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: "1.2.0.0/24"}))
+	require.NoError(t, err)
+	_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer("1.2.0.60")}))
+	require.NoError(t, err)
+
+	released, err := repo.IP(nil).ReleaseOrphaned(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPAMAllocation{{IP: "1.2.0.60", ParentPrefixCidr: "1.2.0.0/24", Namespace: "tenant"}}, released)
+
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.IPAMAllocation{{IP: "1.2.0.60", ParentPrefixCidr: "1.2.0.0/24"}}, diff.OnlyInIPAM)
+}
+
+func TestIpReserveGateway(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("gateway"), Prefixes: []string{"1.2.0.0/24", "2001:db8::/126"}, Labels: map[string]string{metal.NetworkLabelReserveGateway: "true"}})
+	require.NoError(t, err)
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("plain"), Prefixes: []string{"1.3.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(network string, af apiv2.IPAddressFamily) (*metal.IP, error) {
+		return repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: network, Project: "p1", AddressFamily: af.Enum()})
+	}
+
+	// random allocation skips the gateway
+	ip, err := create("gateway", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.2", ip.IPAddress)
+	ip, err = create("gateway", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V6)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::2", ip.IPAddress)
+
+	// the gateway is rejected as specific ip
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "gateway", Project: "p1", Ip: pointer.Pointer("1.2.0.1")})
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "ip:1.2.0.1 is reserved as gateway in network:gateway")
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "gateway", Project: "p1", Ip: pointer.Pointer("2001:db8::1")})
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "gateway", Project: "p1", Ip: pointer.Pointer("1.2.0.10")})
+	require.NoError(t, err)
+
+	// the held gateway is no inconsistency
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+
+	// the next random ip does not acquire the gateway again
+	ip, err = create("gateway", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.3", ip.IPAddress)
+
+	// networks without the label hand out the first usable address
+	ip, err = create("plain", apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4)
+	require.NoError(t, err)
+	assert.Equal(t, "1.3.0.1", ip.IPAddress)
+}
+
+func TestIpCreateConcurrentSameAddress(t *testing.T) {
+	ctx := context.Background()
+	// both networks have the same prefix in different ipam namespaces, so ipam hands out the same address to both of them
+	repo, ds, ipam, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{IPAMNamespace: repository.IPAMNamespaceOfNetwork}}, testProject("p1"))
+	defer cleanup()
+
+	for _, id := range []string{"a", "b"} {
+		_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer(id), Prefixes: []string{"10.0.0.0/24"}})
+		require.NoError(t, err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created []*metal.IP
+		codes   []connect.Code
+	)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			network := []string{"a", "b"}[i%2]
+			ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: network, Project: "p1", Ip: pointer.Pointer("10.0.0.5")})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				codes = append(codes, connect.CodeOf(err))
+				return
+			}
+			created = append(created, ip)
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, created, 1)
+	assert.Len(t, codes, 9)
+	for _, code := range codes {
+		assert.Equal(t, connect.CodeAlreadyExists, code)
+	}
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5"}, ipAddresses(ips), "only one row is written")
+	assert.Equal(t, created[0].NetworkID, ips[0].NetworkID)
+
+	// the address is only held in ipam by the network of the written row
+	for _, network := range []string{"a", "b"} {
+		usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: "10.0.0.0/24", Namespace: &network}))
+		require.NoError(t, err)
+		want := uint64(2)
+		if network == created[0].NetworkID {
+			want = 3
+		}
+		assert.Equal(t, want, usage.Msg.AcquiredIps, "network %s", network)
+	}
+}
+
+func TestIpExcludedIPs(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	nw, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("excluded"), Prefixes: []string{"1.2.0.0/24"}, Labels: map[string]string{metal.NetworkLabelExcludedIPs: "1.2.0.1-1.2.0.3,1.2.0.5"}})
+	require.NoError(t, err)
+
+	create := func(specificIP *string) (*metal.IP, error) {
+		return repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "excluded", Project: "p1", Ip: specificIP})
+	}
+
+	// random allocation skips excluded ips and ranges
+	ip, err := create(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.4", ip.IPAddress)
+	ip, err = create(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.6", ip.IPAddress)
+
+	// excluded ips are rejected as specific ip
+	_, err = create(pointer.Pointer("1.2.0.2"))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "ip:1.2.0.2 is excluded in network:excluded")
+	_, err = create(pointer.Pointer("1.2.0.5"))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	ip, err = create(pointer.Pointer("1.2.0.10"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.10", ip.IPAddress)
+
+	availabilities, err := repo.IP(nil).CheckSpecificIPs(ctx, nw, []string{"1.2.0.3"})
+	require.NoError(t, err)
+	require.Len(t, availabilities, 1)
+	assert.False(t, availabilities[0].Allocatable)
+	assert.Equal(t, "ip is excluded in network:excluded", availabilities[0].Reason)
+
+	// the excluded ips held by random allocation are no inconsistency
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+}
+
+func TestIpFindContainingPrefix(t *testing.T) {
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	nw := &metal.Network{
+		Base:     metal.Base{ID: "overlapping", Changed: time.Now()},
+		Prefixes: metal.Prefixes{{IP: "1.2.0.0", Length: "16"}, {IP: "1.2.3.0", Length: "24"}, {IP: "2001:db8::", Length: "64"}},
+	}
+
+	prefix, err := repo.IP(pointer.Pointer("p1")).FindContainingPrefix(nw, netip.MustParseAddr("1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.0/24", prefix.String(), "the longest match is returned")
+	prefix, err = repo.IP(pointer.Pointer("p1")).FindContainingPrefix(nw, netip.MustParseAddr("1.2.4.4"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.0/16", prefix.String())
+	prefix, err = repo.IP(pointer.Pointer("p1")).FindContainingPrefix(nw, netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::/64", prefix.String())
+
+	for _, ip := range []string{"1.3.0.1", "2001:db9::1"} {
+		_, err = repo.IP(pointer.Pointer("p1")).FindContainingPrefix(nw, netip.MustParseAddr(ip))
+		require.True(t, generic.IsNotFound(err), "expected not found for %s, got %v", ip, err)
+	}
+
+	// changed prefixes are found even if the change timestamp of the network is the same
+	changed := *nw
+	changed.Prefixes = metal.Prefixes{{IP: "1.3.0.0", Length: "24"}}
+	prefix, err = repo.IP(pointer.Pointer("p1")).FindContainingPrefix(&changed, netip.MustParseAddr("1.3.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.3.0.0/24", prefix.String())
+	_, err = repo.IP(pointer.Pointer("p1")).FindContainingPrefix(&changed, netip.MustParseAddr("1.2.3.4"))
+	require.True(t, generic.IsNotFound(err), "the stale index must not be used, got %v", err)
+}
+
+func TestIpReleaseForProjectDeletion(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, ipam, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(project string, ipType apiv2.IPType) *metal.IP {
+		ip, err := repo.IP(&project).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project, Type: ipType.Enum()})
+		require.NoError(t, err)
+		return ip
+	}
+
+	var (
+		ephemeral  = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL)
+		ephemeral2 = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL)
+		static     = create("p1", apiv2.IPType_IP_TYPE_STATIC)
+		otherProj  = create("p2", apiv2.IPType_IP_TYPE_EPHEMERAL)
+	)
+
+	_, err = repo.IP(nil).ReleaseForProjectDeletion(ctx, "")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	// the scope does not allow to release the ips of another project
+	result, err := repo.IP(pointer.Pointer("p2")).ReleaseForProjectDeletion(ctx, "p1")
+	require.NoError(t, err)
+	assert.Empty(t, result.Released)
+	assert.Empty(t, result.Blocking)
+
+	result, err = repo.IP(pointer.Pointer("p1")).ReleaseForProjectDeletion(ctx, "p1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{ephemeral.IPAddress, ephemeral2.IPAddress}, ipAddresses(result.Released))
+	assert.Equal(t, []string{static.IPAddress}, ipAddresses(result.Blocking))
+
+	// ephemeral ips are released in the datastore and in ipam
+	for _, ip := range result.Released {
+		require.Eventually(t, func() bool {
+			_, err := ds.IP().Get(ctx, ip.IPAddress)
+			return generic.IsNotFound(err)
+		}, 10*time.Second, 50*time.Millisecond)
+		_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: "1.2.0.0/24", Ip: pointer.Pointer(ip.IPAddress)}))
+		require.NoError(t, err, ip.IPAddress)
+	}
+	for _, ip := range []*metal.IP{static, otherProj} {
+		_, err := ds.IP().Get(ctx, ip.IPAddress)
+		require.NoError(t, err, ip.IPAddress)
+	}
+
+	// the static ip keeps blocking until it is released explicitly
+	result, err = repo.IP(pointer.Pointer("p1")).ReleaseForProjectDeletion(ctx, "p1")
+	require.NoError(t, err)
+	assert.Empty(t, result.Released)
+	assert.Equal(t, []string{static.IPAddress}, ipAddresses(result.Blocking))
+}
+
+func TestIpPrefixUtilizationWarning(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		want      string
+	}{
+		{
+			name: "no warning unless a threshold is configured",
+		},
+		{
+			name:      "threshold reached",
+			threshold: 50,
+			want:      "prefix:1.2.0.0/28 of network:internet is 50% utilized (8/16 ips acquired), consider adding a prefix to the network",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo, _, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{config: repository.Config{PrefixWarningThreshold: tt.threshold}}, testProject("p1"))
+			defer cleanup()
+
+			_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/28"}})
+			require.NoError(t, err)
+
+			create := func() *metal.IP {
+				ip, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"})
+				require.NoError(t, err)
+				return ip
+			}
+
+			// network and broadcast address are acquired in ipam as well, this is 7 of 16 ips
+			var ip *metal.IP
+			for range 5 {
+				ip = create()
+			}
+			warning, err := repo.IP(pointer.Pointer("p1")).PrefixUtilizationWarning(ctx, ip)
+			require.NoError(t, err)
+			assert.Empty(t, warning, "below the threshold")
+
+			ip = create()
+			warning, err = repo.IP(pointer.Pointer("p1")).PrefixUtilizationWarning(ctx, ip)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, warning)
+		})
+	}
+}
+
+func TestIpListUnboundStatic(t *testing.T) {
+	ctx := context.Background()
+	repo, _, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	create := func(project string, ipType apiv2.IPType, machineID *string) *metal.IP {
+		ip, err := repo.IP(&project).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: project, Type: ipType.Enum(), MachineId: machineID})
+		require.NoError(t, err)
+		return ip
+	}
+
+	var (
+		unbound  = create("p1", apiv2.IPType_IP_TYPE_STATIC, nil)
+		_        = create("p1", apiv2.IPType_IP_TYPE_STATIC, pointer.Pointer("m1"))
+		_        = create("p1", apiv2.IPType_IP_TYPE_EPHEMERAL, nil)
+		unbound2 = create("p1", apiv2.IPType_IP_TYPE_STATIC, nil)
+		_        = create("p2", apiv2.IPType_IP_TYPE_STATIC, nil)
+	)
+
+	_, err = repo.IP(pointer.Pointer("p1")).ListUnboundStatic(ctx, "")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	ips, err := repo.IP(pointer.Pointer("p1")).ListUnboundStatic(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{unbound.IPAddress, unbound2.IPAddress}, ipAddresses(ips), "machine-bound and ephemeral ips are skipped")
+
+	// the scope does not allow to review the ips of another project
+	ips, err = repo.IP(pointer.Pointer("p2")).ListUnboundStatic(ctx, "p1")
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestIpCreateSpecificIdempotent(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"), testProject("p2"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.0.0/24"}})
+	require.NoError(t, err)
+
+	created, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Name: pointer.Pointer("vip")})
+	require.NoError(t, err)
+
+	// the owner retries the create and gets the existing ip
+	retried, err := repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.0.5"), Name: pointer.Pointer("vip")})
+	require.NoError(t, err)
+	assert.Equal(t, created.AllocationUUID, retried.AllocationUUID)
+	assert.Equal(t, "vip", retried.Name)
+
+	// another project must not get the ip of the owner
+	_, err = repo.IP(pointer.Pointer("p2")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "internet", Project: "p2", Ip: pointer.Pointer("1.2.0.5")})
+	require.Error(t, err)
+	assert.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "p1", ips[0].ProjectID)
+}
+
+func TestIpCreateTypePolicy(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("ephemeral-only"), Prefixes: []string{"1.2.0.0/24"}, Labels: map[string]string{metal.NetworkLabelEphemeralOnly: "true"}})
+	require.NoError(t, err)
+
+	create := func(ipType *apiv2.IPType, specificIP *string) (*metal.IP, error) {
+		return repo.IP(pointer.Pointer("p1")).Create(ctx, &apiv2.IPServiceCreateRequest{Network: "ephemeral-only", Project: "p1", Type: ipType, Ip: specificIP})
+	}
+
+	_, err = create(apiv2.IPType_IP_TYPE_STATIC.Enum(), nil)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	assert.ErrorContains(t, err, "network:ephemeral-only only allows ephemeral ips")
+	_, err = create(apiv2.IPType_IP_TYPE_STATIC.Enum(), pointer.Pointer("1.2.0.5"))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = create(apiv2.IPType(42).Enum(), nil)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = create(apiv2.IPType_IP_TYPE_UNSPECIFIED.Enum(), nil)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	// rejected requests do not allocate anything
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ips)
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+
+	ip, err := create(apiv2.IPType_IP_TYPE_EPHEMERAL.Enum(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, metal.Ephemeral, ip.Type)
+	ip, err = create(nil, pointer.Pointer("1.2.0.5"))
+	require.NoError(t, err)
+	assert.Equal(t, metal.Ephemeral, ip.Type)
+}
+
+func TestIpCreateBlock(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"1.2.0.0/28", "1.2.1.0/28"}})
+	require.NoError(t, err)
+
+	ipRepo := repo.IP(pointer.Pointer("p1"))
+	req := &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Name: pointer.Pointer("appliance")}
+
+	// fragment the second prefix, every other address is allocated
+	for _, ip := range []string{"1.2.1.2", "1.2.1.4", "1.2.1.6", "1.2.1.8", "1.2.1.10", "1.2.1.12", "1.2.1.14"} {
+		_, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer(ip)})
+		require.NoError(t, err)
+	}
+
+	t.Run("contiguous block", func(t *testing.T) {
+		_, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer("1.2.0.3")})
+		require.NoError(t, err)
+
+		ips, err := ipRepo.CreateBlock(ctx, req, "1.2.0.0/28", 8)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.0.4", "1.2.0.5", "1.2.0.6", "1.2.0.7", "1.2.0.8", "1.2.0.9", "1.2.0.10", "1.2.0.11"}, ipAddresses(ips))
+		for _, ip := range ips {
+			assert.Equal(t, "appliance", ip.Name)
+			assert.Equal(t, "1.2.0.0/28", ip.ParentPrefixCidr)
+		}
+
+		// the free addresses before the allocated one were released again
+		ip, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1"})
+		require.NoError(t, err)
+		assert.Equal(t, "1.2.0.1", ip.IPAddress)
+	})
+
+	t.Run("fragmented prefix", func(t *testing.T) {
+		_, err := ipRepo.CreateBlock(ctx, req, "1.2.1.0/28", 2)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		assert.ErrorContains(t, err, "no contiguous block of 2 free ips left in prefix:1.2.1.0/28 of network:tenant")
+
+		diff, err := repo.IP(nil).Diff(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, diff.OnlyInIPAM)
+
+		ips, err := ipRepo.CreateBlock(ctx, req, "1.2.1.0/28", 1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.1.1"}, ipAddresses(ips))
+	})
+
+	t.Run("store fails", func(t *testing.T) {
+		_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("rollback"), Prefixes: []string{"1.2.2.0/28"}})
+		require.NoError(t, err)
+		// recorded in the datastore only, so ipam hands it out and storing it conflicts
+		_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.2.3", ProjectID: "p1", NetworkID: "rollback", ParentPrefixCidr: "1.2.2.0/28"})
+		require.NoError(t, err)
+
+		_, err = ipRepo.CreateBlock(ctx, &apiv2.IPServiceCreateRequest{Network: "rollback", Project: "p1"}, "1.2.2.0/28", 4)
+		require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+		ips, err := ipRepo.List(ctx, &apiv2.IPQuery{Network: pointer.Pointer("rollback")})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.2.3"}, ipAddresses(ips))
+		diff, err := repo.IP(nil).Diff(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, diff.OnlyInIPAM)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		_, err := ipRepo.CreateBlock(ctx, req, "1.2.0.0/28", 0)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		_, err = ipRepo.CreateBlock(ctx, req, "10.0.0.0/28", 2)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		_, err = ipRepo.CreateBlock(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer("1.2.0.12")}, "1.2.0.0/28", 2)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+}
+
+func TestIpMoveParentPrefix(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "10.0.0.4", ProjectID: "p1", ParentPrefixCidr: "10.0.0.0/24"},
+		{IPAddress: "10.0.0.5", ProjectID: "p1", ParentPrefixCidr: "10.0.0.0/24"},
+		{IPAddress: "10.0.0.6", ProjectID: "p1", ParentPrefixCidr: "10.0.0.0/24"},
+		{IPAddress: "10.0.1.4", ProjectID: "p1", ParentPrefixCidr: "10.0.1.0/24"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	parentPrefix := func(ip string) string {
+		got, err := ds.IP().Get(ctx, ip)
+		require.NoError(t, err)
+		return got.ParentPrefixCidr
+	}
+
+	t.Run("ip does not fit", func(t *testing.T) {
+		_, err := repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.0/30")
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+		assert.ErrorContains(t, err, "ips 10.0.0.4,10.0.0.5,10.0.0.6 of prefix:10.0.0.0/24 are not contained in prefix:10.0.0.0/30")
+
+		for _, ip := range []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+			assert.Equal(t, "10.0.0.0/24", parentPrefix(ip))
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		_, err := repo.IP(pointer.Pointer("p1")).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.0/23")
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+		_, err = repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.1/24")
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		_, err = repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "no-prefix")
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("clean move", func(t *testing.T) {
+		moved, err := repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.0/23")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"}, ipAddresses(moved))
+
+		for _, ip := range []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+			assert.Equal(t, "10.0.0.0/23", parentPrefix(ip))
+		}
+		assert.Equal(t, "10.0.1.0/24", parentPrefix("10.0.1.4"))
+
+		// nothing is left to move
+		moved, err = repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.0/23")
+		require.NoError(t, err)
+		assert.Empty(t, moved)
+	})
+}
+
+func TestIpMoveParentPrefixRollback(t *testing.T) {
+	ctx := context.Background()
+	executor := &failingExecutor{failOnReplace: 3}
+	repo, ds, _, cleanup := startIpRepositoryWithOpts(t, ipRepositoryOpts{executor: executor}, testProject("p1"))
+	defer cleanup()
+
+	ips := []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}
+	for _, ip := range ips {
+		_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: ip, ProjectID: "p1", ParentPrefixCidr: "10.0.0.0/24"})
+		require.NoError(t, err)
+	}
+
+	_, err := repo.IP(nil).MoveParentPrefix(ctx, "10.0.0.0/24", "10.0.0.0/23")
+	require.Error(t, err)
+	require.Greater(t, executor.replaces, 3, "moved ips must have been rolled back")
+
+	for _, ip := range ips {
+		got, err := repo.IP(nil).Get(ctx, ip)
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0/24", got.ParentPrefixCidr, "ip %s was not rolled back", ip)
+	}
+}
+
+func TestIpSuggestIP(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t, testProject("p1"))
+	defer cleanup()
+
+	_, err := repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("tenant"), Prefixes: []string{"1.2.0.0/29", "2001:db8::/120"}})
+	require.NoError(t, err)
+
+	ipRepo := repo.IP(pointer.Pointer("p1"))
+	for _, ip := range []string{"1.2.0.1", "1.2.0.2"} {
+		_, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer(ip)})
+		require.NoError(t, err)
+	}
+	// stored in the datastore only, it is not suggested either
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.0.3", ProjectID: "p1", NetworkID: "tenant", ParentPrefixCidr: "1.2.0.0/29"})
+	require.NoError(t, err)
+
+	suggestion, err := ipRepo.SuggestIP(ctx, "tenant", pointer.Pointer(metal.IPv4AddressFamily))
+	require.NoError(t, err)
+	assert.Equal(t, &repository.IPSuggestion{IP: "1.2.0.4", ParentPrefixCidr: "1.2.0.0/29"}, suggestion)
+
+	// the suggestion is not acquired, it is suggested again and can be allocated
+	diff, err := repo.IP(nil).Diff(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, diff.OnlyInIPAM)
+	again, err := ipRepo.SuggestIP(ctx, "tenant", pointer.Pointer(metal.IPv4AddressFamily))
+	require.NoError(t, err)
+	assert.Equal(t, suggestion, again)
+	ip, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer(suggestion.IP)})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0.4", ip.IPAddress)
+
+	suggestion, err = ipRepo.SuggestIP(ctx, "tenant", pointer.Pointer(metal.IPv6AddressFamily))
+	require.NoError(t, err)
+	assert.Equal(t, &repository.IPSuggestion{IP: "2001:db8::1", ParentPrefixCidr: "2001:db8::/120"}, suggestion)
+
+	for _, ip := range []string{"1.2.0.5", "1.2.0.6"} {
+		_, err := ipRepo.Create(ctx, &apiv2.IPServiceCreateRequest{Network: "tenant", Project: "p1", Ip: pointer.Pointer(ip)})
+		require.NoError(t, err)
+	}
+	_, err = ipRepo.SuggestIP(ctx, "tenant", pointer.Pointer(metal.IPv4AddressFamily))
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+
+	_, err = ipRepo.SuggestIP(ctx, "no-network", nil)
+	require.True(t, generic.IsNotFound(err))
+}
+
+func TestIpListBlank(t *testing.T) {
+	ctx := context.Background()
+	repo, ds, _, cleanup := startIpRepository(t)
+	defer cleanup()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "internet", Name: "web", Description: "the web server"},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", NetworkID: "internet", Description: "without a name"},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", NetworkID: "internet", Name: "db"},
+		{IPAddress: "1.2.3.7", ProjectID: "p1", NetworkID: "storage"},
+		{IPAddress: "1.2.3.8", ProjectID: "p2", NetworkID: "internet"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	addresses := func(project *string, query *apiv2.IPQuery, name, description bool) []string {
+		ips, err := repo.IP(project).ListBlank(ctx, query, name, description)
+		require.NoError(t, err)
+		return ipAddresses(ips)
+	}
+
+	assert.ElementsMatch(t, []string{"1.2.3.5", "1.2.3.7", "1.2.3.8"}, addresses(nil, nil, true, false))
+	assert.ElementsMatch(t, []string{"1.2.3.6", "1.2.3.7", "1.2.3.8"}, addresses(nil, nil, false, true))
+	assert.ElementsMatch(t, []string{"1.2.3.5", "1.2.3.6", "1.2.3.7", "1.2.3.8"}, addresses(nil, nil, true, true))
+	assert.ElementsMatch(t, []string{"1.2.3.5", "1.2.3.7"}, addresses(pointer.Pointer("p1"), nil, true, false))
+	assert.ElementsMatch(t, []string{"1.2.3.5"}, addresses(pointer.Pointer("p1"), &apiv2.IPQuery{Network: pointer.Pointer("internet")}, true, false))
+
+	_, err := repo.IP(nil).ListBlank(ctx, nil, false, false)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AllocationLatencies is a snapshot of the latencies of the recent allocations of ips in ipam.
+type AllocationLatencies struct {
+	// Count is the number of recent allocations the percentiles are computed of.
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// allocationLatencySamples is the number of recent allocations whose latency is kept.
+const allocationLatencySamples = 1024
+
+// latencyRing keeps the latencies of the recent allocations, the oldest latency is overwritten once it is full.
+type latencyRing struct {
+	mu      sync.Mutex
+	size    int
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyRing(size int) *latencyRing {
+	return &latencyRing{size: size}
+}
+
+func (l *latencyRing) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < l.size {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % l.size
+}
+
+func (l *latencyRing) snapshot() AllocationLatencies {
+	l.mu.Lock()
+	sorted := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return AllocationLatencies{}
+	}
+	slices.Sort(sorted)
+
+	return AllocationLatencies{
+		Count: len(sorted),
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+		P99:   percentile(sorted, 99),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies by the nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
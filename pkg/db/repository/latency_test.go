@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyRing(t *testing.T) {
+	ring := newLatencyRing(100)
+	assert.Equal(t, AllocationLatencies{}, ring.snapshot())
+
+	// recorded in reverse order, the percentiles do not depend on it
+	for i := 100; i > 0; i-- {
+		ring.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, AllocationLatencies{Count: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond}, ring.snapshot())
+
+	// the oldest latencies are overwritten, these are the slowest ones
+	for range 10 {
+		ring.record(time.Millisecond)
+	}
+	assert.Equal(t, AllocationLatencies{Count: 100, P50: 40 * time.Millisecond, P95: 85 * time.Millisecond, P99: 89 * time.Millisecond}, ring.snapshot())
+
+	single := newLatencyRing(10)
+	single.record(3 * time.Second)
+	assert.Equal(t, AllocationLatencies{Count: 1, P50: 3 * time.Second, P95: 3 * time.Second, P99: 3 * time.Second}, single.snapshot())
+}
@@ -2,9 +2,11 @@ package repository
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
 	"slices"
 	"strconv"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/google/uuid"
@@ -25,11 +27,26 @@ func (r *networkRepository) Get(ctx context.Context, id string) (*metal.Network,
 		return nil, err
 	}
 
+	return r.visible(nw)
+}
+
+// getCached is Get served from the network cache of the repostore, it is meant for the allocation path only.
+func (r *networkRepository) getCached(ctx context.Context, id string) (*metal.Network, error) {
+	nw, err := r.r.cachedNetwork(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.visible(nw)
+}
+
+// visible returns the network if it can be seen in scope, shared, private super and external networks can be seen by everyone.
+func (r *networkRepository) visible(nw *metal.Network) (*metal.Network, error) {
 	if nw.Shared || nw.PrivateSuper || nw.ProjectID == "" {
 		return nw, nil
 	}
 
-	err = r.MatchScope(nw)
+	err := r.MatchScope(nw)
 	if err != nil {
 		return nil, err
 	}
@@ -58,6 +75,7 @@ func (r *networkRepository) Delete(ctx context.Context, n *metal.Network) (*meta
 	if err != nil {
 		return nil, err
 	}
+	r.r.invalidateNetwork(nw.ID)
 
 	return nw, nil
 }
@@ -105,19 +123,40 @@ func (r *networkRepository) Create(ctx context.Context, req *apiv2.NetworkServic
 			ID: id,
 		},
 		// FIXME more fields
-		Prefixes: prefixes,
+		Prefixes:        prefixes,
+		AddressFamilies: afs,
+		Labels:          req.Labels,
 	}
 
 	resp, err := r.r.ds.Network().Create(ctx, nw)
 	if err != nil {
 		return nil, err
 	}
+	r.r.invalidateNetwork(nw.ID)
+
+	namespace := r.r.ipamNamespace(nw)
+	if namespace != nil {
+		// creating a namespace is idempotent
+		_, err = r.r.ipam.CreateNamespace(ctx, connect.NewRequest(&ipamv1.CreateNamespaceRequest{Namespace: *namespace}))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	for _, prefix := range nw.Prefixes {
-		_, err = r.r.ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: prefix.String()}))
+		_, err = r.r.ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: prefix.String(), Namespace: namespace}))
 		if err != nil {
 			return nil, err
 		}
+
+		// ipam acquires the network address of every prefix, which is the only address of a single host prefix.
+		// it is released again, otherwise nothing could ever be allocated from a /32 or /128 prefix.
+		if pfx, err := netip.ParsePrefix(prefix.String()); err == nil && pfx.IsSingleIP() {
+			_, err = r.r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamv1.ReleaseIPRequest{PrefixCidr: prefix.String(), Ip: pfx.Addr().String(), Namespace: namespace}))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return resp, nil
@@ -138,3 +177,87 @@ func (r *networkRepository) ConvertToInternal(msg *apiv2.Network) (*metal.Networ
 func (r *networkRepository) ConvertToProto(e *metal.Network) (*apiv2.Network, error) {
 	panic("unimplemented")
 }
+
+// IPAMNamespaceFunc returns the ipam namespace the prefixes of the network live in, an empty namespace is the default namespace of ipam.
+type IPAMNamespaceFunc func(nw *metal.Network) string
+
+// IPAMNamespaceOfNetwork puts the prefixes of every network in a namespace of its own.
+func IPAMNamespaceOfNetwork(nw *metal.Network) string {
+	return nw.ID
+}
+
+// IPAMNamespaceOfProject puts the prefixes of the networks of a project in the namespace of the project,
+// the prefixes of networks without project stay in the default namespace.
+func IPAMNamespaceOfProject(nw *metal.Network) string {
+	return nw.ProjectID
+}
+
+// NewIPAMNamespaceFunc returns the ipam namespace func of the given name, which is either empty, "network" or "project".
+func NewIPAMNamespaceFunc(name string) (IPAMNamespaceFunc, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "network":
+		return IPAMNamespaceOfNetwork, nil
+	case "project":
+		return IPAMNamespaceOfProject, nil
+	default:
+		return nil, fmt.Errorf("unknown ipam namespace %q, must be one of network or project", name)
+	}
+}
+
+// ipamNamespace returns the ipam namespace of the prefixes of the network, nil is the default namespace.
+func (r *Repostore) ipamNamespace(nw *metal.Network) *string {
+	if r.ipamNamespaceFn == nil {
+		return nil
+	}
+	namespace := r.ipamNamespaceFn(nw)
+	if namespace == "" {
+		return nil
+	}
+	return &namespace
+}
+
+// ipamNamespaceOfNetwork returns the ipam namespace of the prefixes of the network with the given id,
+// the network is only looked up if the prefixes are not all in the default namespace.
+func (r *Repostore) ipamNamespaceOfNetwork(ctx context.Context, id string) (*string, error) {
+	if r.ipamNamespaceFn == nil {
+		return nil, nil
+	}
+	nw, err := r.cachedNetwork(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.ipamNamespace(nw), nil
+}
+
+type cachedNetwork struct {
+	nw      *metal.Network
+	expires time.Time
+}
+
+// cachedNetwork returns the network from the network cache if it was fetched within the cache ttl, otherwise it is fetched from the datastore.
+// The cache is only invalidated by changes done through this repostore, changes done by other instances are seen after the ttl at the latest.
+func (r *Repostore) cachedNetwork(ctx context.Context, id string) (*metal.Network, error) {
+	if r.networkCacheTTL <= 0 {
+		return r.ds.Network().Get(ctx, id)
+	}
+
+	if cached, ok := r.networks.Load(id); ok && time.Now().Before(cached.(*cachedNetwork).expires) {
+		return cached.(*cachedNetwork).nw, nil
+	}
+
+	nw, err := r.ds.Network().Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r.networks.Store(id, &cachedNetwork{nw: nw, expires: time.Now().Add(r.networkCacheTTL)})
+
+	return nw, nil
+}
+
+// invalidateNetwork removes the network from the network and prefix index caches, it must be called whenever a network is changed.
+func (r *Repostore) invalidateNetwork(id string) {
+	r.networks.Delete(id)
+	r.prefixIndexes.Delete(id)
+}
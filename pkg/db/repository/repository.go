@@ -3,11 +3,16 @@ package repository
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/metal-stack/api-server/pkg/db/generic"
 	"github.com/metal-stack/api-server/pkg/db/metal"
 	"github.com/metal-stack/api-server/pkg/db/tx"
+	"github.com/metal-stack/api-server/pkg/db/validate"
 	adminv2 "github.com/metal-stack/api/go/metalstack/admin/v2"
 	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
 	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
@@ -29,18 +34,132 @@ type (
 		MatchScope(e E) error
 	}
 
+	// IPRepository is the Repository for ips, extended with ip specific operations.
+	IPRepository interface {
+		Repository[*metal.IP, *apiv2.IP, *apiv2.IPServiceCreateRequest, *apiv2.IPServiceUpdateRequest, *apiv2.IPQuery]
+		AcceptTransfer(ctx context.Context, ipAddress string) (*metal.IP, error)
+		AgeReport(ctx context.Context, project string) ([]IPAgeBucket, error)
+		AllocationLatencies() AllocationLatencies
+		CanAllocate(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*IPAllocationReadiness, error)
+		CancelTransfer(ctx context.Context, ipAddress string) (*metal.IP, error)
+		Chargeable(ip *metal.IP) bool
+		CountByNetworkAndType(ctx context.Context, project string) ([]NetworkIPTypeCount, error)
+		CreateBlock(ctx context.Context, req *apiv2.IPServiceCreateRequest, prefixCidr string, n int) ([]*metal.IP, error)
+		CreateHostPrefix(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error)
+		CreateNth(ctx context.Context, req *apiv2.IPServiceCreateRequest, prefixCidr string, n uint64) (*metal.IP, error)
+		CreatePreferred(ctx context.Context, req *apiv2.IPServiceCreateRequest, preferredIPs []string, fallbackToRandom bool) (*metal.IP, error)
+		CreateTopDown(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error)
+		CreateWithFallback(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error)
+		CheckSpecificIPs(ctx context.Context, nw *metal.Network, specificIPs []string) ([]SpecificIPAvailability, error)
+		DeleteByFilter(ctx context.Context, rq *apiv2.IPQuery, force bool) (*IPBulkRelease, error)
+		Diff(ctx context.Context) (*IPDiff, error)
+		ExportCSV(ctx context.Context, rq *apiv2.IPQuery, w io.Writer) error
+		FailedReleases(ctx context.Context) ([]FailedIPRelease, error)
+		FindContainingPrefix(nw *metal.Network, addr netip.Addr) (*metal.Prefix, error)
+		ForceDelete(ctx context.Context, ip *metal.IP) (*metal.IP, error)
+		Import(ctx context.Context, req *apiv2.IPServiceCreateRequest, parentPrefixCidr string) (*metal.IP, error)
+		InitiateTransfer(ctx context.Context, ipAddress, targetProject, initiatedBy string) (*metal.IP, error)
+		Issues(ctx context.Context) ([]IPIssue, error)
+		Iterate(ctx context.Context, rq *apiv2.IPQuery, fn func(*metal.IP) error) error
+		ListBlank(ctx context.Context, rq *apiv2.IPQuery, name, description bool) ([]*metal.IP, error)
+		ListByOwner(ctx context.Context, rq *apiv2.IPQuery, owner string) ([]*metal.IP, error)
+		ListByParentPrefixFamily(ctx context.Context, rq *apiv2.IPQuery, af apiv2.IPAddressFamily) ([]*metal.IP, error)
+		ListByUUIDs(ctx context.Context, uuids []string) ([]*metal.IP, error)
+		ListChangedSince(ctx context.Context, rq *apiv2.IPQuery, since time.Time) ([]*metal.IP, time.Time, error)
+		ListInExhaustedPrefixes(ctx context.Context, rq *apiv2.IPQuery) ([]*metal.IP, error)
+		ListInNetworks(ctx context.Context, rq *apiv2.IPQuery, networks []string) ([]*metal.IP, error)
+		ListNetworks(ctx context.Context, project string) ([]NetworkIPCount, error)
+		ListOldestEphemeral(ctx context.Context, networkID string, withoutMachine bool, limit int) ([]*metal.IP, error)
+		ListUnboundStatic(ctx context.Context, project string) ([]*metal.IP, error)
+		MoveParentPrefix(ctx context.Context, oldPrefix, newPrefix string) ([]*metal.IP, error)
+		NormalizeIPAddresses(ctx context.Context) ([]IPAddressNormalization, error)
+		Ping(ctx context.Context) error
+		PrefixDrift(ctx context.Context) ([]NetworkPrefixDrift, error)
+		PrefixRange(ctx context.Context, ipOrPrefix string) (*metal.PrefixRange, error)
+		PrefixUtilizationWarning(ctx context.Context, ip *metal.IP) (string, error)
+		PromoteToStatic(ctx context.Context, rq *apiv2.IPQuery, reason string) (*IPPromotion, error)
+		ReassignProject(ctx context.Context, sourceProject, targetProject string) ([]*metal.IP, error)
+		ReconcileImported(ctx context.Context) ([]*metal.IP, error)
+		RefreshLease(ctx context.Context, ipAddress string) (*metal.IP, error)
+		RejectTransfer(ctx context.Context, ipAddress string) (*metal.IP, error)
+		ReleaseInIPAM(ctx context.Context, networkID, ipAddress, parentPrefixCidr string) error
+		ReleaseForProjectDeletion(ctx context.Context, project string) (*IPProjectRelease, error)
+		ReleaseOrphaned(ctx context.Context, dryRun bool) ([]IPAMAllocation, error)
+		RepairTags(ctx context.Context) ([]IPTagRepair, error)
+		ReserveAndClaim(ctx context.Context, req *apiv2.IPServiceCreateRequest) (*metal.IP, error)
+		ReserveIP(ctx context.Context, networkID, ipAddress string) (*metal.Network, error)
+		ReserveRange(ctx context.Context, networkID, first, last string) (*metal.Network, error)
+		RetryFailedReleases(ctx context.Context) ([]FailedIPRelease, error)
+		SuggestIP(ctx context.Context, networkID string, af *metal.AddressFamily) (*IPSuggestion, error)
+		TagUsage(ctx context.Context, project string, topValues int) ([]TagKeyUsage, error)
+		UnreserveIP(ctx context.Context, networkID, ipAddress string) (*metal.Network, error)
+		UpdateIf(ctx context.Context, rq *apiv2.IPServiceUpdateRequest, precondition IPTagPrecondition) (*metal.IP, error)
+		Watch(ctx context.Context, revision string, fn func(IPEvent) error) error
+		WithReferences() IPRepository
+	}
+
 	Entity        any
 	Message       any
 	UpdateMessage any
 	CreateMessage any
 	Query         any
 
+	// Config configures the repositories, the zero value of every field keeps the default behavior.
+	Config struct {
+		// AllocationTimeout limits the duration an ip allocation in ipam may take, independent of the request deadline.
+		// A timeout of zero disables the limit.
+		AllocationTimeout time.Duration
+		// MachineRetryWindow lets the random allocation of an ip for a machine return the ip of the same network and addressfamily
+		// which was allocated for this machine within the window, so a retried machine provisioning does not allocate a fresh ip each time.
+		// A window of zero always allocates a new ip.
+		MachineRetryWindow time.Duration
+		// MaxPrefixAttempts limits the number of prefixes of a network which are tried on the allocation of a random ip.
+		// Zero tries all prefixes.
+		MaxPrefixAttempts int
+		// ProjectLookupTimeout limits the duration the lookup of the project of an ip allocation may take, independent of the request deadline.
+		// A timeout of zero disables the limit.
+		ProjectLookupTimeout time.Duration
+		// ChargeableRule configures which ips are chargeable, no ip is chargeable by default.
+		ChargeableRule metal.ChargeableRule
+		// LengthLimits are the maximum lengths of names and descriptions, validate.DefaultLengthLimits are used if not set.
+		LengthLimits validate.LengthLimits
+		// IPAMNamespace returns the ipam namespace the prefixes of a network are created, acquired and released in.
+		// If not set, all prefixes are kept in the default namespace of ipam.
+		// The namespace of a network must not change once the network exists, its prefixes would not be found in ipam anymore.
+		IPAMNamespace IPAMNamespaceFunc
+		// PrefixWarningThreshold is the utilization of a prefix in percent from which on a warning is returned for allocations in it.
+		// The allocation itself succeeds regardless of the utilization. A threshold of zero disables the warning.
+		PrefixWarningThreshold int
+		// NetworkCacheTTL configures how long networks are cached for the allocation of ips.
+		// A ttl of zero disables the cache.
+		NetworkCacheTTL time.Duration
+	}
+
 	Repostore struct { // TODO naming
-		log  *slog.Logger
-		ds   *generic.Datastore
-		mdc  mdm.Client
-		ipam ipamv1connect.IpamServiceClient
-		q    *tx.Queue
+		log   *slog.Logger
+		ds    *generic.Datastore
+		mdc   mdm.Client
+		ipam  ipamv1connect.IpamServiceClient
+		q     *tx.Queue
+		redis *redis.Client
+
+		// prefixIndexes caches the prefix index per network id
+		prefixIndexes sync.Map
+		// networks caches the networks used by the allocation of ips per network id
+		networks        sync.Map
+		networkCacheTTL time.Duration
+
+		allocationTimeout time.Duration
+		// allocationLatencies keeps the latencies of the recent allocations in ipam
+		allocationLatencies  *latencyRing
+		machineRetryWindow   time.Duration
+		maxPrefixAttempts    int
+		projectLookupTimeout time.Duration
+		chargeableRule       metal.ChargeableRule
+		lengthLimits         validate.LengthLimits
+		ipamNamespaceFn      IPAMNamespaceFunc
+		// prefixWarningThreshold is the utilization of a prefix in percent from which on allocations are warned about
+		prefixWarningThreshold int
 	}
 
 	ProjectScope struct {
@@ -48,13 +167,28 @@ type (
 	}
 )
 
-func New(log *slog.Logger, mdc mdm.Client, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient, redis *redis.Client) (*Repostore, error) {
+func New(log *slog.Logger, mdc mdm.Client, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient, redis *redis.Client, c Config) (*Repostore, error) {
+	lengthLimits := c.LengthLimits
+	if lengthLimits == (validate.LengthLimits{}) {
+		lengthLimits = validate.DefaultLengthLimits
+	}
 
 	r := &Repostore{
-		log:  log,
-		mdc:  mdc,
-		ipam: ipam,
-		ds:   ds,
+		log:                    log,
+		mdc:                    mdc,
+		ipam:                   ipam,
+		ds:                     ds,
+		redis:                  redis,
+		networkCacheTTL:        c.NetworkCacheTTL,
+		allocationTimeout:      c.AllocationTimeout,
+		allocationLatencies:    newLatencyRing(allocationLatencySamples),
+		machineRetryWindow:     c.MachineRetryWindow,
+		maxPrefixAttempts:      c.MaxPrefixAttempts,
+		projectLookupTimeout:   c.ProjectLookupTimeout,
+		chargeableRule:         c.ChargeableRule,
+		lengthLimits:           lengthLimits,
+		ipamNamespaceFn:        c.IPAMNamespace,
+		prefixWarningThreshold: c.PrefixWarningThreshold,
 	}
 
 	actionFn := r.getActionFn()
@@ -69,7 +203,7 @@ func New(log *slog.Logger, mdc mdm.Client, ds *generic.Datastore, ipam ipamv1con
 	return r, nil
 }
 
-func (r *Repostore) IP(project *string) Repository[*metal.IP, *apiv2.IP, *apiv2.IPServiceCreateRequest, *apiv2.IPServiceUpdateRequest, *apiv2.IPQuery] {
+func (r *Repostore) IP(project *string) IPRepository {
 	var scope *ProjectScope
 	if project != nil {
 		scope = &ProjectScope{
@@ -33,7 +33,7 @@ func TestGet(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ip, err := repo.IP(pointer.Pointer("project1")).Get(ctx, "asdf")
@@ -61,7 +61,7 @@ func TestIpUnscopedList(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ips, err := repo.IP(nil).List(ctx, nil)
@@ -1,9 +1,17 @@
 package validate
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/metal-stack/api-server/pkg/db/metal"
 	apiv1 "github.com/metal-stack/api/go/metalstack/api/v2"
+	"github.com/metal-stack/metal-lib/pkg/tag"
 )
 
 func ValidateAddressFamily(af apiv1.IPAddressFamily) error {
@@ -16,3 +24,159 @@ func ValidateAddressFamily(af apiv1.IPAddressFamily) error {
 		return fmt.Errorf("unsupported addressfamily: %s", af.String())
 	}
 }
+
+// ValidateIPCreateRequest checks the fields of a create request which are required or mutually exclusive,
+// all of these checks are done here to have them in one place.
+func ValidateIPCreateRequest(req *apiv1.IPServiceCreateRequest) error {
+	if req.Network == "" {
+		return fmt.Errorf("network should not be empty")
+	}
+	if req.Project == "" {
+		return fmt.Errorf("project should not be empty")
+	}
+	if req.Ip != nil && req.AddressFamily != nil {
+		return fmt.Errorf("it is not possible to specify specificIP and addressfamily")
+	}
+	if req.MachineId != nil {
+		if machineID, ok := tag.NewTagMap(req.Tags).Value(tag.MachineID); ok && machineID != *req.MachineId {
+			return fmt.Errorf("machine id %q contradicts the tag %s=%s", *req.MachineId, tag.MachineID, machineID)
+		}
+	}
+
+	return nil
+}
+
+// LengthLimits are the maximum number of characters of the name and the description of an entity, a limit of zero disables the check.
+type LengthLimits struct {
+	Name        int
+	Description int
+}
+
+// DefaultLengthLimits are used unless other limits are configured.
+var DefaultLengthLimits = LengthLimits{Name: 128, Description: 2048}
+
+// ValidateNameAndDescription checks that name and description do not exceed the given limits.
+func ValidateNameAndDescription(name, description string, limits LengthLimits) error {
+	if n := utf8.RuneCountInString(name); limits.Name > 0 && n > limits.Name {
+		return fmt.Errorf("name must not be longer than %d characters but has %d", limits.Name, n)
+	}
+	if n := utf8.RuneCountInString(description); limits.Description > 0 && n > limits.Description {
+		return fmt.Errorf("description must not be longer than %d characters but has %d", limits.Description, n)
+	}
+	return nil
+}
+
+// ValidateIPTypeAndTags checks that the type of an ip does not contradict the conventions of its tags:
+// ips which are marked as ephemeral ip of a firewall are released together with the firewall and therefore must be ephemeral.
+func ValidateIPTypeAndTags(ipType metal.IPType, tags []string) error {
+	tm := tag.NewTagMap(tags)
+
+	if _, ok := tm.Value(metal.TagFirewallEphemeralIP); ok && ipType != metal.Ephemeral {
+		return fmt.Errorf("ip with tag %s must be of type %s but is %s", metal.TagFirewallEphemeralIP, metal.Ephemeral, ipType)
+	}
+
+	return nil
+}
+
+// ValidateReservedTags checks that no tag uses a key which is reserved for a field of an ip.
+// Such tags would be mistaken for the field by clients, so they are rejected instead of being stored.
+func ValidateReservedTags(tags []string) error {
+	var reserved []string
+	for _, t := range tags {
+		key, _, _ := strings.Cut(t, "=")
+		if slices.Contains(metal.ReservedIPTagKeys, key) && !slices.Contains(reserved, key) {
+			reserved = append(reserved, key)
+		}
+	}
+	if len(reserved) > 0 {
+		return fmt.Errorf("ip tags must not use the reserved keys: %s", strings.Join(reserved, ", "))
+	}
+	return nil
+}
+
+// ValidateTagIntegrity checks that every tag has a key and that no key is given more than once.
+// Tags violating this are collapsed silently by a tag map, which keeps the last value of a key.
+func ValidateTagIntegrity(tags []string) error {
+	var (
+		malformed  []string
+		duplicates []string
+		seen       = map[string]bool{}
+	)
+	for _, t := range tags {
+		key, _, _ := strings.Cut(t, "=")
+		if key == "" {
+			malformed = append(malformed, t)
+			continue
+		}
+		if seen[key] && !slices.Contains(duplicates, key) {
+			duplicates = append(duplicates, key)
+		}
+		seen[key] = true
+	}
+
+	var errs []error
+	if len(malformed) > 0 {
+		errs = append(errs, fmt.Errorf("ip has malformed tags without key: %q", malformed))
+	}
+	if len(duplicates) > 0 {
+		errs = append(errs, fmt.Errorf("ip has tags with duplicate keys: %s", strings.Join(duplicates, ", ")))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateIPLease checks that the lease of an ip, if any, is not expired.
+// An ip with an expired lease is considered orphaned and can be reclaimed.
+func ValidateIPLease(tags []string, now time.Time) error {
+	tm := tag.NewTagMap(tags)
+
+	value, ok := tm.Value(metal.TagIPLeaseExpiry)
+	if !ok {
+		return nil
+	}
+
+	expiry, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("ip has a malformed lease expiry %q: %w", value, err)
+	}
+	if now.After(expiry) {
+		owner, _ := tm.Value(metal.TagIPOwner)
+		return fmt.Errorf("ip lease of owner %q expired at %s", owner, expiry.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// ValidateIPInParentPrefix checks that the address of an ip, or its host prefix, is contained in its recorded parent prefix.
+// Ips without parent prefix are not checked.
+func ValidateIPInParentPrefix(address, parentPrefixCidr string) error {
+	if parentPrefixCidr == "" {
+		return nil
+	}
+
+	pfx, err := netip.ParsePrefix(parentPrefixCidr)
+	if err != nil {
+		return fmt.Errorf("ip has a malformed parent prefix %q: %w", parentPrefixCidr, err)
+	}
+
+	if metal.IsHostPrefix(address) {
+		hostPrefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return fmt.Errorf("ip has a malformed host prefix %q: %w", address, err)
+		}
+		if hostPrefix.Bits() < pfx.Bits() || !pfx.Contains(hostPrefix.Addr()) {
+			return fmt.Errorf("ip host prefix %s is not contained in its parent prefix %s", address, parentPrefixCidr)
+		}
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("ip has a malformed address %q: %w", address, err)
+	}
+	if !pfx.Contains(addr) {
+		return fmt.Errorf("ip address %s is not contained in its parent prefix %s", address, parentPrefixCidr)
+	}
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v2"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIPTypeAndTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipType  metal.IPType
+		tags    []string
+		wantErr string
+	}{
+		{
+			name:   "ephemeral firewall ip is consistent",
+			ipType: metal.Ephemeral,
+			tags:   []string{tag.New(metal.TagFirewallEphemeralIP, "fw1"), tag.New(tag.MachineID, "fw1")},
+		},
+		{
+			name:   "static ip without conventional tags is consistent",
+			ipType: metal.Static,
+			tags:   []string{"color=red"},
+		},
+		{
+			name:   "static machine ip is consistent",
+			ipType: metal.Static,
+			tags:   []string{tag.New(tag.MachineID, "m1")},
+		},
+		{
+			name:    "static ip marked as ephemeral firewall ip is contradictory",
+			ipType:  metal.Static,
+			tags:    []string{tag.New(metal.TagFirewallEphemeralIP, "fw1"), tag.New(tag.MachineID, "fw1")},
+			wantErr: "ip with tag firewall.metal-stack.io/ephemeral-ip must be of type ephemeral but is static",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateIPTypeAndTags(tt.ipType, tt.tags)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateReservedTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		wantErr string
+	}{
+		{
+			name: "tags without reserved keys",
+			tags: []string{"a=1", tag.New(tag.MachineID, "m1"), "flag"},
+		},
+		{
+			name:    "static reason",
+			tags:    []string{"a=1", tag.New(metal.TagIPStaticReason, "dns entry")},
+			wantErr: "ip tags must not use the reserved keys: ip.metal-stack.io/static-reason",
+		},
+		{
+			name:    "reserved keys without value are reported once",
+			tags:    []string{metal.TagIPChargeable, tag.New(metal.TagIPTransferTarget, "p2"), tag.New(metal.TagIPChargeable, "false")},
+			wantErr: "ip tags must not use the reserved keys: ip.metal-stack.io/chargeable, ip.metal-stack.io/transfer-target",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateReservedTags(tt.tags)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateTagIntegrity(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		wantErr string
+	}{
+		{
+			name: "valid tags",
+			tags: []string{"a=1", "b=2", "flag"},
+		},
+		{
+			name:    "duplicate keys",
+			tags:    []string{"a=1", "b=2", "a=3", "b=2", "a"},
+			wantErr: "ip has tags with duplicate keys: a, b",
+		},
+		{
+			name:    "malformed tags",
+			tags:    []string{"a=1", "=2", ""},
+			wantErr: `ip has malformed tags without key: ["=2" ""]`,
+		},
+		{
+			name:    "malformed and duplicate",
+			tags:    []string{"a=1", "=2", "a=1"},
+			wantErr: "ip has malformed tags without key: [\"=2\"]\nip has tags with duplicate keys: a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTagIntegrity(tt.tags)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateIPLease(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		tags    []string
+		wantErr string
+	}{
+		{
+			name: "ip without lease",
+			tags: []string{tag.New(tag.MachineID, "m1")},
+		},
+		{
+			name: "ip with running lease",
+			tags: []string{tag.New(metal.TagIPOwner, "machine:m1"), tag.New(metal.TagIPLeaseExpiry, "2024-05-02T12:00:00Z")},
+		},
+		{
+			name:    "ip with expired lease",
+			tags:    []string{tag.New(metal.TagIPOwner, "machine:m1"), tag.New(metal.TagIPLeaseExpiry, "2024-04-30T12:00:00Z")},
+			wantErr: `ip lease of owner "machine:m1" expired at 2024-04-30T12:00:00Z`,
+		},
+		{
+			name:    "ip with malformed lease",
+			tags:    []string{tag.New(metal.TagIPLeaseExpiry, "tomorrow")},
+			wantErr: `ip has a malformed lease expiry "tomorrow": parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateIPLease(tt.tags, now)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateIPInParentPrefix(t *testing.T) {
+	tests := []struct {
+		name             string
+		address          string
+		parentPrefixCidr string
+		wantErr          string
+	}{
+		{
+			name:             "ip in its parent prefix",
+			address:          "1.2.3.4",
+			parentPrefixCidr: "1.2.3.0/24",
+		},
+		{
+			name:             "v6 ip in its parent prefix",
+			address:          "2001:db8::1",
+			parentPrefixCidr: "2001:db8::/64",
+		},
+		{
+			name:    "ip without parent prefix",
+			address: "1.2.3.4",
+		},
+		{
+			name:             "ip outside of its parent prefix",
+			address:          "1.2.4.4",
+			parentPrefixCidr: "1.2.3.0/24",
+			wantErr:          "ip address 1.2.4.4 is not contained in its parent prefix 1.2.3.0/24",
+		},
+		{
+			name:             "ip of another addressfamily than its parent prefix",
+			address:          "2001:db8::1",
+			parentPrefixCidr: "1.2.3.0/24",
+			wantErr:          "ip address 2001:db8::1 is not contained in its parent prefix 1.2.3.0/24",
+		},
+		{
+			name:             "host prefix in its parent prefix",
+			address:          "2001:db8:0:1::/64",
+			parentPrefixCidr: "2001:db8::/48",
+		},
+		{
+			name:             "host prefix outside of its parent prefix",
+			address:          "2001:db9:0:1::/64",
+			parentPrefixCidr: "2001:db8::/48",
+			wantErr:          "ip host prefix 2001:db9:0:1::/64 is not contained in its parent prefix 2001:db8::/48",
+		},
+		{
+			name:             "host prefix larger than its parent prefix",
+			address:          "2001:db8::/32",
+			parentPrefixCidr: "2001:db8::/48",
+			wantErr:          "ip host prefix 2001:db8::/32 is not contained in its parent prefix 2001:db8::/48",
+		},
+		{
+			name:             "malformed parent prefix",
+			address:          "1.2.3.4",
+			parentPrefixCidr: "1.2.3.0",
+			wantErr:          `ip has a malformed parent prefix "1.2.3.0": netip.ParsePrefix("1.2.3.0"): no '/'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateIPInParentPrefix(tt.address, tt.parentPrefixCidr)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateIPCreateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     *apiv1.IPServiceCreateRequest
+		wantErr string
+	}{
+		{
+			name: "specific ip",
+			req:  &apiv1.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.3.4")},
+		},
+		{
+			name: "addressfamily",
+			req:  &apiv1.IPServiceCreateRequest{Network: "internet", Project: "p1", AddressFamily: apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()},
+		},
+		{
+			name: "machine id and matching tag",
+			req:  &apiv1.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1"), Tags: []string{tag.New(tag.MachineID, "m1")}},
+		},
+		{
+			name:    "network is missing",
+			req:     &apiv1.IPServiceCreateRequest{Project: "p1"},
+			wantErr: "network should not be empty",
+		},
+		{
+			name:    "project is missing",
+			req:     &apiv1.IPServiceCreateRequest{Network: "internet"},
+			wantErr: "project should not be empty",
+		},
+		{
+			name:    "specific ip and addressfamily",
+			req:     &apiv1.IPServiceCreateRequest{Network: "internet", Project: "p1", Ip: pointer.Pointer("1.2.3.4"), AddressFamily: apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V4.Enum()},
+			wantErr: "it is not possible to specify specificIP and addressfamily",
+		},
+		{
+			name:    "machine id contradicts tag",
+			req:     &apiv1.IPServiceCreateRequest{Network: "internet", Project: "p1", MachineId: pointer.Pointer("m1"), Tags: []string{tag.New(tag.MachineID, "m2")}},
+			wantErr: `machine id "m1" contradicts the tag machine.metal-stack.io/id=m2`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateIPCreateRequest(tt.req)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateNameAndDescription(t *testing.T) {
+	limits := LengthLimits{Name: 10, Description: 20}
+
+	tests := []struct {
+		name        string
+		ipName      string
+		description string
+		limits      LengthLimits
+		wantErr     string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:        "at the limits",
+			ipName:      strings.Repeat("n", 10),
+			description: strings.Repeat("d", 20),
+			limits:      limits,
+		},
+		{
+			name:        "multibyte characters are counted once",
+			ipName:      strings.Repeat("ü", 10),
+			description: strings.Repeat("€", 20),
+			limits:      limits,
+		},
+		{
+			name:    "name just over the limit",
+			ipName:  strings.Repeat("n", 11),
+			limits:  limits,
+			wantErr: "name must not be longer than 10 characters but has 11",
+		},
+		{
+			name:        "description just over the limit",
+			description: strings.Repeat("d", 21),
+			limits:      limits,
+			wantErr:     "description must not be longer than 20 characters but has 21",
+		},
+		{
+			name:        "no limits",
+			ipName:      strings.Repeat("n", 1000),
+			description: strings.Repeat("d", 10000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNameAndDescription(tt.ipName, tt.description, tt.limits)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
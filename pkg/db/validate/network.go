@@ -0,0 +1,42 @@
+package validate
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+// ValidateNetworkAddressFamilies checks that the addressfamilies of a network are exactly the addressfamilies of its prefixes.
+// Otherwise allocations for a claimed addressfamily without prefixes fail.
+func ValidateNetworkAddressFamilies(nw *metal.Network) error {
+	var afs metal.AddressFamilies
+	for _, prefix := range nw.Prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			return fmt.Errorf("network:%s has a malformed prefix %s: %w", nw.ID, prefix.String(), err)
+		}
+
+		af := metal.IPv4AddressFamily
+		if pfx.Addr().Is6() {
+			af = metal.IPv6AddressFamily
+		}
+		if !slices.Contains(afs, af) {
+			afs = append(afs, af)
+		}
+	}
+
+	for _, af := range nw.AddressFamilies {
+		if !slices.Contains(afs, af) {
+			return fmt.Errorf("network:%s claims addressfamily %s but has no prefix of it", nw.ID, af)
+		}
+	}
+	for _, af := range afs {
+		if !slices.Contains(nw.AddressFamilies, af) {
+			return fmt.Errorf("network:%s has prefixes of addressfamily %s but does not claim it", nw.ID, af)
+		}
+	}
+
+	return nil
+}
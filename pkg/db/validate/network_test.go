@@ -0,0 +1,66 @@
+package validate
+
+import (
+	"testing"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNetworkAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		nw      *metal.Network
+		wantErr string
+	}{
+		{
+			name: "dualstack network is consistent",
+			nw: &metal.Network{
+				Base:            metal.Base{ID: "n1"},
+				Prefixes:        metal.Prefixes{{IP: "10.0.0.0", Length: "24"}, {IP: "2001:db8::", Length: "96"}},
+				AddressFamilies: metal.AddressFamilies{metal.IPv6AddressFamily, metal.IPv4AddressFamily},
+			},
+		},
+		{
+			name: "network without prefixes and addressfamilies is consistent",
+			nw:   &metal.Network{Base: metal.Base{ID: "n1"}},
+		},
+		{
+			name: "claimed addressfamily without prefix",
+			nw: &metal.Network{
+				Base:            metal.Base{ID: "n1"},
+				Prefixes:        metal.Prefixes{{IP: "10.0.0.0", Length: "24"}},
+				AddressFamilies: metal.AddressFamilies{metal.IPv4AddressFamily, metal.IPv6AddressFamily},
+			},
+			wantErr: "network:n1 claims addressfamily IPv6 but has no prefix of it",
+		},
+		{
+			name: "prefix of unclaimed addressfamily",
+			nw: &metal.Network{
+				Base:            metal.Base{ID: "n1"},
+				Prefixes:        metal.Prefixes{{IP: "10.0.0.0", Length: "24"}, {IP: "2001:db8::", Length: "96"}},
+				AddressFamilies: metal.AddressFamilies{metal.IPv4AddressFamily},
+			},
+			wantErr: "network:n1 has prefixes of addressfamily IPv6 but does not claim it",
+		},
+		{
+			name: "malformed prefix",
+			nw: &metal.Network{
+				Base:            metal.Base{ID: "n1"},
+				Prefixes:        metal.Prefixes{{IP: "10.0.0", Length: "24"}},
+				AddressFamilies: metal.AddressFamilies{metal.IPv4AddressFamily},
+			},
+			wantErr: `network:n1 has a malformed prefix 10.0.0/24: netip.ParsePrefix("10.0.0/24"): ParseAddr("10.0.0"): IPv4 address too short`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNetworkAddressFamilies(tt.nw)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
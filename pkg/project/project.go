@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"connectrpc.com/connect"
 	tutil "github.com/metal-stack/api-server/pkg/tenant"
@@ -17,6 +18,12 @@ const (
 	DefaultProjectAnnotation = "metal-stack.io/default-project"
 	ProjectRoleAnnotation    = "metal-stack.io/project-role"
 	AvatarURLAnnotation      = "avatarUrl"
+	// SuspendedProjectAnnotation marks a project as suspended, suspended projects can not allocate new resources.
+	// Projects without this annotation are never considered suspended.
+	SuspendedProjectAnnotation = "metal-stack.io/suspended"
+	// AddressFamiliesAnnotation restricts the addressfamilies a project can allocate ips of, given comma separated, e.g. IPv4.
+	// Projects without this annotation are not restricted.
+	AddressFamiliesAnnotation = "metal-stack.io/addressfamilies"
 )
 
 func ProjectRoleFromMap(annotations map[string]string) apiv1.ProjectRole {
@@ -64,6 +71,46 @@ func IsDefaultProject(p *mdcv1.Project) bool {
 	return res
 }
 
+// AllowedAddressFamilies returns the addressfamilies the project is restricted to, it returns nil if the project is not restricted.
+func AllowedAddressFamilies(p *mdcv1.Project) []string {
+	if p.Meta == nil {
+		return nil
+	}
+
+	value, ok := p.Meta.Annotations[AddressFamiliesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var res []string
+	for af := range strings.SplitSeq(value, ",") {
+		af = strings.TrimSpace(af)
+		if af != "" {
+			res = append(res, af)
+		}
+	}
+
+	return res
+}
+
+func IsSuspended(p *mdcv1.Project) bool {
+	if p.Meta == nil {
+		return false
+	}
+
+	value, ok := p.Meta.Annotations[SuspendedProjectAnnotation]
+	if !ok {
+		return false
+	}
+
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		return false
+	}
+
+	return res
+}
+
 func GetProjectMember(ctx context.Context, c mdc.Client, projectID, tenantID string) (*mdcv1.ProjectMember, *mdcv1.Project, error) {
 	getResp, err := c.Project().Get(ctx, &mdcv1.ProjectGetRequest{
 		Id: projectID,
@@ -244,3 +244,80 @@ func TestGetProjectsAndTenants(t *testing.T) {
 		})
 	}
 }
+
+func TestIsSuspended(t *testing.T) {
+	tests := []struct {
+		name string
+		p    *mdcv1.Project
+		want bool
+	}{
+		{
+			name: "no meta",
+			p:    &mdcv1.Project{},
+			want: false,
+		},
+		{
+			name: "no annotation",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1"}},
+			want: false,
+		},
+		{
+			name: "suspended",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1", Annotations: map[string]string{SuspendedProjectAnnotation: "true"}}},
+			want: true,
+		},
+		{
+			name: "not suspended",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1", Annotations: map[string]string{SuspendedProjectAnnotation: "false"}}},
+			want: false,
+		},
+		{
+			name: "malformed annotation",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1", Annotations: map[string]string{SuspendedProjectAnnotation: "maybe"}}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSuspended(tt.p); got != tt.want {
+				t.Errorf("IsSuspended() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name string
+		p    *mdcv1.Project
+		want []string
+	}{
+		{
+			name: "no meta",
+			p:    &mdcv1.Project{},
+			want: nil,
+		},
+		{
+			name: "no annotation",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1"}},
+			want: nil,
+		},
+		{
+			name: "single family",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1", Annotations: map[string]string{AddressFamiliesAnnotation: "IPv4"}}},
+			want: []string{"IPv4"},
+		},
+		{
+			name: "both families with spaces",
+			p:    &mdcv1.Project{Meta: &mdcv1.Meta{Id: "p1", Annotations: map[string]string{AddressFamiliesAnnotation: "IPv4, IPv6,"}}},
+			want: []string{"IPv4", "IPv6"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, AllowedAddressFamilies(tt.p)); diff != "" {
+				t.Errorf("AllowedAddressFamilies() diff = %s", diff)
+			}
+		})
+	}
+}
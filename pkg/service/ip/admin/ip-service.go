@@ -2,6 +2,7 @@ package admin
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 
 	"connectrpc.com/connect"
@@ -60,5 +61,27 @@ func (i *ipServiceServer) List(ctx context.Context, rq *connect.Request[adminv2.
 }
 
 func (i *ipServiceServer) Issues(ctx context.Context, rq *connect.Request[adminv2.IPServiceIssuesRequest]) (*connect.Response[adminv2.IPServiceIssuesResponse], error) {
-	panic("unimplemented")
+	i.log.Debug("issues", "ip", rq)
+
+	issues, err := i.repo.IP(nil).Issues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*adminv2.IPIssue
+	for _, issue := range issues {
+		converted, err := i.repo.IP(nil).ConvertToProto(issue.IP)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		// the api has no fields for the problem and the remediation yet, they are passed along with the description
+		res = append(res, &adminv2.IPIssue{
+			Description: fmt.Sprintf("%s: %s, remediation: %s", issue.Problem, issue.Description, issue.Remediation),
+			Ip:          converted,
+		})
+	}
+
+	return connect.NewResponse(&adminv2.IPServiceIssuesResponse{
+		Issues: res,
+	}), nil
 }
@@ -112,15 +112,12 @@ func (i *ipServiceServer) Create(ctx context.Context, rq *connect.Request[apiv2.
 	i.log.Debug("create", "ip", rq)
 	req := rq.Msg
 
-	if req.Network == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("network should not be empty"))
-	}
-	if req.Project == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("project should not be empty"))
-	}
-
 	created, err := i.repo.IP(&req.Project).Create(ctx, req)
 	if err != nil {
+		var connectErr *connect.Error
+		if errors.As(err, &connectErr) {
+			return nil, connectErr
+		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
@@ -129,6 +126,15 @@ func (i *ipServiceServer) Create(ctx context.Context, rq *connect.Request[apiv2.
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
+	// the ip is allocated already, a failed utilization check must not fail the request.
+	// the create response has no field for warnings, so operators are told by the log.
+	warning, err := i.repo.IP(&req.Project).PrefixUtilizationWarning(ctx, created)
+	if err != nil {
+		i.log.Warn("unable to check prefix utilization", "ip", created.IPAddress, "prefix", created.ParentPrefixCidr, "error", err)
+	} else if warning != "" {
+		i.log.Warn("prefix nearly exhausted", "ip", created.IPAddress, "network", created.NetworkID, "warning", warning)
+	}
+
 	return connect.NewResponse(&apiv2.IPServiceCreateResponse{Ip: converted}), nil
 }
 
@@ -1,6 +1,7 @@
 package ip
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"log/slog"
@@ -15,6 +16,7 @@ import (
 	"github.com/metal-stack/api-server/pkg/db/generic"
 	"github.com/metal-stack/api-server/pkg/db/metal"
 	"github.com/metal-stack/api-server/pkg/db/repository"
+	putil "github.com/metal-stack/api-server/pkg/project"
 	"github.com/metal-stack/api-server/pkg/test"
 	apiv2 "github.com/metal-stack/api/go/metalstack/api/v2"
 	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
@@ -23,6 +25,7 @@ import (
 	mdmock "github.com/metal-stack/masterdata-api/api/v1/mocks"
 	mdm "github.com/metal-stack/masterdata-api/pkg/client"
 	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/metal-stack/metal-lib/pkg/tag"
 	"github.com/redis/go-redis/v9"
 	testifymock "github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -30,8 +33,8 @@ import (
 )
 
 var prefixMap = map[string][]string{
-	"1.2.3.0/24":    {"1.2.3.4", "1.2.3.5", "1.2.3.6"},
-	"2.3.4.0/24":    {"2.3.4.5"},
+	"1.2.3.0/24":    {"1.2.3.4", "1.2.3.5", "1.2.3.6", "1.2.3.7"},
+	"2.3.4.0/24":    {"2.3.4.5", "2.3.4.6", "2.3.4.7"},
 	"2001:db8::/96": {"2001:db8::1"},
 }
 
@@ -52,7 +55,7 @@ func Test_ipServiceServer_Get(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	createIPs(t, ctx, ds, ipam, prefixMap, []*metal.IP{{IPAddress: "1.2.3.4", ProjectID: "p1"}})
@@ -138,7 +141,7 @@ func Test_ipServiceServer_List(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -247,7 +250,7 @@ func Test_ipServiceServer_Update(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -256,9 +259,20 @@ func Test_ipServiceServer_Update(t *testing.T) {
 		{Name: "ip3", IPAddress: "1.2.3.6", ProjectID: "p1", NetworkID: "n1"},
 		{Name: "ip4", IPAddress: "2001:db8::1", ProjectID: "p2", NetworkID: "n2", Tags: []string{"color=red"}},
 		{Name: "ip5", IPAddress: "2.3.4.5", ProjectID: "p2", NetworkID: "n3", ParentPrefixCidr: "2.3.4.0/24"},
+		{Name: "ip6", IPAddress: "1.2.3.7", ProjectID: "p1", Type: metal.Ephemeral, Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")}},
+		{Name: "ip8", IPAddress: "2.3.4.7", ProjectID: "p1", Type: metal.Static, Tags: []string{tag.New(tag.MachineID, "m1")}},
+		{Name: "ip7", IPAddress: "2.3.4.6", ProjectID: "p1", NetworkID: "ephemeral-only-network", Type: metal.Ephemeral},
 	}
 	createIPs(t, ctx, ds, ipam, prefixMap, ips)
 
+	for _, nw := range []*metal.Network{
+		{Base: metal.Base{ID: "n1"}},
+		{Base: metal.Base{ID: "ephemeral-only-network"}, Labels: map[string]string{metal.NetworkLabelEphemeralOnly: "true"}},
+	} {
+		_, err := ds.Network().Create(ctx, nw)
+		require.NoError(t, err)
+	}
+
 	tests := []struct {
 		name           string
 		log            *slog.Logger
@@ -305,6 +319,45 @@ func Test_ipServiceServer_Update(t *testing.T) {
 			want:    &apiv2.IPServiceUpdateResponse{Ip: &apiv2.IP{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2", Tags: []string{"color=red", "purpose=lb"}}},
 			wantErr: false,
 		},
+		{
+			name:           "update ephemeral firewall ip to static is contradictory",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv2.IPServiceUpdateRequest{Ip: "1.2.3.7", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum(), Tags: []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")}},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name: "update name of static machine ip",
+			log:  log,
+			ctx:  ctx,
+			rq:   &apiv2.IPServiceUpdateRequest{Ip: "2.3.4.7", Project: "p1", Name: pointer.Pointer("ip8-changed"), Tags: []string{tag.New(tag.MachineID, "m1")}},
+			ds:   ds,
+			// the machine tag is internal and not shown to users
+			want:    &apiv2.IPServiceUpdateResponse{Ip: &apiv2.IP{Name: "ip8-changed", Ip: "2.3.4.7", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC}},
+			wantErr: false,
+		},
+		{
+			name:    "update name of static machine ip without the internal tags",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv2.IPServiceUpdateRequest{Ip: "2.3.4.7", Project: "p1", Name: pointer.Pointer("ip8"), Tags: []string{"a=b"}},
+			ds:      ds,
+			want:    &apiv2.IPServiceUpdateResponse{Ip: &apiv2.IP{Name: "ip8", Ip: "2.3.4.7", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC, Tags: []string{"a=b"}}},
+			wantErr: false,
+		},
+		{
+			name:           "update ip in ephemeral only network to static",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv2.IPServiceUpdateRequest{Ip: "2.3.4.6", Project: "p1", Type: apiv2.IPType_IP_TYPE_STATIC.Enum()},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -359,7 +412,7 @@ func Test_ipServiceServer_Delete(t *testing.T) {
 	ds, err := generic.New(log, "metal", c)
 	require.NoError(t, err)
 
-	repo, err := repository.New(log, nil, ds, ipam, rc)
+	repo, err := repository.New(log, nil, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -368,6 +421,7 @@ func Test_ipServiceServer_Delete(t *testing.T) {
 		{Name: "ip3", IPAddress: "1.2.3.6", ProjectID: "p1", NetworkID: "n1", ParentPrefixCidr: "1.2.3.0/24", AllocationUUID: uuid.NewString()},
 		{Name: "ip4", IPAddress: "2001:db8::1", ProjectID: "p2", NetworkID: "n2", ParentPrefixCidr: "2001:db8::/64", AllocationUUID: uuid.NewString()},
 		{Name: "ip5", IPAddress: "2.3.4.5", ProjectID: "p2", NetworkID: "n3", ParentPrefixCidr: "2.3.4.0/24", AllocationUUID: uuid.NewString()},
+		{Name: "ip6", IPAddress: "1.2.3.7", ProjectID: "p1", ParentPrefixCidr: "1.2.3.0/24", AllocationUUID: uuid.NewString(), Tags: []string{tag.New(tag.MachineID, "m1")}},
 	}
 	createIPs(t, ctx, ds, ipam, prefixMap, ips)
 
@@ -394,12 +448,22 @@ func Test_ipServiceServer_Delete(t *testing.T) {
 			name:           "delete unknown ip",
 			log:            log,
 			ctx:            ctx,
-			rq:             &apiv2.IPServiceDeleteRequest{Ip: "1.2.3.7", Project: "p1"},
+			rq:             &apiv2.IPServiceDeleteRequest{Ip: "1.2.3.8", Project: "p1"},
 			ds:             ds,
 			want:           nil,
 			wantErr:        true,
 			wantReturnCode: connect.CodeNotFound,
 		},
+		{
+			name:           "delete ip which is still used by a machine",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv2.IPServiceDeleteRequest{Ip: "1.2.3.7", Project: "p1"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -466,11 +530,15 @@ func Test_ipServiceServer_Create(t *testing.T) {
 		Project: &mdmv1.Project{
 			Meta: &mdmv1.Meta{Id: "p1"},
 		}}, nil)
+	psc.On("Get", testifymock.Anything, &mdmv1.ProjectGetRequest{Id: "p3"}).Return(&mdmv1.ProjectResponse{
+		Project: &mdmv1.Project{
+			Meta: &mdmv1.Meta{Id: "p3", Annotations: map[string]string{putil.SuspendedProjectAnnotation: "true"}},
+		}}, nil)
 	tsc := mdmock.TenantServiceClient{}
 
 	mdc := mdm.NewMock(&psc, &tsc, nil, nil)
 
-	repo, err := repository.New(log, mdc, ds, ipam, rc)
+	repo, err := repository.New(log, mdc, ds, ipam, rc, repository.Config{})
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -485,6 +553,8 @@ func Test_ipServiceServer_Create(t *testing.T) {
 		{Id: pointer.Pointer("tenant-network"), Prefixes: []string{"10.2.0.0/24"}, Options: &apiv2.NetworkOptions{PrivateSuper: true}},
 		{Id: pointer.Pointer("tenant-network-v6"), Prefixes: []string{"2001:db8:1::/64"}, Options: &apiv2.NetworkOptions{PrivateSuper: true}},
 		{Id: pointer.Pointer("tenant-network-dualstack"), Prefixes: []string{"10.3.0.0/24", "2001:db8:2::/64"}, Options: &apiv2.NetworkOptions{PrivateSuper: true}},
+		{Id: pointer.Pointer("ephemeral-only-network"), Prefixes: []string{"10.4.0.0/24"}, Labels: map[string]string{metal.NetworkLabelEphemeralOnly: "true"}},
+		{Id: pointer.Pointer("no-specific-ip-network"), Prefixes: []string{"10.5.0.0/24"}, Labels: map[string]string{metal.NetworkLabelNoSpecificIP: "true"}},
 	}
 	createNetworks(t, ctx, repo, nws)
 	createIPs(t, ctx, ds, ipam, prefixMap, ips)
@@ -581,17 +651,17 @@ func Test_ipServiceServer_Create(t *testing.T) {
 			},
 		},
 		{
-			name: "create specific ipv4 which is already allocated",
+			name: "create specific ipv4 which is already allocated by another project",
 			ctx:  ctx,
 			rq: &apiv2.IPServiceCreateRequest{
 				Network: "internet",
-				Project: "p1",
+				Project: "p2",
 				Ip:      pointer.Pointer("1.2.0.1"),
 			},
 			want:           nil,
 			wantErr:        true,
-			wantReturnCode: connect.CodeInternal, // FIXME should be InvalidArgument
-			wantErrMessage: "internal: internal: Conflict ip already allocated",
+			wantReturnCode: connect.CodeAlreadyExists,
+			wantErrMessage: "already_exists: Conflict ip already allocated",
 		},
 		{
 			name: "allocate a static specific ip outside prefix",
@@ -603,8 +673,8 @@ func Test_ipServiceServer_Create(t *testing.T) {
 			},
 			want:           nil,
 			wantErr:        true,
-			wantReturnCode: connect.CodeInternal, // FIXME should be InvalidArgument
-			wantErrMessage: "internal: internal: specific ip not contained in any of the defined prefixes",
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: specific ip not contained in any of the defined prefixes",
 		},
 		{
 			name: "allocate a random ip with unavailable addressfamily",
@@ -616,8 +686,8 @@ func Test_ipServiceServer_Create(t *testing.T) {
 			},
 			want:           nil,
 			wantErr:        true,
-			wantReturnCode: connect.CodeInternal,
-			wantErrMessage: "internal: invalid_argument: there is no prefix for the given addressfamily:IPv4 present in network:tenant-network-v6 [IPv6]",
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: there is no prefix for the given addressfamily:IPv4 present in network:tenant-network-v6 [IPv6]",
 		},
 		{
 			name: "allocate a random ip with unavailable addressfamily",
@@ -629,8 +699,107 @@ func Test_ipServiceServer_Create(t *testing.T) {
 			},
 			want:           nil,
 			wantErr:        true,
-			wantReturnCode: connect.CodeInternal,
-			wantErrMessage: "internal: invalid_argument: there is no prefix for the given addressfamily:IPv6 present in network:tenant-network [IPv4]",
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: there is no prefix for the given addressfamily:IPv6 present in network:tenant-network [IPv4]",
+		},
+		{
+			name: "allocate a static ip in an ephemeral only network",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "ephemeral-only-network",
+				Project: "p1",
+				Type:    apiv2.IPType_IP_TYPE_STATIC.Enum(),
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+			wantErrMessage: "failed_precondition: network:ephemeral-only-network only allows ephemeral ips",
+		},
+		{
+			name: "allocate an ephemeral ip in an ephemeral only network",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "ephemeral-only-network",
+				Project: "p1",
+			},
+			want: &apiv2.IPServiceCreateResponse{
+				Ip: &apiv2.IP{Ip: "10.4.0.1", Network: "ephemeral-only-network", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL},
+			},
+		},
+		{
+			name: "allocate a specific ip in a network which does not allow specific ips",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "no-specific-ip-network",
+				Project: "p1",
+				Ip:      pointer.Pointer("10.5.0.10"),
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+			wantErrMessage: "failed_precondition: network:no-specific-ip-network does not allow allocation of specific ips",
+		},
+		{
+			name: "allocate a random ip in a network which does not allow specific ips",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "no-specific-ip-network",
+				Project: "p1",
+			},
+			want: &apiv2.IPServiceCreateResponse{
+				Ip: &apiv2.IP{Ip: "10.5.0.1", Network: "no-specific-ip-network", Project: "p1", Type: apiv2.IPType_IP_TYPE_EPHEMERAL},
+			},
+		},
+		{
+			name: "allocate a static ip which is marked as ephemeral firewall ip",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "internet",
+				Project: "p1",
+				Type:    apiv2.IPType_IP_TYPE_STATIC.Enum(),
+				Tags:    []string{tag.New(metal.TagFirewallEphemeralIP, "fw1")},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: ip with tag firewall.metal-stack.io/ephemeral-ip must be of type ephemeral but is static",
+		},
+		{
+			name: "allocate an ip in a suspended project",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network: "internet",
+				Project: "p3",
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+			wantErrMessage: "failed_precondition: project:p3 is suspended, no ips can be allocated",
+		},
+		{
+			name: "allocate a specific ip with addressfamily",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Network:       "internet",
+				Project:       "p1",
+				Ip:            pointer.Pointer("1.2.3.8"),
+				AddressFamily: apiv2.IPAddressFamily_IP_ADDRESS_FAMILY_V4.Enum(),
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: it is not possible to specify specificIP and addressfamily",
+		},
+		{
+			name: "allocate an ip without network",
+			ctx:  ctx,
+			rq: &apiv2.IPServiceCreateRequest{
+				Project: "p1",
+			},
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErrMessage: "invalid_argument: network should not be empty",
 		},
 	}
 	for _, tt := range tests {
@@ -668,7 +837,61 @@ func Test_ipServiceServer_Create(t *testing.T) {
 	}
 }
 
-// FIXME use repository
+func Test_ipServiceServer_CreatePrefixWarning(t *testing.T) {
+	container, c, err := test.StartRethink(t)
+	require.NoError(t, err)
+	defer func() {
+		_ = container.Terminate(context.Background())
+	}()
+	r := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: r.Addr()})
+
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	var logs bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	ds, err := generic.New(log, "metal", c)
+	require.NoError(t, err)
+
+	psc := mdmock.ProjectServiceClient{}
+	psc.On("Get", testifymock.Anything, &mdmv1.ProjectGetRequest{Id: "p1"}).Return(&mdmv1.ProjectResponse{
+		Project: &mdmv1.Project{
+			Meta: &mdmv1.Meta{Id: "p1"},
+		}}, nil)
+	mdc := mdm.NewMock(&psc, &mdmock.TenantServiceClient{}, nil, nil)
+
+	repo, err := repository.New(log, mdc, ds, ipam, rc, repository.Config{PrefixWarningThreshold: 75})
+	require.NoError(t, err)
+
+	_, err = repo.Network(nil).Create(ctx, &apiv2.NetworkServiceCreateRequest{Id: pointer.Pointer("internet"), Prefixes: []string{"1.2.3.0/29"}})
+	require.NoError(t, err)
+
+	i := &ipServiceServer{
+		log:  log,
+		repo: repo,
+	}
+
+	create := func() *connect.Response[apiv2.IPServiceCreateResponse] {
+		resp, err := i.Create(ctx, connect.NewRequest(&apiv2.IPServiceCreateRequest{Network: "internet", Project: "p1"}))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// network and broadcast address are acquired in ipam as well, these are 5 of 8 ips
+	for range 3 {
+		create()
+		require.NotContains(t, logs.String(), "prefix nearly exhausted")
+	}
+
+	// the allocation succeeds anyway, the warning is only logged
+	resp := create()
+	require.Equal(t, "1.2.3.4", resp.Msg.Ip.Ip)
+	require.Contains(t, logs.String(), `"msg":"prefix nearly exhausted"`)
+	require.Contains(t, logs.String(), `"warning":"prefix:1.2.3.0/29 of network:internet is 75% utilized (6/8 ips acquired), consider adding a prefix to the network"`)
+}
+
 func createIPs(t *testing.T, ctx context.Context, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient, prefixesMap map[string][]string, ips []*metal.IP) {
 	for prefix := range prefixesMap {
 		_, err := ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: prefix}))
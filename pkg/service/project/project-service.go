@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"sort"
+	"strings"
 	"time"
 
 	"connectrpc.com/connect"
@@ -30,6 +31,8 @@ type Config struct {
 	Repo         *repository.Repostore
 	InviteStore  invite.ProjectInviteStore
 	TokenStore   token.TokenStore
+	// ReleaseEphemeralIPs releases the ephemeral ips of a project on its deletion, otherwise all ips must be released before.
+	ReleaseEphemeralIPs bool
 }
 
 // FIXME use repo where possible
@@ -40,6 +43,8 @@ type projectServiceServer struct {
 	repo         *repository.Repostore
 	inviteStore  invite.ProjectInviteStore
 	tokenStore   token.TokenStore
+
+	releaseEphemeralIPs bool
 }
 
 func New(c Config) apiv2connect.ProjectServiceHandler {
@@ -49,6 +54,8 @@ func New(c Config) apiv2connect.ProjectServiceHandler {
 		inviteStore:  c.InviteStore,
 		tokenStore:   c.TokenStore,
 		repo:         c.Repo,
+
+		releaseEphemeralIPs: c.ReleaseEphemeralIPs,
 	}
 }
 
@@ -273,6 +280,22 @@ func (p *projectServiceServer) Delete(ctx context.Context, rq *connect.Request[a
 
 	// FIXME check for machines and networks first
 
+	if p.releaseEphemeralIPs {
+		release, err := p.repo.IP(&req.Project).ReleaseForProjectDeletion(ctx, req.Project)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("error releasing ephemeral ips: %w", err))
+		}
+		p.log.Info("released ephemeral ips of deleted project", "project", req.Project, "released", len(release.Released))
+
+		if len(release.Blocking) > 0 {
+			var blocking []string
+			for _, ip := range release.Blocking {
+				blocking = append(blocking, ip.IPAddress)
+			}
+			return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("there are still ips associated with this project which are not released automatically, you need to delete them first: %s", strings.Join(blocking, ", ")))
+		}
+	}
+
 	ips, err := p.repo.IP(&req.Project).List(ctx, &apiv1.IPQuery{Project: &req.Project})
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("error retrieving ips: %w", err))